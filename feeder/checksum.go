@@ -0,0 +1,282 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package feeder
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// checksumError is returned when an image file is not the one described by
+// its .metadata file
+type checksumError struct {
+	file     string
+	expected string
+	actual   string
+}
+
+func (e checksumError) Error() string {
+	return fmt.Sprintf("%s does not match its metadata: expected %s, got %s", e.file, e.expected, e.actual)
+}
+
+// verifyChecksum checks the size and the sha256 checksum of the image file
+// stored at path, described by metadata, by streaming it. The size is checked
+// first, sparing the reading of truncated files. Nothing is checked when the
+// metadata describes neither.
+func verifyChecksum(ctx context.Context, path string, metadata ImageType) error {
+	if metadata.SHA256 == "" && metadata.Size == 0 {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if metadata.Size > 0 {
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		if info.Size() != metadata.Size {
+			return checksumError{
+				file:     path,
+				expected: fmt.Sprintf("%d bytes", metadata.Size),
+				actual:   fmt.Sprintf("%d bytes", info.Size()),
+			}
+		}
+	}
+	if metadata.SHA256 == "" {
+		return nil
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, contextReader{ctx: ctx, r: file}); err != nil {
+		return fmt.Errorf("error reading %s: %v", path, err)
+	}
+	if actual := fmt.Sprintf("%x", h.Sum(nil)); actual != metadata.SHA256 {
+		return checksumError{
+			file:     path,
+			expected: "sha256:" + metadata.SHA256,
+			actual:   "sha256:" + actual,
+		}
+	}
+	return nil
+}
+
+// verifyChecksums checks the image files of the RPMs images, stored at the
+// paths of rpmImages, against the checksums of their .metadata files, for the
+// consumers that do not read them through an import. The images that do not
+// match are removed from rpmImages and returned with the reason. The files
+// recorded as verified in the journal are not read again.
+func (f *Feeder) verifyChecksums(ctx context.Context, rpmImages map[string]string, rpmMetadata map[string]ImageType) map[string]error {
+	failed := make(map[string]error)
+
+	for _, repotag := range sortedRepotags(rpmImages) {
+		metadata := rpmMetadata[repotag]
+		record := f.state.fileRecord(metadata)
+		if record != nil && metadata.SHA256 != "" && record.ImageChecksum == metadata.SHA256 {
+			log.Debugf("Image %s: %s is unchanged since its checksum has been verified", repotag, rpmImages[repotag])
+			continue
+		}
+
+		if err := verifyChecksum(ctx, rpmImages[repotag], metadata); err != nil {
+			log.Warnf("Image %s: %v", repotag, err)
+			failed[repotag] = err
+			delete(rpmImages, repotag)
+			continue
+		}
+		if record != nil {
+			record.ImageChecksum = metadata.SHA256
+		}
+	}
+	return failed
+}
+
+// checksumKey is the context key of the *imageChecksum of the image file
+// being imported
+type checksumKey struct{}
+
+// imageChecksum is the verification of an image file against the checksum of
+// its .metadata file, done while the file is read by its import instead of
+// reading it once more beforehand. It is shared by the imports of the image
+// into every target.
+type imageChecksum struct {
+	path     string
+	metadata ImageType
+
+	mu sync.Mutex
+	// set once the whole file matched its checksum
+	verified bool
+	// the mismatch found, if any
+	err error
+}
+
+// imageChecksums returns the verifications of the image files of the RPMs
+// images, by repotag. The images without checksum and the files recorded as
+// verified in the journal are left out.
+func (f *Feeder) imageChecksums(rpmImages map[string]string, rpmMetadata map[string]ImageType) map[string]*imageChecksum {
+	checksums := make(map[string]*imageChecksum)
+	for repotag, path := range rpmImages {
+		metadata := rpmMetadata[repotag]
+		if metadata.SHA256 == "" && metadata.Size == 0 {
+			continue
+		}
+		record := f.state.fileRecord(metadata)
+		if record != nil && metadata.SHA256 != "" && record.ImageChecksum == metadata.SHA256 {
+			log.Debugf("Image %s: %s is unchanged since its checksum has been verified", repotag, path)
+			continue
+		}
+		checksums[repotag] = &imageChecksum{path: path, metadata: metadata}
+	}
+	return checksums
+}
+
+// recordChecksums records the verified checksums in the journal
+func (f *Feeder) recordChecksums(checksums map[string]*imageChecksum) {
+	for _, c := range checksums {
+		c.mu.Lock()
+		verified := c.verified
+		c.mu.Unlock()
+		if !verified {
+			continue
+		}
+		if record := f.state.fileRecord(c.metadata); record != nil {
+			record.ImageChecksum = c.metadata.SHA256
+		}
+	}
+}
+
+// withChecksum returns a copy of ctx in which c is verified while its image
+// file is read by openDecompressed
+func withChecksum(ctx context.Context, c *imageChecksum) context.Context {
+	if c == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, checksumKey{}, c)
+}
+
+// checksumReader returns file, opened at path, verifying the checksum of ctx
+// while it is read when path is its image file. The size is checked first,
+// sparing the reading of truncated files.
+func checksumReader(ctx context.Context, path string, file *os.File) (io.Reader, error) {
+	c, ok := ctx.Value(checksumKey{}).(*imageChecksum)
+	if !ok || c.path != path {
+		return file, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return nil, c.err
+	}
+	if c.verified {
+		return file, nil
+	}
+	if c.metadata.Size > 0 {
+		info, err := file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if info.Size() != c.metadata.Size {
+			c.err = checksumError{
+				file:     path,
+				expected: fmt.Sprintf("%d bytes", c.metadata.Size),
+				actual:   fmt.Sprintf("%d bytes", info.Size()),
+			}
+			return nil, c.err
+		}
+	}
+	if c.metadata.SHA256 == "" {
+		c.verified = true
+		return file, nil
+	}
+	return &hashingReader{r: file, hash: sha256.New(), checksum: c}, nil
+}
+
+// hashingReader computes the sha256 checksum of the stream it reads and
+// compares it with its checksum at the end of the stream, returning the
+// mismatch in place of io.EOF
+type hashingReader struct {
+	r        io.Reader
+	hash     hash.Hash
+	checksum *imageChecksum
+}
+
+func (r *hashingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.hash.Write(p[:n])
+	if err != io.EOF {
+		return n, err
+	}
+
+	c := r.checksum
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if actual := fmt.Sprintf("%x", r.hash.Sum(nil)); actual != c.metadata.SHA256 {
+		c.err = checksumError{
+			file:     c.path,
+			expected: "sha256:" + c.metadata.SHA256,
+			actual:   "sha256:" + actual,
+		}
+		return n, c.err
+	}
+	c.verified = true
+	return n, err
+}
+
+// verify returns nil once the image file matched its checksum. The file is
+// read again only when its import did not read it entirely.
+func (c *imageChecksum) verify(ctx context.Context) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil || c.verified {
+		return c.err
+	}
+
+	err := verifyChecksum(ctx, c.path, c.metadata)
+	if _, ok := err.(checksumError); ok {
+		c.err = err
+	}
+	c.verified = err == nil
+	return err
+}
+
+// failure returns the checksum mismatch found while reading the image file,
+// the cause of the failed import, or err otherwise
+func (c *imageChecksum) failure(err error) error {
+	if c == nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	return err
+}
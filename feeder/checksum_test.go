@@ -0,0 +1,295 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package feeder
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	wlk "github.com/kubic-project/container-feeder/walker"
+)
+
+func TestVerifyChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-checksum")
+	if err != nil {
+		t.Fatalf("error while creating test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := filepath.Join(dir, "salt-api.tar.xz")
+	if err := ioutil.WriteFile(image, []byte("image"), 0644); err != nil {
+		t.Fatalf("error writing image: %v", err)
+	}
+	checksum := fmt.Sprintf("%x", sha256.Sum256([]byte("image")))
+	other := fmt.Sprintf("%x", sha256.Sum256([]byte("other image")))
+
+	for _, test := range []struct {
+		metadata ImageType
+		valid    bool
+	}{
+		{ImageType{}, true},
+		{ImageType{SHA256: checksum}, true},
+		{ImageType{SHA256: checksum, Size: 5}, true},
+		{ImageType{Size: 5}, true},
+		{ImageType{SHA256: other}, false},
+		{ImageType{SHA256: checksum, Size: 6}, false},
+		{ImageType{Size: 4}, false},
+	} {
+		err := verifyChecksum(context.Background(), image, test.metadata)
+		if test.valid && err != nil {
+			t.Errorf("%+v: unexpected error: %v", test.metadata, err)
+		} else if !test.valid {
+			if _, ok := err.(checksumError); !ok {
+				t.Errorf("%+v: expected checksum error, got %v", test.metadata, err)
+			}
+		}
+	}
+
+	if err := verifyChecksum(context.Background(), filepath.Join(dir, "missing.tar.xz"), ImageType{SHA256: checksum}); err == nil {
+		t.Error("error expected for a missing image file")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := verifyChecksum(ctx, image, ImageType{SHA256: checksum}); err == nil {
+		t.Error("error expected once the context is done")
+	}
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-checksum")
+	if err != nil {
+		t.Fatalf("error while creating test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := &Feeder{state: newFeederState()}
+	rpmImages := make(map[string]string)
+	rpmMetadata := make(map[string]ImageType)
+	for name, checksum := range map[string]string{
+		"salt-api":   fmt.Sprintf("%x", sha256.Sum256([]byte("image"))),
+		"tumbleweed": fmt.Sprintf("%x", sha256.Sum256([]byte("tampered"))),
+	} {
+		metadataFile := filepath.Join(dir, name+".metadata")
+		image := filepath.Join(dir, name+".tar.xz")
+		if err := ioutil.WriteFile(metadataFile, []byte("{}"), 0644); err != nil {
+			t.Fatalf("error writing metadata: %v", err)
+		}
+		if err := ioutil.WriteFile(image, []byte("image"), 0644); err != nil {
+			t.Fatalf("error writing image: %v", err)
+		}
+		f.state.updateFile(metadataFile, image, "", wlk.VerifierRPM)
+		repotag := "opensuse/" + name + ":13"
+		rpmImages[repotag] = image
+		rpmMetadata[repotag] = ImageType{SHA256: checksum, metadataFile: metadataFile}
+	}
+
+	failed := f.verifyChecksums(context.Background(), rpmImages, rpmMetadata)
+	if _, ok := failed["opensuse/tumbleweed:13"]; !ok || len(failed) != 1 {
+		t.Errorf("expected only the tampered image to fail, got %v", failed)
+	}
+	if _, ok := rpmImages["opensuse/tumbleweed:13"]; ok {
+		t.Error("expected the tampered image not to be imported")
+	}
+	if _, ok := rpmImages["opensuse/salt-api:13"]; !ok {
+		t.Error("expected the verified image to be imported")
+	}
+	record := f.state.fileRecord(rpmMetadata["opensuse/salt-api:13"])
+	if record == nil || record.ImageChecksum != rpmMetadata["opensuse/salt-api:13"].SHA256 {
+		t.Errorf("expected the verified checksum to be recorded, got %+v", record)
+	}
+
+	// the recorded checksum spares reading the unchanged file again: a
+	// tampering preserving its size and its modification time goes unnoticed
+	image := rpmImages["opensuse/salt-api:13"]
+	info, err := os.Stat(image)
+	if err != nil {
+		t.Fatalf("error reading image: %v", err)
+	}
+	if err := ioutil.WriteFile(image, []byte("IMAGE"), 0644); err != nil {
+		t.Fatalf("error writing image: %v", err)
+	}
+	if err := os.Chtimes(image, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatalf("error writing image: %v", err)
+	}
+	if failed := f.verifyChecksums(context.Background(), rpmImages, rpmMetadata); len(failed) != 0 {
+		t.Errorf("expected the recorded checksum to be trusted, got %v", failed)
+	}
+}
+
+// streamingFeeder is a fakeFeeder reading the files it loads, only their
+// first byte when partial is set
+type streamingFeeder struct {
+	fakeFeeder
+	partial bool
+}
+
+func (f *streamingFeeder) LoadImage(ctx context.Context, path, format string) (string, error) {
+	stream, err := openDecompressed(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	defer stream.Close()
+
+	if f.partial {
+		_, err = stream.Read(make([]byte, 1))
+	} else {
+		_, err = ioutil.ReadAll(stream)
+	}
+	if err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func TestImportImagesChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-checksum")
+	if err != nil {
+		t.Fatalf("error while creating test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := &Feeder{state: newFeederState()}
+	rpmImages := make(map[string]string)
+	rpmImageTags := make(map[string][]string)
+	rpmMetadata := make(map[string]ImageType)
+	checksum := fmt.Sprintf("%x", sha256.Sum256([]byte("image")))
+	for name, content := range map[string]string{
+		"salt-api":   "image",
+		"tumbleweed": "IMAGE",
+		"leap":       "image!",
+	} {
+		metadataFile := filepath.Join(dir, name+".metadata")
+		image := filepath.Join(dir, name+".tar")
+		if err := ioutil.WriteFile(metadataFile, []byte("{}"), 0644); err != nil {
+			t.Fatalf("error writing metadata: %v", err)
+		}
+		if err := ioutil.WriteFile(image, []byte(content), 0644); err != nil {
+			t.Fatalf("error writing image: %v", err)
+		}
+		f.state.updateFile(metadataFile, image, "", wlk.VerifierRPM)
+		repotag := "docker.io/opensuse/" + name + ":13"
+		rpmImages[repotag] = image
+		rpmImageTags[repotag] = []string{repotag}
+		rpmMetadata[repotag] = ImageType{SHA256: checksum, Size: 5, metadataFile: metadataFile}
+	}
+
+	// the checksum is read again when the engine did not read the whole
+	// file, and computed while the image is loaded otherwise: the tampered
+	// image is only loaded into crio
+	docker := &streamingFeeder{
+		fakeFeeder: fakeFeeder{images: []string{"docker.io/opensuse/tumbleweed:13"}},
+		partial:    true,
+	}
+	crio := &streamingFeeder{}
+	f.targets = []target{{name: "docker", feeder: docker}, {name: "crio", feeder: crio}}
+	res := f.importImages(context.Background(), rpmImages, rpmImageTags, rpmMetadata)
+
+	if len(res.SuccessfulImports) != 2 {
+		t.Errorf("unexpected successful imports: %+v", res.SuccessfulImports)
+	}
+	for _, imported := range res.SuccessfulImports {
+		if imported.Image != "docker.io/opensuse/salt-api:13" {
+			t.Errorf("unexpected successful import: %+v", imported)
+		}
+	}
+	if len(res.FailedImports) != 3 {
+		t.Errorf("unexpected failed imports: %+v", res.FailedImports)
+	}
+	for _, failed := range res.FailedImports {
+		if failed.Category != CategoryChecksum {
+			t.Errorf("unexpected failed import: %+v", failed)
+		}
+	}
+	if len(docker.images) != 2 || !stringInSlice("docker.io/opensuse/salt-api:13", docker.images) {
+		t.Errorf("unexpected images: %v", docker.images)
+	}
+	if len(crio.images) != 1 || crio.images[0] != "docker.io/opensuse/salt-api:13" {
+		t.Errorf("unexpected images: %v", crio.images)
+	}
+
+	record := f.state.fileRecord(rpmMetadata["docker.io/opensuse/salt-api:13"])
+	if record == nil || record.ImageChecksum != checksum {
+		t.Errorf("expected the verified checksum to be recorded, got %+v", record)
+	}
+	if record := f.state.fileRecord(rpmMetadata["docker.io/opensuse/tumbleweed:13"]); record == nil || record.ImageChecksum != "" {
+		t.Errorf("unexpected recorded checksum: %+v", record)
+	}
+}
+
+func TestFindRPMImagesChecksumVerification(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-checksum")
+	if err != nil {
+		t.Fatalf("error while creating test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	checksum := fmt.Sprintf("%x", sha256.Sum256([]byte("image")))
+	for name, content := range map[string]string{
+		"salt-api":   fmt.Sprintf(`{"image": {"name": "opensuse/salt-api", "tags": ["13"], "file": "salt-api.tar.xz", "sha256": "%s"}}`, checksum),
+		"tumbleweed": `{"image": {"name": "opensuse/tumbleweed", "tags": ["13"], "file": "tumbleweed.tar.xz"}}`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name+".metadata"), []byte(content), 0644); err != nil {
+			t.Fatalf("error writing metadata: %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name+".tar.xz"), []byte("image"), 0644); err != nil {
+			t.Fatalf("error writing image: %v", err)
+		}
+	}
+
+	// no RPM database is involved
+	rpmImages, _, _, _, err := findRPMImages([]string{dir}, nil, FeederConfig{Verification: wlk.VerifierChecksum})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(rpmImages) != 1 || rpmImages["docker.io/opensuse/salt-api:13"] == "" {
+		t.Errorf("expected only the image with a checksum to be found, got %v", rpmImages)
+	}
+}
+
+func TestChecksumMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-checksum")
+	if err != nil {
+		t.Fatalf("error while creating test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	checksum := fmt.Sprintf("%x", sha256.Sum256([]byte("image")))
+	for metadata, valid := range map[string]bool{
+		fmt.Sprintf(`{"image": {"name": "opensuse/salt-api", "tags": ["13"], "file": "salt-api.tar.xz", "sha256": "%s", "size": 5}}`, checksum): true,
+		`{"image": {"name": "opensuse/salt-api", "tags": ["13"], "file": "salt-api.tar.xz", "sha256": "42"}}`:                                   false,
+		fmt.Sprintf(`{"image": {"name": "opensuse/salt-api", "tags": ["13"], "file": "salt-api.tar.xz", "sha256": "sha256:%s"}}`, checksum):     false,
+		`{"image": {"name": "opensuse/salt-api", "tags": ["13"], "file": "salt-api.tar.xz", "size": -1}}`:                                       false,
+		`{"image": {"name": "opensuse/salt-api", "tags": ["13"], "file": "salt-api", "format": "oci", "size": 5}}`:                              false,
+	} {
+		file := filepath.Join(dir, "salt-api.metadata")
+		if err := ioutil.WriteFile(file, []byte(metadata), 0644); err != nil {
+			t.Fatalf("error writing metadata: %v", err)
+		}
+		_, _, _, err := repotagFromRPMFile(file)
+		if valid && err != nil {
+			t.Errorf("unexpected error for %s: %v", metadata, err)
+		} else if !valid && err == nil {
+			t.Errorf("error expected for %s", metadata)
+		}
+	}
+}
@@ -0,0 +1,414 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package feeder
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	wlk "github.com/kubic-project/container-feeder/walker"
+	log "github.com/sirupsen/logrus"
+)
+
+// The policies resolving a repotag claimed by more than one .metadata file
+const (
+	// refuse to import anything (default)
+	conflictFail = "fail"
+	// the image shipped by the newest package wins
+	conflictNewest = "newest"
+	// the image with the highest "priority" field wins
+	conflictPriority = "priority"
+)
+
+// validConflictPolicy returns an error if policy is unknown
+func validConflictPolicy(policy string) error {
+	switch policy {
+	case "", conflictFail, conflictNewest, conflictPriority:
+		return nil
+	}
+	return fmt.Errorf("unknown conflict policy '%s'", policy)
+}
+
+// rpmImage is an image found inside of the RPMs directory
+type rpmImage struct {
+	repotag  string
+	tags     []string
+	file     string
+	metadata ImageType
+	// the package shipping the .metadata file, empty when unknown
+	nevra string
+	// the verifier which found the package shipping it
+	verification string
+}
+
+// describe returns the .metadata file and the package shipping it
+func (i rpmImage) describe() string {
+	nevra := i.nevra
+	if nevra == "" {
+		nevra = "unknown RPM"
+	}
+	return fmt.Sprintf("%s (%s)", i.metadata.metadataFile, nevra)
+}
+
+// conflictError is the error failing the images claiming a repotag that
+// the conflict policy cannot give to a single image
+type conflictError struct {
+	// the .metadata file of the failed image
+	metadataFile string
+	conflicts    []string
+}
+
+func (e conflictError) Error() string {
+	return fmt.Sprintf("conflicting repotags: %s", strings.Join(e.conflicts, "; "))
+}
+
+// resolveConflicts makes sure every repotag is claimed by a single image,
+// following policy. The images losing their main repotag are dropped, the
+// ones losing one of their additional tags are imported without it. The
+// images involved in a conflict that cannot be resolved are dropped as well
+// and returned by repotag, with a conflictError listing the files and the RPMs
+// involved.
+func resolveConflicts(images []rpmImage, policy string) ([]rpmImage, map[string]error) {
+	claims := make(map[string][]int)
+	for i, image := range images {
+		claimed := make(map[string]bool)
+		for _, repotag := range append([]string{image.repotag}, image.tags...) {
+			// an image listing a tag twice does not conflict with itself
+			if claimed[repotag] {
+				continue
+			}
+			claimed[repotag] = true
+			claims[repotag] = append(claims[repotag], i)
+		}
+	}
+	repotags := []string{}
+	for repotag, claimants := range claims {
+		if len(claimants) > 1 {
+			repotags = append(repotags, repotag)
+		}
+	}
+	sort.Strings(repotags)
+
+	dropped := make(map[int]bool)
+	failed := make(map[int][]string)
+	for _, repotag := range repotags {
+		claimants := claims[repotag]
+		described := []string{}
+		for _, i := range claimants {
+			described = append(described, images[i].describe())
+		}
+		conflict := fmt.Sprintf("%s is claimed by %s", repotag, strings.Join(described, " and "))
+
+		winner, err := conflictWinner(images, claimants, policy)
+		if err != nil {
+			for _, i := range claimants {
+				failed[i] = append(failed[i], fmt.Sprintf("%s: %v", conflict, err))
+			}
+			continue
+		}
+		log.Warnf("%s: using %s", conflict, images[winner].metadata.metadataFile)
+		for _, i := range claimants {
+			if i == winner {
+				continue
+			}
+			if images[i].repotag == repotag {
+				dropped[i] = true
+				continue
+			}
+			tags := []string{}
+			for _, tag := range images[i].tags {
+				if tag != repotag {
+					tags = append(tags, tag)
+				}
+			}
+			images[i].tags = tags
+		}
+	}
+	resolved := []rpmImage{}
+	conflicting := make(map[string]error)
+	for i, image := range images {
+		if conflicts, ok := failed[i]; ok {
+			conflicting[image.repotag] = conflictError{metadataFile: image.metadata.metadataFile, conflicts: conflicts}
+			continue
+		}
+		if !dropped[i] {
+			resolved = append(resolved, image)
+		}
+	}
+	return resolved, conflicting
+}
+
+// conflictWinner returns which of the claimants of a repotag keeps it
+// according to policy
+func conflictWinner(images []rpmImage, claimants []int, policy string) (int, error) {
+	var compare func(a, b rpmImage) int
+	switch policy {
+	case conflictNewest:
+		verification := images[claimants[0]].verification
+		for _, i := range claimants {
+			if images[i].nevra == "" {
+				return 0, fmt.Errorf("the package shipping %s is unknown", images[i].metadata.metadataFile)
+			}
+			if images[i].verification != verification {
+				return 0, fmt.Errorf("cannot compare packages verified by %s and %s", verification, images[i].verification)
+			}
+		}
+		switch verification {
+		case wlk.VerifierRPM:
+			compare = func(a, b rpmImage) int {
+				return compareNEVRA(a.nevra, b.nevra)
+			}
+		case wlk.VerifierDpkg:
+			compare = func(a, b rpmImage) int {
+				return compareDpkgPackages(a.nevra, b.nevra)
+			}
+		default:
+			return 0, fmt.Errorf("the %s policy needs packages verified by %s or %s", policy, wlk.VerifierRPM, wlk.VerifierDpkg)
+		}
+	case conflictPriority:
+		compare = func(a, b rpmImage) int {
+			return a.metadata.Priority - b.metadata.Priority
+		}
+	default:
+		return 0, fmt.Errorf("set conflict-policy to \"newest\" or \"priority\" to pick one")
+	}
+
+	winner, tie := claimants[0], false
+	for _, i := range claimants[1:] {
+		switch c := compare(images[i], images[winner]); {
+		case c > 0:
+			winner, tie = i, false
+		case c == 0:
+			tie = true
+		}
+	}
+	if tie {
+		return 0, fmt.Errorf("the %s policy cannot pick one of them", policy)
+	}
+	return winner, nil
+}
+
+// compareNEVRA compares the epoch, version and release of two packages
+// formatted as name-epoch:version-release.arch, the way rpm does
+func compareNEVRA(a, b string) int {
+	aEpoch, aVersion, aRelease := splitNEVRA(a)
+	bEpoch, bVersion, bRelease := splitNEVRA(b)
+	if c := rpmvercmp(aEpoch, bEpoch); c != 0 {
+		return c
+	}
+	if c := rpmvercmp(aVersion, bVersion); c != 0 {
+		return c
+	}
+	return rpmvercmp(aRelease, bRelease)
+}
+
+// splitNEVRA returns the epoch, version and release of a package formatted as
+// name-epoch:version-release.arch
+func splitNEVRA(nevra string) (string, string, string) {
+	if i := strings.LastIndex(nevra, "."); i >= 0 {
+		nevra = nevra[:i]
+	}
+	release := ""
+	if i := strings.LastIndex(nevra, "-"); i >= 0 {
+		nevra, release = nevra[:i], nevra[i+1:]
+	}
+	if i := strings.LastIndex(nevra, "-"); i >= 0 {
+		nevra = nevra[i+1:]
+	}
+	epoch := "0"
+	if i := strings.Index(nevra, ":"); i >= 0 {
+		epoch, nevra = nevra[:i], nevra[i+1:]
+	}
+	return epoch, nevra, release
+}
+
+// rpmvercmp compares two version strings like rpm does: they are split into
+// numeric and alphabetic segments, numeric segments are newer than alphabetic
+// ones and a "~" sorts before anything, even the end of the string.
+func rpmvercmp(a, b string) int {
+	isSeparator := func(r rune) bool {
+		return !isAlnum(r) && r != '~'
+	}
+	for {
+		a = strings.TrimLeftFunc(a, isSeparator)
+		b = strings.TrimLeftFunc(b, isSeparator)
+
+		aTilde, bTilde := strings.HasPrefix(a, "~"), strings.HasPrefix(b, "~")
+		if aTilde || bTilde {
+			if !aTilde {
+				return 1
+			}
+			if !bTilde {
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+		if a == "" || b == "" {
+			break
+		}
+
+		segment := isLetter
+		numeric := isDigit(rune(a[0]))
+		if numeric {
+			segment = isDigit
+		}
+		aSegment := leading(a, segment)
+		bSegment := leading(b, segment)
+		if bSegment == "" {
+			if numeric {
+				return 1
+			}
+			return -1
+		}
+		a, b = a[len(aSegment):], b[len(bSegment):]
+
+		if numeric {
+			aSegment = strings.TrimLeft(aSegment, "0")
+			bSegment = strings.TrimLeft(bSegment, "0")
+			if len(aSegment) != len(bSegment) {
+				if len(aSegment) > len(bSegment) {
+					return 1
+				}
+				return -1
+			}
+		}
+		if c := strings.Compare(aSegment, bSegment); c != 0 {
+			return c
+		}
+	}
+
+	switch {
+	case a == "" && b == "":
+		return 0
+	case a == "":
+		return -1
+	}
+	return 1
+}
+
+// compareDpkgPackages compares the epoch, upstream version and revision of
+// two packages formatted as name_epoch:upstream-revision_arch, the way dpkg
+// does
+func compareDpkgPackages(a, b string) int {
+	aEpoch, aUpstream, aRevision := splitDpkgPackage(a)
+	bEpoch, bUpstream, bRevision := splitDpkgPackage(b)
+	switch {
+	case aEpoch > bEpoch:
+		return 1
+	case aEpoch < bEpoch:
+		return -1
+	}
+	if c := verrevcmp(aUpstream, bUpstream); c != 0 {
+		return c
+	}
+	return verrevcmp(aRevision, bRevision)
+}
+
+// splitDpkgPackage returns the epoch, upstream version and revision of a
+// package formatted as name_epoch:upstream-revision_arch
+func splitDpkgPackage(pkg string) (int, string, string) {
+	version := pkg
+	if i := strings.Index(version, "_"); i >= 0 {
+		version = version[i+1:]
+	}
+	if i := strings.LastIndex(version, "_"); i >= 0 {
+		version = version[:i]
+	}
+	epoch := 0
+	if i := strings.Index(version, ":"); i >= 0 {
+		epoch, _ = strconv.Atoi(version[:i])
+		version = version[i+1:]
+	}
+	revision := ""
+	if i := strings.LastIndex(version, "-"); i >= 0 {
+		version, revision = version[:i], version[i+1:]
+	}
+	return epoch, version, revision
+}
+
+// verrevcmp compares two version strings like dpkg does: non-digit segments
+// are compared character by character, with letters sorting before the
+// other characters and "~" before anything, even the end of the string, and
+// digit segments are compared numerically.
+func verrevcmp(a, b string) int {
+	order := func(s string) int {
+		switch {
+		case s == "", isDigit(rune(s[0])):
+			return 0
+		case isLetter(rune(s[0])):
+			return int(s[0])
+		case s[0] == '~':
+			return -1
+		}
+		return int(s[0]) + 256
+	}
+	for a != "" || b != "" {
+		for (a != "" && !isDigit(rune(a[0]))) || (b != "" && !isDigit(rune(b[0]))) {
+			aOrder, bOrder := order(a), order(b)
+			if aOrder != bOrder {
+				if aOrder > bOrder {
+					return 1
+				}
+				return -1
+			}
+			a, b = a[1:], b[1:]
+		}
+
+		aSegment := strings.TrimLeft(leading(a, isDigit), "0")
+		bSegment := strings.TrimLeft(leading(b, isDigit), "0")
+		a, b = strings.TrimLeft(a, "0123456789"), strings.TrimLeft(b, "0123456789")
+		if len(aSegment) != len(bSegment) {
+			if len(aSegment) > len(bSegment) {
+				return 1
+			}
+			return -1
+		}
+		if c := strings.Compare(aSegment, bSegment); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// isLetter returns true for ASCII letters
+func isLetter(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+}
+
+// isDigit returns true for ASCII digits
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+// isAlnum returns true for ASCII letters and digits
+func isAlnum(r rune) bool {
+	return isLetter(r) || isDigit(r)
+}
+
+// leading returns the prefix of s made of the characters matching f
+func leading(s string, f func(rune) bool) string {
+	for i, r := range s {
+		if !f(r) {
+			return s[:i]
+		}
+	}
+	return s
+}
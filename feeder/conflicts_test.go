@@ -0,0 +1,231 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package feeder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	wlk "github.com/kubic-project/container-feeder/walker"
+)
+
+func TestCompareNEVRA(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"salt-api-0:13-1.1.x86_64", "salt-api-0:13-1.1.x86_64", 0},
+		{"salt-api-0:13-1.2.x86_64", "salt-api-0:13-1.10.x86_64", -1},
+		{"salt-api-0:14-1.1.x86_64", "salt-api-0:13-1.9.x86_64", 1},
+		{"salt-api-1:2-1.1.x86_64", "salt-api-0:13-1.1.x86_64", 1},
+		{"salt-api-0:2017.03-1.1.x86_64", "salt-api-0:2017.3-1.1.x86_64", 0},
+		{"salt-api-0:1.0~rc1-1.1.x86_64", "salt-api-0:1.0-1.1.x86_64", -1},
+		{"salt-api-0:1.0a-1.1.x86_64", "salt-api-0:1.0-1.1.x86_64", 1},
+		{"salt-api-0:1.a-1.1.x86_64", "salt-api-0:1.1-1.1.x86_64", -1},
+	}
+	for _, test := range tests {
+		if c := compareNEVRA(test.a, test.b); c != test.expected {
+			t.Errorf("compareNEVRA(%s, %s): expected %d, got %d", test.a, test.b, test.expected, c)
+		}
+	}
+}
+
+func TestCompareDpkgPackages(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"salt-api_1.0-1_amd64", "salt-api_1.0-1_amd64", 0},
+		{"salt-api_1.0-2_amd64", "salt-api_1.0-1_amd64", 1},
+		{"salt-api_1.10-1_amd64", "salt-api_1.9-1_amd64", 1},
+		{"salt-api_1:1.0-1_amd64", "salt-api_2.0-1_amd64", 1},
+		{"salt-api_1.0~rc1-1_amd64", "salt-api_1.0-1_amd64", -1},
+		{"salt-api_1.0a-1_amd64", "salt-api_1.0-1_amd64", 1},
+		{"salt-api_1.0a-1_amd64", "salt-api_1.0+-1_amd64", -1},
+		{"salt-api_1.0-1ubuntu1_amd64", "salt-api_1.0-1_amd64", 1},
+		{"salt-api_1.0_all", "salt-api_1.0-0_all", 0},
+	}
+	for _, test := range tests {
+		if c := compareDpkgPackages(test.a, test.b); c != test.expected {
+			t.Errorf("compareDpkgPackages(%s, %s): expected %d, got %d", test.a, test.b, test.expected, c)
+		}
+	}
+}
+
+func TestResolveConflicts(t *testing.T) {
+	images := func() []rpmImage {
+		return []rpmImage{
+			{
+				repotag:      "docker.io/opensuse/salt-api:13",
+				tags:         []string{"docker.io/opensuse/salt-api:latest"},
+				metadata:     ImageType{metadataFile: "/salt-api-13.metadata", Priority: 1},
+				nevra:        "salt-api-13-0:13-1.1.x86_64",
+				verification: wlk.VerifierRPM,
+			},
+			{
+				repotag:      "docker.io/opensuse/salt-api:14",
+				tags:         []string{"docker.io/opensuse/salt-api:latest"},
+				metadata:     ImageType{metadataFile: "/salt-api-14.metadata"},
+				nevra:        "salt-api-14-0:14-1.1.x86_64",
+				verification: wlk.VerifierRPM,
+			},
+		}
+	}
+
+	// only the conflicting images fail
+	unrelated := append(images(), rpmImage{
+		repotag:  "docker.io/opensuse/velum:1",
+		metadata: ImageType{metadataFile: "/velum.metadata"},
+	})
+	resolved, conflicts := resolveConflicts(unrelated, "")
+	if len(resolved) != 1 || resolved[0].repotag != "docker.io/opensuse/velum:1" {
+		t.Errorf("unexpected images: %+v", resolved)
+	}
+	if len(conflicts) != 2 {
+		t.Fatalf("expected both images to conflict: %v", conflicts)
+	}
+	for _, repotag := range []string{"docker.io/opensuse/salt-api:13", "docker.io/opensuse/salt-api:14"} {
+		err := conflicts[repotag]
+		if err == nil {
+			t.Errorf("expected %s to conflict", repotag)
+			continue
+		}
+		for _, s := range []string{"/salt-api-13.metadata", "salt-api-13-0:13-1.1.x86_64", "/salt-api-14.metadata", "salt-api-14-0:14-1.1.x86_64"} {
+			if !strings.Contains(err.Error(), s) {
+				t.Errorf("expected %s in the error: %v", s, err)
+			}
+		}
+	}
+
+	// the loser is imported without the tag
+	resolved, conflicts = resolveConflicts(images(), conflictNewest)
+	if len(conflicts) != 0 {
+		t.Fatalf("unexpected conflicts: %v", conflicts)
+	}
+	if len(resolved) != 2 || len(resolved[0].tags) != 0 || len(resolved[1].tags) != 1 {
+		t.Errorf("unexpected images: %+v", resolved)
+	}
+
+	resolved, conflicts = resolveConflicts(images(), conflictPriority)
+	if len(conflicts) != 0 {
+		t.Fatalf("unexpected conflicts: %v", conflicts)
+	}
+	if len(resolved) != 2 || len(resolved[0].tags) != 1 || len(resolved[1].tags) != 0 {
+		t.Errorf("unexpected images: %+v", resolved)
+	}
+
+	// the loser of its main repotag is dropped
+	same := images()
+	same[1].repotag = same[0].repotag
+	resolved, conflicts = resolveConflicts(same, conflictNewest)
+	if len(conflicts) != 0 {
+		t.Fatalf("unexpected conflicts: %v", conflicts)
+	}
+	if len(resolved) != 1 || resolved[0].metadata.metadataFile != "/salt-api-14.metadata" {
+		t.Errorf("unexpected images: %+v", resolved)
+	}
+
+	// ties and unknown RPMs cannot be resolved
+	tie := images()
+	tie[1].metadata.Priority = 1
+	if _, conflicts := resolveConflicts(tie, conflictPriority); len(conflicts) != 2 {
+		t.Error("expected tie to be reported")
+	}
+	unknown := images()
+	unknown[0].nevra = ""
+	if _, conflicts := resolveConflicts(unknown, conflictNewest); len(conflicts) != 2 {
+		t.Error("expected unknown RPM to be reported")
+	}
+
+	// only the versions of packages of the same kind can be compared
+	mixed := images()
+	mixed[0].verification = wlk.VerifierDpkg
+	if _, conflicts := resolveConflicts(mixed, conflictNewest); len(conflicts) != 2 {
+		t.Error("expected packages of different kinds to be reported")
+	}
+	checksum := images()
+	checksum[0].verification = wlk.VerifierChecksum
+	checksum[1].verification = wlk.VerifierChecksum
+	if _, conflicts := resolveConflicts(checksum, conflictNewest); len(conflicts) != 2 {
+		t.Error("expected images without package to be reported")
+	}
+
+	// Debian packages are compared like dpkg does
+	dpkg := images()
+	dpkg[0].nevra = "salt-api_1:13-1_amd64"
+	dpkg[0].verification = wlk.VerifierDpkg
+	dpkg[1].nevra = "salt-api_14-1_amd64"
+	dpkg[1].verification = wlk.VerifierDpkg
+	resolved, conflicts = resolveConflicts(dpkg, conflictNewest)
+	if len(conflicts) != 0 {
+		t.Fatalf("unexpected conflicts: %v", conflicts)
+	}
+	if len(resolved) != 2 || len(resolved[0].tags) != 1 || len(resolved[1].tags) != 0 {
+		t.Errorf("unexpected images: %+v", resolved)
+	}
+
+	// an image listing a tag twice does not conflict with itself
+	twice := images()[:1]
+	twice[0].tags = []string{"docker.io/opensuse/salt-api:latest", "docker.io/opensuse/salt-api:13"}
+	if resolved, conflicts := resolveConflicts(twice, ""); len(conflicts) != 0 || len(resolved) != 1 {
+		t.Errorf("unexpected conflicts: %v", conflicts)
+	}
+}
+
+func TestFindRPMImagesConflicts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-conflicts")
+	if err != nil {
+		t.Fatalf("error while creating test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	state := newFeederState()
+	for file, content := range map[string]string{
+		"a.metadata": `{"image": {"name": "opensuse/salt-api", "tags": ["13"], "file": "a.tar.xz"}}`,
+		"b.metadata": `{"image": {"name": "opensuse/salt-api", "tags": ["13"], "file": "b.tar.xz", "priority": 5}}`,
+	} {
+		metadata := filepath.Join(dir, file)
+		image := strings.TrimSuffix(metadata, ".metadata") + ".tar.xz"
+		if err := ioutil.WriteFile(metadata, []byte(content), 0644); err != nil {
+			t.Fatalf("error writing metadata: %v", err)
+		}
+		if err := ioutil.WriteFile(image, []byte("image"), 0644); err != nil {
+			t.Fatalf("error writing image: %v", err)
+		}
+		// the verification is skipped: no rpm is needed
+		state.updateFile(metadata, image, "", wlk.VerifierRPM)
+	}
+
+	_, _, _, conflicts, err := findRPMImages([]string{dir}, state, FeederConfig{ConflictPolicy: conflictFail})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(conflicts) != 1 {
+		t.Errorf("expected conflict to be reported: %v", conflicts)
+	}
+	rpmImages, _, _, _, err := findRPMImages([]string{dir}, state, FeederConfig{ConflictPolicy: conflictPriority})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rpmImages["docker.io/opensuse/salt-api:13"] != filepath.Join(dir, "b.tar.xz") {
+		t.Errorf("unexpected images: %v", rpmImages)
+	}
+}
@@ -0,0 +1,196 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package feeder
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// the default containerd socket
+	defaultContainerdAddress = "/run/containerd/containerd.sock"
+	// the namespace used by the CRI plugin of containerd, hence by kubelet
+	defaultContainerdNamespace = "k8s.io"
+)
+
+// ContainerdConfig holds the containerd specific settings of the
+// container-feeder.json config
+type ContainerdConfig struct {
+	Address   string `json:"address,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// ContainerdFeeder imports images into containerd by means of the ctr client.
+type ContainerdFeeder struct {
+	ctr       string
+	address   string
+	namespace string
+}
+
+// NewContainerdFeeder returns a pointer to an initialized ContainerdFeeder.
+// Takes care of checking that the containerd daemon is reachable.
+func NewContainerdFeeder(ctx context.Context, config ContainerdConfig) (*ContainerdFeeder, error) {
+	feeder := &ContainerdFeeder{
+		ctr:       ctrClient,
+		address:   config.Address,
+		namespace: config.Namespace,
+	}
+	if feeder.address == "" {
+		feeder.address = defaultContainerdAddress
+	}
+	if feeder.namespace == "" {
+		feeder.namespace = defaultContainerdNamespace
+	}
+
+	if _, err := feeder.run(ctx, "version"); err != nil {
+		return nil, fmt.Errorf("error connecting to containerd: %v", err)
+	}
+
+	return feeder, nil
+}
+
+// run executes ctr against the configured socket and namespace and returns
+// its standard output. ctr is killed once ctx is done.
+func (f *ContainerdFeeder) run(ctx context.Context, args ...string) ([]byte, error) {
+	return f.runWithInput(ctx, nil, args...)
+}
+
+// runWithInput works like run, feeding stdin to ctr.
+func (f *ContainerdFeeder) runWithInput(ctx context.Context, stdin io.Reader, args ...string) ([]byte, error) {
+	args = append([]string{"--address", f.address, "--namespace", f.namespace}, args...)
+	log.Debugf("Running %s %s", f.ctr, strings.Join(args, " "))
+
+	cmd := exec.CommandContext(ctx, f.ctr, args...)
+	cmd.Stdin = stdin
+	out, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+			return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+// Images returns images available in the containerd namespace in the form
+// "<repo>:<tag>" with the digest of their manifest.
+func (f *ContainerdFeeder) Images(ctx context.Context) (map[string]ImageID, error) {
+	tags := make(map[string]ImageID)
+
+	out, err := f.run(ctx, "images", "list")
+	if err != nil {
+		return nil, fmt.Errorf("error listing containerd images: %v", err)
+	}
+
+	// REF TYPE DIGEST SIZE PLATFORMS LABELS
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] == "REF" {
+			continue
+		}
+		ref := fields[0]
+		// the CRI plugin also references images by their ID or digest
+		if strings.HasPrefix(ref, "sha256:") || strings.Contains(ref, "@") {
+			continue
+		}
+		normalizedName, normalizedTag, err := normalizeNameTag(ref)
+		if err != nil {
+			return nil, err
+		}
+		tags[normalizedName+":"+normalizedTag] = ImageID{Manifest: fields[2]}
+	}
+
+	return tags, nil
+}
+
+// LoadImage imports the specified image into containerd and returns the name
+// of the imported image. Both docker-archive and oci-archive images are
+// understood by ctr.
+func (f *ContainerdFeeder) LoadImage(ctx context.Context, path, format string) (string, error) {
+	if format != dockerArchiveFormat && format != ociArchiveFormat {
+		return "", unsupportedFormatError("containerd", format)
+	}
+
+	// containerd does not understand xz compressed archives: stream the
+	// decompressed archive to ctr
+	image, err := openDecompressed(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	defer image.Close()
+
+	out, err := f.runWithInput(ctx, image, "images", "import", "-")
+	if err != nil {
+		return "", fmt.Errorf("error importing image: %v", err)
+	}
+
+	// ctr prints "unpacking <name> (<digest>)...done" for every imported image
+	imgName := ""
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "unpacking" {
+			imgName = fields[1]
+			break
+		}
+	}
+
+	log.Debugf("Loaded image: %v", imgName)
+	return imgName, nil
+}
+
+// TagImage tags the specified image with the supplied tags.
+func (f *ContainerdFeeder) TagImage(ctx context.Context, image string, tags []string) error {
+	for _, tag := range tags {
+		log.Debug("Tagging image: ", image, " with ", tag)
+		if _, err := f.run(ctx, "images", "tag", "--force", image, tag); err != nil {
+			return fmt.Errorf("error tagging image: %v", err)
+		}
+	}
+	return nil
+}
+
+// RemoveImage removes the specified image reference; containerd garbage
+// collects the content no longer referenced.
+func (f *ContainerdFeeder) RemoveImage(ctx context.Context, image string) error {
+	log.Debug("Removing image: ", image)
+	if _, err := f.run(ctx, "images", "remove", image); err != nil {
+		return fmt.Errorf("error removing image: %v", err)
+	}
+	return nil
+}
+
+// the messages of the errors returned by ctr while containerd is starting or
+// busy
+var transientContainerdErrors = []string{
+	"failed to dial",
+	"connection refused",
+	"code = Unavailable",
+	"transport is closing",
+	"resource temporarily unavailable",
+}
+
+// isTransientContainerdError returns true if err is worth retrying
+func isTransientContainerdError(err error) bool {
+	return errorContainsAny(err, transientContainerdErrors)
+}
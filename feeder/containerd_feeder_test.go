@@ -0,0 +1,134 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package feeder
+
+import (
+	"archive/tar"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeCtr is a stand-in for the ctr client: it records its arguments and
+// answers like a containerd daemon holding a single image.
+const fakeCtr = `#!/bin/sh
+echo "$@" >> "$(dirname "$0")/calls"
+while [ $# -gt 0 ]; do
+	case "$1" in
+	--address|--namespace) shift 2 ;;
+	*) break ;;
+	esac
+done
+case "$1 $2" in
+"images list")
+	echo "REF                              TYPE                                                 DIGEST                                                                  SIZE    PLATFORMS   LABELS"
+	echo "docker.io/library/busybox:latest application/vnd.docker.distribution.manifest.v2+json sha256:58ac43b2cc92c687a32c8be6278e50a063579655fe3090125dcb2af0ff9e1a64 716.1 KiB linux/amd64 io.cri-containerd.image=managed"
+	echo "sha256:3fbc632167424a6d997e74f52b878d7cc478225cffac6bc977eedfe51c7f4e79 application/vnd.docker.distribution.manifest.v2+json sha256:58ac43b2cc92c687a32c8be6278e50a063579655fe3090125dcb2af0ff9e1a64 716.1 KiB linux/amd64 io.cri-containerd.image=managed"
+	;;
+"images import")
+	cat > "$(dirname "$0")/imported"
+	echo "unpacking docker.io/opensuse/salt-api:13 (sha256:0123)...done"
+	;;
+esac
+`
+
+// newFakeContainerdFeeder returns a ContainerdFeeder talking to fakeCtr and
+// the directory containing the calls log.
+func newFakeContainerdFeeder(t *testing.T) (*ContainerdFeeder, string) {
+	dir, err := ioutil.TempDir("", "test-containerd")
+	if err != nil {
+		t.Fatalf("error while creating test dir: %v", err)
+	}
+	ctr := filepath.Join(dir, "ctr")
+	if err := ioutil.WriteFile(ctr, []byte(fakeCtr), 0755); err != nil {
+		t.Fatalf("error writing fake ctr: %v", err)
+	}
+	return &ContainerdFeeder{ctr: ctr, address: "/run/test.sock", namespace: "test"}, dir
+}
+
+func TestContainerdImages(t *testing.T) {
+	f, dir := newFakeContainerdFeeder(t)
+	defer os.RemoveAll(dir)
+
+	images, err := f.Images(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	id, ok := images["docker.io/library/busybox:latest"]
+	if len(images) != 1 || !ok || id.Manifest != "sha256:58ac43b2cc92c687a32c8be6278e50a063579655fe3090125dcb2af0ff9e1a64" {
+		t.Errorf("unexpected images: %v", images)
+	}
+
+	calls, _ := ioutil.ReadFile(filepath.Join(dir, "calls"))
+	if !strings.HasPrefix(string(calls), "--address /run/test.sock --namespace test images list") {
+		t.Errorf("unexpected ctr invocation: %s", calls)
+	}
+}
+
+func TestContainerdTagImage(t *testing.T) {
+	f, dir := newFakeContainerdFeeder(t)
+	defer os.RemoveAll(dir)
+
+	err := f.TagImage(context.Background(), "docker.io/opensuse/salt-api:13", []string{"docker.io/opensuse/salt-api:latest"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	calls, _ := ioutil.ReadFile(filepath.Join(dir, "calls"))
+	if !strings.Contains(string(calls), "images tag --force docker.io/opensuse/salt-api:13 docker.io/opensuse/salt-api:latest") {
+		t.Errorf("unexpected ctr invocation: %s", calls)
+	}
+}
+
+func TestContainerdLoadImage(t *testing.T) {
+	f, dir := newFakeContainerdFeeder(t)
+	defer os.RemoveAll(dir)
+
+	archive := filepath.Join(dir, "salt-api.tar.xz")
+	writeDockerArchive(t, archive, "opensuse/salt-api:13")
+
+	image, err := f.LoadImage(context.Background(), archive, dockerArchiveFormat)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if image != "docker.io/opensuse/salt-api:13" {
+		t.Errorf("unexpected image name: %s", image)
+	}
+
+	calls, _ := ioutil.ReadFile(filepath.Join(dir, "calls"))
+	if !strings.Contains(string(calls), "images import -") {
+		t.Errorf("unexpected ctr invocation: %s", calls)
+	}
+
+	// ctr is fed with the decompressed archive
+	imported, err := os.Open(filepath.Join(dir, "imported"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer imported.Close()
+	hdr, err := tar.NewReader(imported).Next()
+	if err != nil {
+		t.Fatalf("ctr has not been fed with a tar archive: %v", err)
+	}
+	if hdr.Name != "config.json" {
+		t.Errorf("unexpected archive entry: %s", hdr.Name)
+	}
+}
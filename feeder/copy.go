@@ -0,0 +1,260 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package feeder
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/containers/image/copy"
+	"github.com/containers/image/docker/archive"
+	"github.com/containers/image/docker/tarfile"
+	"github.com/containers/image/oci/layout"
+	"github.com/containers/image/signature"
+	"github.com/containers/image/transports"
+	"github.com/containers/image/types"
+	storagearchive "github.com/containers/storage/pkg/archive"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// openedReference is a types.ImageReference handing out an image source
+// that has already been opened, so that copying the image does not read
+// (and decompress) the archive once more.
+type openedReference struct {
+	types.ImageReference
+	source types.ImageSource
+}
+
+// NewImageSource returns the opened source; closing it is up to the owner
+// of the openedReference.
+func (r openedReference) NewImageSource(ctx *types.SystemContext) (types.ImageSource, error) {
+	return unclosableSource{r.source}, nil
+}
+
+type unclosableSource struct {
+	types.ImageSource
+}
+
+func (unclosableSource) Close() error {
+	return nil
+}
+
+// contextSource is a types.ImageSource whose blobs can no longer be read
+// once ctx is done, which interrupts the copies of the image.
+type contextSource struct {
+	types.ImageSource
+	ctx context.Context
+}
+
+func (s contextSource) GetBlob(info types.BlobInfo) (io.ReadCloser, int64, error) {
+	if err := s.ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	blob, size, err := s.ImageSource.GetBlob(info)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &contextReadCloser{contextReader{ctx: s.ctx, r: blob}, blob}, size, nil
+}
+
+// archiveSource is a docker-archive types.ImageSource created from a stream
+type archiveSource struct {
+	*tarfile.Source
+	ref types.ImageReference
+}
+
+func (s *archiveSource) Reference() types.ImageReference {
+	return s.ref
+}
+
+func (s *archiveSource) LayerInfosForCopy() ([]types.BlobInfo, error) {
+	return nil, nil
+}
+
+// openDockerArchive opens the docker-archive stored at path. Returns a
+// reference to copy the image from, the repotags stored inside of the
+// archive and a function releasing the opened archive.
+func openDockerArchive(ctx context.Context, path string) (types.ImageReference, []string, func() error, error) {
+	ref, err := archive.ParseReference(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	stream, err := openDecompressed(ctx, path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer stream.Close()
+
+	// the decompressed archive is copied to a temporary file, removed when
+	// the source is closed
+	tarSrc, err := tarfile.NewSourceFromStream(stream)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error opening %s: %v", path, err)
+	}
+	src := &archiveSource{Source: tarSrc, ref: ref}
+
+	repotags := []string{}
+	items, err := src.LoadTarManifest()
+	if err != nil {
+		src.Close()
+		return nil, nil, nil, fmt.Errorf("error reading manifest of %s: %v", path, err)
+	}
+	if len(items) > 0 {
+		repotags = items[0].RepoTags
+	}
+
+	return openedReference{ImageReference: ref, source: src}, repotags, src.Close, nil
+}
+
+// openOCILayout opens the single image stored inside of the OCI image layout
+// at dir. Returns a reference to copy the image from and the repotag of the
+// image, taken from its org.opencontainers.image.ref.name annotation.
+func openOCILayout(dir string) (types.ImageReference, []string, error) {
+	ref, err := layout.NewReference(dir, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	desc, err := layout.LoadManifestDescriptor(ref)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading index of %s: %v", dir, err)
+	}
+
+	repotags := []string{}
+	if name := desc.Annotations[imgspecv1.AnnotationRefName]; name != "" {
+		repotags = append(repotags, name)
+		// select the image by name, the index could also list manifests
+		// that are not images
+		if ref, err = layout.NewReference(dir, name); err != nil {
+			return nil, nil, err
+		}
+	}
+	return ref, repotags, nil
+}
+
+// openOCIArchive extracts the oci-archive stored at path into a temporary
+// directory located in /var/tmp (writable on MicroOS) and opens it like
+// openOCILayout. The returned function removes the directory.
+func openOCIArchive(ctx context.Context, path string) (types.ImageReference, []string, func() error, error) {
+	stream, err := openDecompressed(ctx, path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer stream.Close()
+
+	dir, err := ioutil.TempDir("/var/tmp", "container-feeder")
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error creating temporary directory: %v", err)
+	}
+	removeDir := func() error { return os.RemoveAll(dir) }
+
+	if err := storagearchive.Untar(stream, dir, &storagearchive.TarOptions{NoLchown: true}); err != nil {
+		removeDir()
+		return nil, nil, nil, fmt.Errorf("error extracting %s: %v", path, err)
+	}
+
+	ref, repotags, err := openOCILayout(dir)
+	if err != nil {
+		removeDir()
+		return nil, nil, nil, err
+	}
+	return ref, repotags, removeDir, nil
+}
+
+// openImage opens the image stored at path in the specified format. Returns
+// a reference to copy the image from, the repotags stored inside of the image
+// and a function releasing the opened image.
+func openImage(ctx context.Context, path, format string) (types.ImageReference, []string, func() error, error) {
+	switch format {
+	case dockerArchiveFormat:
+		return openDockerArchive(ctx, path)
+	case ociArchiveFormat:
+		return openOCIArchive(ctx, path)
+	case ociLayoutFormat:
+		ref, repotags, err := openOCILayout(path)
+		return ref, repotags, func() error { return nil }, err
+	default:
+		return nil, nil, nil, fmt.Errorf("unknown image format '%s'", format)
+	}
+}
+
+// newPolicyContext returns the signature policy applied when copying images:
+// the configured policy for the images shipped with signed, every image is
+// accepted otherwise.
+func newPolicyContext(signed *imageSignatures) (*signature.PolicyContext, error) {
+	if signed != nil {
+		policyContext, err := newSignaturePolicyContext(signed.policy)
+		if err != nil {
+			return nil, signatureError{err}
+		}
+		return policyContext, nil
+	}
+	policy := &signature.Policy{
+		Default: []signature.PolicyRequirement{signature.NewPRInsecureAcceptAnything()},
+	}
+	return signature.NewPolicyContext(policy)
+}
+
+// copyImage copies the image referenced by src to dest, using sys for both
+// ends. When signed is set the image is checked against its policy, as read
+// by the copy, and refused images are not copied. The copy is interrupted
+// when ctx is done.
+func copyImage(ctx context.Context, dest, src types.ImageReference, sys *types.SystemContext, signed *imageSignatures) error {
+	policyContext, err := newPolicyContext(signed)
+	if err != nil {
+		return err
+	}
+	defer policyContext.Destroy()
+
+	source, err := src.NewImageSource(sys)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %v", transports.ImageName(src), err)
+	}
+	defer source.Close()
+
+	var imageSource types.ImageSource = contextSource{source, ctx}
+	if signed != nil {
+		signedSrc, err := newSignedSource(imageSource, signed.repotag, signed.signatures)
+		if err != nil {
+			return err
+		}
+		// checked here to tell the refused images from the failed copies,
+		// copy.Image applies the same policy to the same source again
+		if err := checkSignatures(policyContext, signedSrc); err != nil {
+			return err
+		}
+		imageSource = signedSrc
+	}
+
+	err = copy.Image(policyContext, dest, openedReference{ImageReference: src, source: imageSource}, &copy.Options{
+		// the temporary archives cannot store the shipped signatures
+		RemoveSignatures: signed != nil,
+		SourceCtx:        sys,
+		DestinationCtx:   sys,
+	})
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("error copying %s to %s: %v",
+			transports.ImageName(src), transports.ImageName(dest), err)
+	}
+	return nil
+}
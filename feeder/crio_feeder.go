@@ -18,9 +18,9 @@
 package feeder
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 
 	"github.com/containers/image/docker/reference"
@@ -57,9 +57,10 @@ func NewCRIOFeeder() (*CRIOFeeder, error) {
 	return feeder, nil
 }
 
-// Images returns an array of images present in containers/storage.
-func (f *CRIOFeeder) Images() ([]string, error) {
-	tags := []string{}
+// Images returns the images present in containers/storage. The ID of the
+// images copied into containers/storage is the hex of their config digest.
+func (f *CRIOFeeder) Images(ctx context.Context) (map[string]ImageID, error) {
+	tags := make(map[string]ImageID)
 
 	images, err := f.runtime.GetImageResults()
 	if err != nil {
@@ -67,46 +68,50 @@ func (f *CRIOFeeder) Images() ([]string, error) {
 	}
 
 	for _, img := range images {
-		tags = append(tags, img.RepoTags...)
+		for _, tag := range img.RepoTags {
+			tags[tag] = ImageID{
+				Config:   "sha256:" + img.ID,
+				Manifest: string(img.Digest),
+			}
+		}
 	}
 
 	return tags, nil
 }
 
-// decompressXZImage decompresses the specified tar.xz into a tar image that is
-// located in /var/tmp (writable on MicroOS).
-func decompressXZImage(image string) (string, error) {
-	log.Debugf("Decompressing image %s", image)
-
-	tmpFile, err := ioutil.TempFile("/var/tmp", "container-feeder")
-	if err != nil {
-		return "", fmt.Errorf("error creating temporary file: %v", err)
-	}
-	defer tmpFile.Close()
-
-	cmd := []string{"/usr/bin/unxz", "-c", image}
-	if err := runCommand(cmd, "", tmpFile); err != nil {
-		return "", fmt.Errorf("error using xz: %v", err)
-	}
-
-	return tmpFile.Name(), nil
-}
-
 // LoadImage loads the specified image into containers/storage and returns the
-// image name.
-func (f *CRIOFeeder) LoadImage(path string) (string, error) {
+// image name. libpod cannot be interrupted: ctx is only checked before
+// pulling the image.
+func (f *CRIOFeeder) LoadImage(ctx context.Context, path, format string) (string, error) {
 	var writer io.Writer
 	options := libpod.CopyOptions{
 		Writer: writer,
 	}
 
-	image, err := decompressXZImage(path)
-	if err != nil {
-		return "", err
+	var src string
+	switch format {
+	case dockerArchiveFormat:
+		// libpod decompresses docker-archives by itself, while copying them
+		// to the temporary file it reads the image from
+		if err := checkCompression(path); err != nil {
+			return "", err
+		}
+		src = libpod.DockerArchive + ":" + path
+	case ociArchiveFormat:
+		// libpod extracts oci-archives twice, relying on the xz binary
+		image, err := decompressToTempFile(ctx, path)
+		if err != nil {
+			return "", err
+		}
+		defer os.Remove(image)
+		src = libpod.OCIArchive + ":" + image
+	default:
+		return "", unsupportedFormatError("crio", format)
 	}
-	defer os.Remove(image)
 
-	src := libpod.DockerArchive + ":" + image
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
 	imgName, err := f.runtime.PullImage(src, options)
 	if err != nil {
 		return "", fmt.Errorf("error loading image: %v", err)
@@ -117,7 +122,11 @@ func (f *CRIOFeeder) LoadImage(path string) (string, error) {
 }
 
 // TagImage tags the specified image with the supplied tags.
-func (f *CRIOFeeder) TagImage(image string, tags []string) error {
+func (f *CRIOFeeder) TagImage(ctx context.Context, image string, tags []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	newImage := f.runtime.NewImage(image)
 	newImage.GetLocalImageName()
 
@@ -136,6 +145,29 @@ func (f *CRIOFeeder) TagImage(image string, tags []string) error {
 	return nil
 }
 
+// RemoveImage removes the specified name from its image, deleting the image
+// when it was the last one.
+func (f *CRIOFeeder) RemoveImage(ctx context.Context, image string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	img, err := f.runtime.GetImage(image)
+	if err != nil {
+		return err
+	}
+	log.Debug("Removing image: ", image)
+	if len(img.Names) > 1 {
+		_, err = f.runtime.UntagImage(img, image)
+	} else {
+		_, err = f.runtime.RemoveImage(img, false)
+	}
+	if err != nil {
+		return fmt.Errorf("error removing image: %v", err)
+	}
+	return nil
+}
+
 // addImageNames adds addNames to the specified image
 func (f *CRIOFeeder) addImageNames(image *storage.Image, names []string) error {
 	// Add tags to the names if applicable
@@ -169,3 +201,16 @@ func expandedTags(tags []string) ([]string, error) {
 	}
 	return expandedNames, nil
 }
+
+// the messages of the errors returned while the storage is locked or in use
+// by CRI-O
+var transientCRIOErrors = []string{
+	"database is locked",
+	"resource temporarily unavailable",
+	"device or resource busy",
+}
+
+// isTransientCRIOError returns true if err is worth retrying
+func isTransientCRIOError(err error) bool {
+	return errorContainsAny(err, transientCRIOErrors)
+}
@@ -0,0 +1,171 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package feeder
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/ulikunitz/xz"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// compression describes a compression format, recognized by the magic bytes
+// the compressed files start with
+type compression struct {
+	name  string
+	magic []byte
+	// returns the decompressed stream; nil when the format is recognized
+	// but cannot be decompressed
+	decompressor func(io.Reader) (io.Reader, error)
+}
+
+// the compression formats the images can be shipped with
+var compressions = []compression{
+	{"xz", []byte{0xFD, 0x37, 0x7A, 0x58, 0x5A, 0x00}, func(r io.Reader) (io.Reader, error) {
+		return xz.NewReader(r)
+	}},
+	{"gzip", []byte{0x1F, 0x8B}, func(r io.Reader) (io.Reader, error) {
+		return gzip.NewReader(r)
+	}},
+	{"bzip2", []byte{0x42, 0x5A, 0x68}, func(r io.Reader) (io.Reader, error) {
+		return bzip2.NewReader(r), nil
+	}},
+	// no zstd decoder is vendored: recognize the format to reject it
+	// clearly instead of streaming it as a plain tarball
+	{"zstd", []byte{0x28, 0xB5, 0x2F, 0xFD}, nil},
+}
+
+// detectCompression returns the compression of the stream read by r, nil if
+// the stream is not compressed. The stream is not consumed.
+func detectCompression(r *bufio.Reader) (*compression, error) {
+	header, err := r.Peek(8)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	for i := range compressions {
+		if bytes.HasPrefix(header, compressions[i].magic) {
+			if compressions[i].decompressor == nil {
+				return nil, fmt.Errorf("%s is not supported", compressions[i].name)
+			}
+			return &compressions[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// contextReader is an io.Reader failing once ctx is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// contextReadCloser is a contextReader closing the underlying stream
+type contextReadCloser struct {
+	contextReader
+	io.Closer
+}
+
+// openDecompressed opens the file at path and returns a stream of its
+// decompressed content, which can no longer be read once ctx is done.
+// Compression is detected by magic bytes; files that are not compressed are
+// streamed as they are. The file is verified against the checksum of ctx, if
+// any, while it is read.
+func openDecompressed(ctx context.Context, path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := checksumReader(ctx, path, file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(raw)
+	c, err := detectCompression(reader)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error decompressing %s: %v", path, err)
+	}
+	if c == nil {
+		return &contextReadCloser{contextReader{ctx: ctx, r: reader}, file}, nil
+	}
+
+	log.Debugf("Decompressing %s (%s)", path, c.name)
+	stream, err := c.decompressor(reader)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error decompressing %s: %v", path, err)
+	}
+	return &contextReadCloser{contextReader{ctx: ctx, r: stream}, file}, nil
+}
+
+// checkCompression returns an error if the file at path is compressed with a
+// format that cannot be decompressed.
+func checkCompression(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := detectCompression(bufio.NewReader(file)); err != nil {
+		return fmt.Errorf("error decompressing %s: %v", path, err)
+	}
+	return nil
+}
+
+// decompressToTempFile writes the decompressed content of the file at path
+// into a temporary file located in /var/tmp (writable on MicroOS) and returns
+// its name. Only meant for the consumers that need random access to the
+// content.
+func decompressToTempFile(ctx context.Context, path string) (string, error) {
+	stream, err := openDecompressed(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	defer stream.Close()
+
+	tmpFile, err := ioutil.TempFile("/var/tmp", "container-feeder")
+	if err != nil {
+		return "", fmt.Errorf("error creating temporary file: %v", err)
+	}
+	defer tmpFile.Close()
+
+	if _, err := io.Copy(tmpFile, stream); err != nil {
+		os.Remove(tmpFile.Name())
+		return "", fmt.Errorf("error decompressing %s: %v", path, err)
+	}
+	return tmpFile.Name(), nil
+}
@@ -0,0 +1,121 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package feeder
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ulikunitz/xz"
+)
+
+func TestOpenDecompressed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-decompress")
+	if err != nil {
+		t.Fatalf("error while creating test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := []byte("a docker-archive")
+	compressors := map[string]func(io.Writer) (io.WriteCloser, error){
+		"plain": func(w io.Writer) (io.WriteCloser, error) {
+			return nopWriteCloser{w}, nil
+		},
+		"gzip": func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		"xz": func(w io.Writer) (io.WriteCloser, error) {
+			return xz.NewWriter(w)
+		},
+	}
+
+	for name, compressor := range compressors {
+		var buf bytes.Buffer
+		w, err := compressor(&buf)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		w.Write(content)
+		w.Close()
+
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, buf.Bytes(), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		stream, err := openDecompressed(context.Background(), file)
+		if err != nil {
+			t.Fatalf("unexpected error opening %s file: %v", name, err)
+		}
+		data, err := ioutil.ReadAll(stream)
+		stream.Close()
+		if err != nil {
+			t.Fatalf("unexpected error reading %s file: %v", name, err)
+		}
+		if !bytes.Equal(data, content) {
+			t.Errorf("unexpected content of %s file: %q", name, data)
+		}
+	}
+
+	zstd := filepath.Join(dir, "zstd")
+	if err := ioutil.WriteFile(zstd, []byte{0x28, 0xB5, 0x2F, 0xFD, 0x00}, 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := openDecompressed(context.Background(), zstd); err == nil || !strings.Contains(err.Error(), "zstd is not supported") {
+		t.Errorf("zstd not supported error expected, got %v", err)
+	}
+	if err := checkCompression(zstd); err == nil {
+		t.Error("error expected for zstd compressed file")
+	}
+}
+
+func TestDecompressToTempFileCanceled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-decompress")
+	if err != nil {
+		t.Fatalf("error while creating test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "salt-api.tar.xz")
+	writeDockerArchive(t, file, "opensuse/salt-api:13")
+
+	before, _ := filepath.Glob("/var/tmp/container-feeder*")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := decompressToTempFile(ctx, file); err == nil {
+		t.Error("error expected but not received")
+	}
+	after, _ := filepath.Glob("/var/tmp/container-feeder*")
+	if len(after) != len(before) {
+		t.Errorf("temporary file left behind: %v", after)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,207 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package feeder
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// the target name asking to detect the running container engines
+const autoTarget = "auto"
+
+var (
+	// the socket of the Docker daemon, unless DOCKER_HOST says otherwise
+	dockerSocket = "/var/run/docker.sock"
+	// the socket of the CRI-O daemon
+	crioSocket = "/var/run/crio/crio.sock"
+	// the configuration of the containers/storage used by CRI-O
+	storageConfig = "/etc/containers/storage.conf"
+	// the client used to talk to containerd
+	ctrClient = "ctr"
+	// how long to wait for a socket to accept a connection
+	probeTimeout = 2 * time.Second
+)
+
+// engineProbe checks whether the container engine of a target is running and
+// returns the reason of its verdict.
+type engineProbe func(config FeederConfig) (bool, string)
+
+// engineProbes lists the probes in the order the targets are fed
+var engineProbes = []struct {
+	target string
+	probe  engineProbe
+}{
+	{"docker", probeDocker},
+	{"crio", probeCRIO},
+	{"containerd", probeContainerd},
+}
+
+// probeSocket returns nil if something is accepting connections on address.
+func probeSocket(network, address string) error {
+	conn, err := net.DialTimeout(network, address, probeTimeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// probeDocker checks whether the Docker daemon is listening on its socket.
+func probeDocker(config FeederConfig) (bool, string) {
+	network, address := "unix", dockerSocket
+	if host := os.Getenv("DOCKER_HOST"); host != "" {
+		parts := strings.SplitN(host, "://", 2)
+		if len(parts) == 2 {
+			network, address = parts[0], parts[1]
+		}
+	}
+	if err := probeSocket(network, address); err != nil {
+		return false, fmt.Sprintf("Docker socket %s is not reachable: %v", address, err)
+	}
+	return true, fmt.Sprintf("Docker socket %s is reachable", address)
+}
+
+// probeCRIO checks whether the CRI-O daemon is listening on its socket. The
+// presence of the containers/storage configuration is reported as well.
+func probeCRIO(config FeederConfig) (bool, string) {
+	storage := fmt.Sprintf("containers/storage configuration %s found", storageConfig)
+	if _, err := os.Stat(storageConfig); err != nil {
+		storage = fmt.Sprintf("containers/storage configuration %s not found", storageConfig)
+	}
+	if err := probeSocket("unix", crioSocket); err != nil {
+		return false, fmt.Sprintf("CRI-O socket %s is not reachable (%s): %v", crioSocket, storage, err)
+	}
+	return true, fmt.Sprintf("CRI-O socket %s is reachable (%s)", crioSocket, storage)
+}
+
+// probeContainerd checks whether containerd is listening on the configured
+// socket and serves Kubernetes, by means of the CRI plugin or the configured
+// namespace. The containerd started by Docker is ignored.
+func probeContainerd(config FeederConfig) (bool, string) {
+	address := config.Containerd.Address
+	if address == "" {
+		address = defaultContainerdAddress
+	}
+	namespace := config.Containerd.Namespace
+	if namespace == "" {
+		namespace = defaultContainerdNamespace
+	}
+	if err := probeSocket("unix", address); err != nil {
+		return false, fmt.Sprintf("containerd socket %s is not reachable: %v", address, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	ctr := &ContainerdFeeder{ctr: ctrClient, address: address, namespace: namespace}
+	if out, err := ctr.run(ctx, "plugins", "ls"); err == nil && hasCRIPlugin(out) {
+		return true, fmt.Sprintf("containerd socket %s is reachable and serves the CRI plugin", address)
+	}
+	if out, err := ctr.run(ctx, "namespaces", "ls", "-q"); err == nil && stringInSlice(namespace, strings.Fields(string(out))) {
+		return true, fmt.Sprintf("containerd socket %s is reachable and holds the %s namespace", address, namespace)
+	}
+	return false, fmt.Sprintf("containerd socket %s is reachable but serves neither the CRI plugin nor the %s namespace, it is probably run by Docker", address, namespace)
+}
+
+// hasCRIPlugin returns true if the output of `ctr plugins ls` lists the CRI
+// plugin as loaded
+func hasCRIPlugin(out []byte) bool {
+	// TYPE ID PLATFORMS STATUS
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && fields[0] == "io.containerd.grpc.v1" && fields[1] == "cri" && fields[len(fields)-1] == "ok" {
+			return true
+		}
+	}
+	return false
+}
+
+// detectTargets returns the targets whose container engine is running.
+func detectTargets(config FeederConfig) []string {
+	targets := []string{}
+	for _, p := range engineProbes {
+		running, reason := p.probe(config)
+		if running {
+			log.Infof("Feeder target '%s': selecting %s: %s", autoTarget, p.target, reason)
+			targets = append(targets, p.target)
+		} else {
+			log.Debugf("Feeder target '%s': skipping %s: %s", autoTarget, p.target, reason)
+		}
+	}
+	return targets
+}
+
+// waitForTargets calls detectTargets until a container engine is running or
+// the engine timeout in config expires: the engines may still be starting.
+func waitForTargets(ctx context.Context, config FeederConfig) ([]string, error) {
+	retryConfig := config.Retry.withDefaults()
+	deadline := time.Now().Add(time.Duration(retryConfig.EngineTimeout))
+
+	for attempt := 0; ; attempt++ {
+		detected := detectTargets(config)
+		if len(detected) > 0 {
+			return detected, nil
+		}
+
+		delay := retryConfig.backoff(attempt)
+		if time.Now().Add(delay).After(deadline) {
+			return nil, fmt.Errorf("Feeder target '%s': no running container engine detected within %v", autoTarget, time.Duration(retryConfig.EngineTimeout))
+		}
+		log.Infof("Feeder target '%s': no running container engine detected, retrying in %v", autoTarget, delay)
+		if err := sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// expandTargets replaces the "auto" target, or an unspecified one, with the
+// targets detected on the host. When wait is set and no engine is running
+// yet, the detection is retried until one is.
+func expandTargets(ctx context.Context, config FeederConfig, wait bool) ([]string, error) {
+	if len(config.Targets) == 0 {
+		log.Infof("Feeder target unspecified: detecting the running container engines")
+		config.Targets = FeederTargets{autoTarget}
+	}
+
+	targets := []string{}
+	for _, name := range config.Targets {
+		if name != autoTarget {
+			targets = append(targets, name)
+			continue
+		}
+		if wait {
+			detected, err := waitForTargets(ctx, config)
+			if err != nil {
+				return nil, err
+			}
+			targets = append(targets, detected...)
+			continue
+		}
+		detected := detectTargets(config)
+		if len(detected) == 0 {
+			return nil, fmt.Errorf("Feeder target '%s': no running container engine detected", autoTarget)
+		}
+		targets = append(targets, detected...)
+	}
+	return targets, nil
+}
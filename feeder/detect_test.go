@@ -0,0 +1,160 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package feeder
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeDetectCtr is a stand-in for the ctr client listing the plugins and the
+// namespaces stored next to it
+const fakeDetectCtr = `#!/bin/sh
+while [ $# -gt 0 ]; do
+	case "$1" in
+	--address|--namespace) shift 2 ;;
+	*) break ;;
+	esac
+done
+case "$1 $2" in
+"plugins ls") cat "$(dirname "$0")/plugins" 2>/dev/null ;;
+"namespaces ls") cat "$(dirname "$0")/namespaces" 2>/dev/null ;;
+esac
+`
+
+func TestExpandTargets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-detect")
+	if err != nil {
+		t.Fatalf("error while creating test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// only containerd is running
+	listener, err := net.Listen("unix", filepath.Join(dir, "containerd.sock"))
+	if err != nil {
+		t.Fatalf("error listening on socket: %v", err)
+	}
+	defer listener.Close()
+
+	oldDocker, oldCRIO, oldCtr := dockerSocket, crioSocket, ctrClient
+	defer func() { dockerSocket, crioSocket, ctrClient = oldDocker, oldCRIO, oldCtr }()
+	dockerSocket = filepath.Join(dir, "docker.sock")
+	crioSocket = filepath.Join(dir, "crio.sock")
+	ctrClient = filepath.Join(dir, "ctr")
+	os.Unsetenv("DOCKER_HOST")
+	if err := ioutil.WriteFile(ctrClient, []byte(fakeDetectCtr), 0755); err != nil {
+		t.Fatalf("error writing fake ctr: %v", err)
+	}
+	plugins := "TYPE                  ID   PLATFORMS   STATUS\nio.containerd.grpc.v1 cri  linux/amd64 ok\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "plugins"), []byte(plugins), 0644); err != nil {
+		t.Fatalf("error writing plugins: %v", err)
+	}
+
+	config := FeederConfig{Containerd: ContainerdConfig{Address: listener.Addr().String()}}
+	targets, err := expandTargets(context.Background(), config, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(targets) != 1 || targets[0] != "containerd" {
+		t.Errorf("unexpected targets: %v", targets)
+	}
+
+	config.Targets = FeederTargets{"docker", "auto"}
+	targets, err = expandTargets(context.Background(), config, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(targets) != 2 || targets[0] != "docker" || targets[1] != "containerd" {
+		t.Errorf("unexpected targets: %v", targets)
+	}
+
+	// the containerd run by Docker
+	os.Remove(filepath.Join(dir, "plugins"))
+	if err := ioutil.WriteFile(filepath.Join(dir, "namespaces"), []byte("moby\n"), 0644); err != nil {
+		t.Fatalf("error writing namespaces: %v", err)
+	}
+	config.Targets = FeederTargets{"auto"}
+	if targets, err := expandTargets(context.Background(), config, false); err == nil {
+		t.Errorf("error expected but not received, targets: %v", targets)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "namespaces"), []byte("moby\nk8s.io\n"), 0644); err != nil {
+		t.Fatalf("error writing namespaces: %v", err)
+	}
+	targets, err = expandTargets(context.Background(), config, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(targets) != 1 || targets[0] != "containerd" {
+		t.Errorf("unexpected targets: %v", targets)
+	}
+
+	listener.Close()
+	if _, err := expandTargets(context.Background(), config, false); err == nil {
+		t.Error("error expected but not received")
+	}
+	config.Retry = RetryConfig{Delay: Duration(10 * time.Millisecond), EngineTimeout: Duration(50 * time.Millisecond)}
+	if _, err := expandTargets(context.Background(), config, true); err == nil {
+		t.Error("error expected but not received")
+	}
+}
+
+func TestExpandTargetsWait(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-detect")
+	if err != nil {
+		t.Fatalf("error while creating test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldDocker, oldCRIO := dockerSocket, crioSocket
+	defer func() { dockerSocket, crioSocket = oldDocker, oldCRIO }()
+	dockerSocket = filepath.Join(dir, "docker.sock")
+	crioSocket = filepath.Join(dir, "crio.sock")
+	os.Unsetenv("DOCKER_HOST")
+
+	// docker starts after container-feeder
+	started := make(chan net.Listener, 1)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		listener, err := net.Listen("unix", dockerSocket)
+		if err != nil {
+			t.Errorf("error listening on socket: %v", err)
+		}
+		started <- listener
+	}()
+
+	config := FeederConfig{
+		Containerd: ContainerdConfig{Address: filepath.Join(dir, "containerd.sock")},
+		Retry:      RetryConfig{Delay: Duration(10 * time.Millisecond), EngineTimeout: Duration(5 * time.Second)},
+	}
+	targets, err := expandTargets(context.Background(), config, true)
+	if listener := <-started; listener != nil {
+		listener.Close()
+	}
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(targets) != 1 || targets[0] != "docker" {
+		t.Errorf("unexpected targets: %v", targets)
+	}
+}
@@ -19,6 +19,7 @@ package feeder
 
 import (
 	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -36,11 +37,11 @@ type DockerFeeder struct {
 
 // Returns a new Feeder instance. Takes care of initializing the connection
 // with the Docker daemon.
-func NewDockerFeeder() (*DockerFeeder, error) {
+func NewDockerFeeder(ctx context.Context) (*DockerFeeder, error) {
 	feeder := &DockerFeeder{}
 
 	var err error
-	feeder.client, err = connectToDaemon()
+	feeder.client, err = connectToDaemon(ctx)
 	if err != nil {
 		return &DockerFeeder{}, err
 	}
@@ -50,13 +51,17 @@ func NewDockerFeeder() (*DockerFeeder, error) {
 
 // dockerDaemonAPIVersion returns the API version supported by the server by
 // shelling out.
-func dockerDaemonAPIVersion() (string, error) {
-	out, err := exec.Command(
+func dockerDaemonAPIVersion(ctx context.Context) (string, error) {
+	out, err := exec.CommandContext(
+		ctx,
 		"docker",
 		"version",
 		"--format",
 		"{{.Server.APIVersion}}").Output()
 	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+			return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
 		return "", err
 	}
 	api := strings.Trim(string(out[:]), "\n")
@@ -65,12 +70,12 @@ func dockerDaemonAPIVersion() (string, error) {
 
 // connectToDaemon returns a Docker client.Client using the right version of
 // the API
-func connectToDaemon() (*client.Client, error) {
+func connectToDaemon(ctx context.Context) (*client.Client, error) {
 	// Set the exact version of the API in use, otherwise the library will
 	// try to use the latest one, which might be too new compared to the
 	// one supported by the docker daemon
 
-	apiVersion, err := dockerDaemonAPIVersion()
+	apiVersion, err := dockerDaemonAPIVersion(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -87,21 +92,21 @@ func connectToDaemon() (*client.Client, error) {
 }
 
 // Images returns images available on the docker host in the form
-// "<repo>:<tag>".
-func (f *DockerFeeder) Images() ([]string, error) {
-	tags := []string{}
-	images, err := f.client.ImageList(context.Background(), types.ImageListOptions{})
+// "<repo>:<tag>" with their image ID, the digest of their config.
+func (f *DockerFeeder) Images(ctx context.Context) (map[string]ImageID, error) {
+	tags := make(map[string]ImageID)
+	images, err := f.client.ImageList(ctx, types.ImageListOptions{})
 	if err != nil {
-		return tags, err
+		return nil, err
 	}
 
 	for _, image := range images {
 		for _, tag := range image.RepoTags {
 			normalizedName, normalizedTag, err := normalizeNameTag(tag)
 			if err != nil {
-				return []string{}, err
+				return nil, err
 			}
-			tags = append(tags, normalizedName+":"+normalizedTag)
+			tags[normalizedName+":"+normalizedTag] = ImageID{Config: image.ID}
 		}
 	}
 
@@ -109,15 +114,19 @@ func (f *DockerFeeder) Images() ([]string, error) {
 }
 
 // LoadImage loads the specified image into docker. Returns the image name
-// loaded into the docker daemon.
-func (f *DockerFeeder) LoadImage(pathToImage string) (string, error) {
-	image, err := os.Open(pathToImage)
+// loaded into the docker daemon. Only docker-archive images can be loaded.
+func (f *DockerFeeder) LoadImage(ctx context.Context, pathToImage, format string) (string, error) {
+	if format != dockerArchiveFormat {
+		return "", unsupportedFormatError("docker", format)
+	}
+
+	image, err := openDecompressed(ctx, pathToImage)
 	if err != nil {
 		return "", err
 	}
 	defer image.Close()
 
-	ret, err := f.client.ImageLoad(context.Background(), image, true)
+	ret, err := f.client.ImageLoad(ctx, image, true)
 	if err != nil {
 		return "", err
 	}
@@ -131,12 +140,34 @@ func (f *DockerFeeder) LoadImage(pathToImage string) (string, error) {
 }
 
 // TagImage tags the specified docker image with the supplied tags.
-func (f *DockerFeeder) TagImage(image string, tags []string) error {
+func (f *DockerFeeder) TagImage(ctx context.Context, image string, tags []string) error {
 	for _, tag := range tags {
 		log.Debug("Tagging image: ", image, " with ", tag)
-		if err := f.client.ImageTag(context.Background(), image, tag); err != nil {
+		if err := f.client.ImageTag(ctx, image, tag); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+// RemoveImage removes the specified repotag from docker, which deletes the
+// image once it has no tags left.
+func (f *DockerFeeder) RemoveImage(ctx context.Context, image string) error {
+	log.Debug("Removing image: ", image)
+	_, err := f.client.ImageRemove(ctx, image, types.ImageRemoveOptions{PruneChildren: true})
+	return err
+}
+
+// the messages of the errors returned while the docker daemon is starting
+// or busy
+var transientDockerErrors = []string{
+	"Cannot connect to the Docker daemon",
+	"connection refused",
+	"connection reset by peer",
+	"i/o timeout",
+}
+
+// isTransientDockerError returns true if err is worth retrying
+func isTransientDockerError(err error) bool {
+	return client.IsErrConnectionFailed(err) || errorContainsAny(err, transientDockerErrors)
+}
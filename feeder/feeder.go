@@ -18,16 +18,20 @@
 package feeder
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/containers/image/docker/reference"
+	"github.com/opencontainers/go-digest"
 
 	wlk "github.com/kubic-project/container-feeder/walker"
 	log "github.com/sirupsen/logrus"
@@ -38,8 +42,77 @@ var configFile = "/etc/container-feeder.json"
 
 // special type to load the container-feeder.json config
 type FeederConfig struct {
-	Target    string   `json:"feeder-target,omitempty"`
-	Whitelist []string `json:"whitelist,omitempty"`
+	Targets    FeederTargets    `json:"feeder-target,omitempty"`
+	Whitelist  []string         `json:"whitelist,omitempty"`
+	Containerd ContainerdConfig `json:"containerd,omitempty"`
+	Registry   RegistryConfig   `json:"registry,omitempty"`
+	OCI        OCIConfig        `json:"oci,omitempty"`
+	// the number of images imported at the same time (default: 1)
+	Concurrency int `json:"concurrency,omitempty"`
+	// the time allowed to import all the images (default: no limit)
+	Timeout Duration `json:"timeout,omitempty"`
+	// the time allowed to import a single image (default: no limit)
+	ImageTimeout Duration `json:"image-timeout,omitempty"`
+	// the retries of the operations failing with transient errors
+	Retry RetryConfig `json:"retry,omitempty"`
+	// the file recording the imported images
+	// (default: /var/lib/container-feeder/state.json)
+	StateFile string `json:"state-file,omitempty"`
+	// the removal of the imported images no RPM ships anymore
+	Prune PruneConfig `json:"prune,omitempty"`
+	// how a repotag claimed by more than one .metadata file is resolved:
+	// "fail", "newest" or "priority" (default: "fail")
+	ConflictPolicy string `json:"conflict-policy,omitempty"`
+	// the settings of the watch command
+	Watch WatchConfig `json:"watch,omitempty"`
+	// the containers-policy.json file the images are verified against
+	// before being imported (default: none, the images are not verified)
+	SignaturePolicy string `json:"signature-policy,omitempty"`
+	// how the .metadata files and their image files are verified: "rpm",
+	// against the RPM database, "dpkg", against the dpkg database,
+	// "checksum", against the checksum of the .metadata files, or "none"
+	// (default: "rpm")
+	Verification string `json:"verification,omitempty"`
+	// the settings of the directories the images are found in
+	Sources []SourceConfig `json:"sources,omitempty"`
+}
+
+// Duration is a time.Duration specified in the config as a string, eg: "5m"
+type Duration time.Duration
+
+// UnmarshalJSON parses durations like "90s" or "1h30m".
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("durations must be strings like \"5m\"")
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// FeederTargets is the list of container engines to feed. In the config it
+// can either be a single string or a list of strings.
+type FeederTargets []string
+
+// UnmarshalJSON accepts both "feeder-target": "docker" and
+// "feeder-target": ["docker", "crio"].
+func (t *FeederTargets) UnmarshalJSON(data []byte) error {
+	var target string
+	if err := json.Unmarshal(data, &target); err == nil {
+		*t = FeederTargets{target}
+		return nil
+	}
+
+	var targets []string
+	if err := json.Unmarshal(data, &targets); err != nil {
+		return fmt.Errorf("feeder-target must be a string or a list of strings")
+	}
+	*t = FeederTargets(targets)
+	return nil
 }
 
 // parseWhitelist returns a whitelist with normalized elements.
@@ -77,17 +150,56 @@ func loadConfig() (FeederConfig, error) {
 	}
 	config.Whitelist = whitelist
 
+	if err := validConflictPolicy(config.ConflictPolicy); err != nil {
+		return config, err
+	}
+	if err := validVerification(config.Verification); err != nil {
+		return config, err
+	}
+	if err := validSources(config.Sources); err != nil {
+		return config, err
+	}
+
 	return config, nil
 }
 
+type SuccessfulImport struct {
+	Image    string
+	Target   string
+	Duration time.Duration
+}
+
 type FailedImportError struct {
-	Image string
-	Error error
+	Image  string
+	Target string
+	Error  error
+	// one of the Category constants
+	Category string
+	Duration time.Duration
+}
+
+// UpToDateImage is an image that did not need to be imported
+type UpToDateImage struct {
+	Image  string
+	Target string
+}
+
+// RPMImage describes an image shipped by an RPM
+type RPMImage struct {
+	Tags []string
+	File string
+	// the RPM shipping the image, empty when unknown
+	Package string
+	// the size of the image file
+	Bytes int64
 }
 
 type FeederLoadResponse struct {
-	SuccessfulImports []string
+	SuccessfulImports []SuccessfulImport
 	FailedImports     []FailedImportError
+	UpToDateImages    []UpToDateImage
+	// the images found in the RPMs, by repotag
+	Images map[string]RPMImage
 }
 
 /* Image metadata type JSON schema:
@@ -106,6 +218,67 @@ For example:
     "file": "salt-api-2017.03-docker-images.x86_64.tar.xz"
   }
 }
+Images shipped as a plain root filesystem tarball are marked with
+"type": "rootfs" and can specify the config of the image:
+{
+  "image": {
+    "name": "opensuse/tumbleweed",
+    "tags": [ "20180201" ],
+    "file": "tumbleweed-rootfs.tar.xz",
+    "type": "rootfs",
+    "config": {
+      "env": [ "PATH=/usr/sbin:/usr/bin:/sbin:/bin" ],
+      "entrypoint": [ ],
+      "cmd": [ "/bin/bash" ],
+      "labels": { "org.opensuse.reference": "opensuse/tumbleweed:20180201" }
+    }
+  }
+}
+The format of the file is specified with "format": "docker-archive" (the
+default, a tarball created by `docker save`), "oci-archive" (a tarball of an
+OCI image layout) or "oci" (an OCI image layout directory). OCI images are
+named after their org.opencontainers.image.ref.name annotation, which must
+hold the full name of the image:
+{
+  "image": {
+    "name": "opensuse/salt-api",
+    "tags": [ "13", "latest" ],
+    "file": "salt-api-2017.03-oci-image.x86_64.tar.xz",
+    "format": "oci-archive"
+  }
+}
+The content of the image can be described with "config-digest", the digest
+of the image config (the docker image ID), and "manifest-digest". Images
+whose tags point to a different content in the engine are imported again:
+{
+  "image": {
+    "name": "opensuse/salt-api",
+    "tags": [ "13", "latest" ],
+    "file": "salt-api-2017.03-docker-images.x86_64.tar.xz",
+    "config-digest": "sha256:3fbc632167424a6d997e74f52b878d7cc478225cffac6bc977eedfe51c7f4e79"
+  }
+}
+When the same repotag is claimed by more than one .metadata file the image
+with the highest "priority" keeps it, provided conflict-policy is "priority":
+{
+  "image": {
+    "name": "opensuse/salt-api",
+    "tags": [ "13", "latest" ],
+    "file": "salt-api-2017.03-docker-images.x86_64.tar.xz",
+    "priority": 10
+  }
+}
+The image file can be described with its "sha256" checksum and its "size" in
+bytes, which are verified before the image is imported:
+{
+  "image": {
+    "name": "opensuse/salt-api",
+    "tags": [ "13", "latest" ],
+    "file": "salt-api-2017.03-docker-images.x86_64.tar.xz",
+    "sha256": "b5bb9d8014a0f9b1d61e21e796d78dccdf1352f23cd32812f4850b878ae4944c",
+    "size": 52428800
+  }
+}
 */
 // MetadataType struct to handle JSON schema
 type MetadataType struct {
@@ -114,23 +287,93 @@ type MetadataType struct {
 
 // ImageType struct to handle JSON schema
 type ImageType struct {
-	Name string   `json:"name"`
-	Tags []string `json:"tags"`
-	File string   `json:"file"`
+	Name           string        `json:"name"`
+	Tags           []string      `json:"tags"`
+	File           string        `json:"file"`
+	Format         string        `json:"format,omitempty"`
+	Type           string        `json:"type,omitempty"`
+	Config         *RootfsConfig `json:"config,omitempty"`
+	ConfigDigest   string        `json:"config-digest,omitempty"`
+	ManifestDigest string        `json:"manifest-digest,omitempty"`
+	// the image keeping the repotags claimed by other .metadata files too,
+	// the highest wins when conflict-policy is "priority"
+	Priority int `json:"priority,omitempty"`
+	// the simple signing signatures of the image, relative to the directory
+	// of the .metadata file
+	Signatures []string `json:"signatures,omitempty"`
+	// the sha256 checksum of the image file, hex encoded
+	SHA256 string `json:"sha256,omitempty"`
+	// the size of the image file in bytes
+	Size int64 `json:"size,omitempty"`
+	// the .metadata file describing the image
+	metadataFile string
+}
+
+// ImageID identifies the content a repotag points to. Engines fill in the
+// digests they know about, or none of them.
+type ImageID struct {
+	// the digest of the image config, the docker image ID
+	Config string `json:"config,omitempty"`
+	// the digest of the image manifest
+	Manifest string `json:"manifest,omitempty"`
+}
+
+// the formats of the files images are shipped in
+const (
+	dockerArchiveFormat = "docker-archive"
+	ociArchiveFormat    = "oci-archive"
+	ociLayoutFormat     = "oci"
+)
+
+// unsupportedFormatError returns the error reported when the images in the
+// specified format cannot be fed into the target
+func unsupportedFormatError(target, format string) error {
+	return formatError{target: target, format: format}
 }
 
-// FeederIface is a generalized interface that Container Feeders must implement
+// formatError is the error reported for the images in a format that cannot
+// be fed into a target
+type formatError struct {
+	target string
+	format string
+}
+
+func (e formatError) Error() string {
+	return fmt.Sprintf("image format '%s' is not supported by the %s target", e.format, e.target)
+}
+
+// FeederIface is a generalized interface that Container Feeders must implement.
+// Implementations give up as soon as possible once the context is done.
+// Images returns the repotags stored by the engine with the content they
+// point to. RemoveImage removes a single repotag, deleting the image once it
+// is no longer referenced.
 type FeederIface interface {
-	Images() ([]string, error)
-	LoadImage(string) (string, error)
-	TagImage(string, []string) error
+	Images(context.Context) (map[string]ImageID, error)
+	LoadImage(context.Context, string, string) (string, error)
+	TagImage(context.Context, string, []string) error
+	RemoveImage(context.Context, string) error
 }
 
-// Feeder includes a concrete object implementing the FeederIface and
-// FeederConfig
+// manifestRemover is implemented by the feeders that cannot remove a single
+// repotag: their RemoveImage deletes every tag pointing to the same content
+type manifestRemover interface {
+	removesManifests()
+}
+
+// Feeder includes the concrete objects implementing the FeederIface, one for
+// every configured target, and FeederConfig
 type Feeder struct {
+	targets []target
+	config  FeederConfig
+	// the imported images and the journal of the verified files, nil when
+	// they are not tracked
+	state *feederState
+}
+
+// target binds a FeederIface to the name of the target it was created for
+type target struct {
+	name   string
 	feeder FeederIface
-	config FeederConfig
 }
 
 // stringInSlice returns true if a is in list.
@@ -143,79 +386,446 @@ func stringInSlice(a string, list []string) bool {
 	return false
 }
 
-// NewFeeder returns a new Container Feeder based on the specified type in
-// the container-feeder.json config (default: DockerFeeder)
-func NewFeeder() (*Feeder, error) {
-	var err error
-	f := Feeder{}
+// newTargetFeeder returns the FeederIface implementation for the specified
+// target name
+func newTargetFeeder(ctx context.Context, name string, config FeederConfig) (FeederIface, error) {
+	switch name {
+	case "docker":
+		log.Debugf("Feeder target '%s': using DockerFeeder", name)
+		return NewDockerFeeder(ctx)
+	case "crio":
+		log.Debugf("Feeder target '%s': using CRIOFeeder", name)
+		return NewCRIOFeeder()
+	case "containerd":
+		log.Debugf("Feeder target '%s': using ContainerdFeeder", name)
+		return NewContainerdFeeder(ctx, config.Containerd)
+	case "registry":
+		log.Debugf("Feeder target '%s': using RegistryFeeder", name)
+		return NewRegistryFeeder(ctx, config.Registry)
+	case "oci":
+		log.Debugf("Feeder target '%s': using OCIFeeder", name)
+		return NewOCIFeeder(config.OCI)
+	default:
+		return nil, fmt.Errorf("Unknown feeder type specified: '%s'", name)
+	}
+}
 
-	f.config, err = loadConfig()
+// NewFeeder returns a new Container Feeder based on the targets specified in
+// the container-feeder.json config (default: the running container engines)
+func NewFeeder(ctx context.Context) (*Feeder, error) {
+	config, err := loadConfig()
 	if err != nil {
 		return nil, err
 	}
+	return newFeeder(ctx, config)
+}
 
-	switch f.config.Target {
-	case "docker":
-		log.Debugf("Feeder target '%s': using DockerFeeder", f.config.Target)
-		f.feeder, err = NewDockerFeeder()
-	case "crio":
-		log.Debugf("Feeder target '%s': using CRIOFeeder", f.config.Target)
-		f.feeder, err = NewCRIOFeeder()
-	default:
-		log.Debugf("Feeder target unspecified: raising an error")
-		return nil, fmt.Errorf("Unknown feeder type specified %v", err)
+// newFeeder returns a new Container Feeder based on config
+func newFeeder(ctx context.Context, config FeederConfig) (*Feeder, error) {
+	f := Feeder{config: config}
+
+	targets, err := expandTargets(ctx, f.config, true)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := []string{}
+	for _, name := range targets {
+		if stringInSlice(name, seen) {
+			log.Debugf("Feeder target '%s' specified more than once: ignoring", name)
+			continue
+		}
+		seen = append(seen, name)
+
+		feeder, err := waitForEngine(ctx, f.config.Retry, name, func() (FeederIface, error) {
+			return newTargetFeeder(ctx, name, f.config)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error creating feeder for target '%s': %v", name, err)
+		}
+		f.targets = append(f.targets, target{name: name, feeder: feeder})
 	}
 
-	return &f, err
+	return &f, nil
 }
 
-// Imports all the RPMs images stored inside of `path` into
-// the local docker daemon
-func Import(path string) (FeederLoadResponse, error) {
+// Imports all the RPMs images stored inside of `dirs`, the configured sources
+// when empty, into every configured container engine. The import stops once
+// ctx is done, or the configured timeout expires, and the temporary files are
+// removed.
+func Import(ctx context.Context, dirs []string) (FeederLoadResponse, error) {
 	res := FeederLoadResponse{}
 
-	f, err := NewFeeder()
+	config, err := loadConfig()
+	if err != nil {
+		return res, err
+	}
+	if config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(config.Timeout))
+		defer cancel()
+	}
+
+	f, err := newFeeder(ctx, config)
 	if err != nil {
 		return res, fmt.Errorf("Error creating new feeder: %v", err)
 	}
+	f.loadFeederState()
+	defer f.saveFeederState()
 
-	log.Debugf("Trying to import images from %s", path)
-	imagesToImport, imagesToImportTags, err := f.imagesToImport(path)
+	log.Debugf("Trying to import images from %v", config.sourceDirs(dirs))
+	rpmImages, rpmImageTags, rpmMetadata, conflicts, err := f.whitelistedRPMImages(dirs)
 	if err != nil {
 		return res, err
 	}
 
-	log.Debugf("Images to import: %v", imagesToImport)
-	for tag, file := range imagesToImport {
-		_, err := f.feeder.LoadImage(file)
-		if err != nil {
-			log.Warnf("Could not load image %s: %v", file, err)
+	return f.importRPMImages(ctx, rpmImages, rpmImageTags, rpmMetadata, conflicts), nil
+}
+
+// importRPMImages imports the RPMs images into every target, verifying their
+// checksums first, and records the imports in the state of f. The images left
+// out because of a conflict, by repotag, are reported as failed imports.
+func (f *Feeder) importRPMImages(ctx context.Context, rpmImages map[string]string, rpmImageTags map[string][]string, rpmMetadata map[string]ImageType, conflicts map[string]error) FeederLoadResponse {
+	res := FeederLoadResponse{}
+	res.Images = f.rpmImages(rpmImages, rpmImageTags, rpmMetadata)
+
+	for tag, err := range conflicts {
+		for _, t := range f.targets {
 			res.FailedImports = append(
 				res.FailedImports,
 				FailedImportError{
-					Image: tag,
-					Error: err,
+					Image:    tag,
+					Target:   t.name,
+					Error:    err,
+					Category: CategoryConflict,
 				})
-		} else {
-			err = f.feeder.TagImage(tag, imagesToImportTags[tag])
-			if err != nil {
-				log.Warnf("Could not tag image %s: %v", file, err)
+		}
+	}
+
+	imported := f.importImages(ctx, rpmImages, rpmImageTags, rpmMetadata)
+	f.recordImports(ctx, imported.SuccessfulImports, rpmImageTags, rpmMetadata)
+	f.state.recordMetadataFiles(rpmMetadata)
+	res.SuccessfulImports = append(res.SuccessfulImports, imported.SuccessfulImports...)
+	res.FailedImports = append(res.FailedImports, imported.FailedImports...)
+	res.UpToDateImages = imported.UpToDateImages
+
+	return res
+}
+
+// importJob is the import of a single image into a target
+type importJob struct {
+	target target
+	image  string
+	file   string
+	format string
+	tags   []string
+	// the repotags found in the target before the import
+	present map[string]ImageID
+	// the checksum verified while importing the file, nil when none
+	checksum *imageChecksum
+	// the file prepared for the import, shared by the jobs of the image
+	prepared *preparedImage
+}
+
+// preparedImage is the file imported into every target for an image: the
+// image file itself or the archive it has been converted into, or its copy
+// accepted by the signature policy. It is prepared by the first job of the
+// image and its temporary files are removed once the last job is done.
+type preparedImage struct {
+	once     sync.Once
+	file     string
+	category string
+	err      error
+
+	mu sync.Mutex
+	// the jobs of the image not done yet
+	jobs int
+	// the files to remove once the jobs are done
+	temporary []string
+}
+
+// addTemporary records a temporary file holding the prepared image
+func (p *preparedImage) addTemporary(file string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.temporary = append(p.temporary, file)
+}
+
+// done tells p that one of the jobs of its image is done, removing the
+// temporary files after the last one
+func (p *preparedImage) done() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.jobs--
+	if p.jobs > 0 {
+		return
+	}
+	for _, file := range p.temporary {
+		os.RemoveAll(file)
+	}
+}
+
+// the time allowed to roll back a failed import, which has to happen even
+// when the import has been interrupted
+const rollbackTimeout = time.Minute
+
+// importImages imports the RPMs images into every target, running up to
+// FeederConfig.Concurrency imports at the same time. The images are tagged by
+// one job at a time per target.
+func (f *Feeder) importImages(ctx context.Context, rpmImages map[string]string, rpmImageTags map[string][]string, rpmMetadata map[string]ImageType) FeederLoadResponse {
+	res := FeederLoadResponse{}
+	jobs := []importJob{}
+	tagLocks := make(map[string]*sync.Mutex)
+	checksums := f.imageChecksums(rpmImages, rpmMetadata)
+	prepared := make(map[string]*preparedImage)
+
+	for _, t := range f.targets {
+		tagLocks[t.name] = &sync.Mutex{}
+		present, err := f.presentImages(ctx, t)
+		if err != nil {
+			log.Warnf("Could not compute images to import into %s: %v", t.name, err)
+			for tag := range rpmImages {
 				res.FailedImports = append(
 					res.FailedImports,
 					FailedImportError{
-						Image: tag,
-						Error: err,
+						Image:    tag,
+						Target:   t.name,
+						Error:    err,
+						Category: errorCategory(ctx, t.name, err),
 					})
-			} else {
-				res.SuccessfulImports = append(res.SuccessfulImports, tag)
 			}
+			continue
+		}
+
+		imagesToImport, imagesToImportTags := f.imagesToImport(t, present, rpmImages, rpmImageTags, rpmMetadata)
+		for tag := range rpmImages {
+			if _, ok := imagesToImport[tag]; !ok {
+				res.UpToDateImages = append(res.UpToDateImages, UpToDateImage{Image: tag, Target: t.name})
+			}
+		}
+		log.Debugf("Images to import into %s: %v", t.name, imagesToImport)
+		for tag, file := range imagesToImport {
+			if prepared[tag] == nil {
+				prepared[tag] = &preparedImage{}
+			}
+			prepared[tag].jobs++
+			jobs = append(jobs, importJob{
+				target:   t,
+				image:    tag,
+				file:     file,
+				format:   rpmMetadata[tag].Format,
+				tags:     imagesToImportTags[tag],
+				present:  present,
+				checksum: checksums[tag],
+				prepared: prepared[tag],
+			})
 		}
 	}
 
-	return res, nil
+	concurrency := f.config.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	log.Debugf("Importing %d images, %d at a time", len(jobs), concurrency)
+
+	queue := make(chan importJob)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				start := time.Now()
+				category, err := f.runJob(ctx, job, tagLocks[job.target.name], rpmMetadata)
+				duration := time.Since(start)
+
+				mutex.Lock()
+				if err != nil {
+					res.FailedImports = append(
+						res.FailedImports,
+						FailedImportError{
+							Image:    job.image,
+							Target:   job.target.name,
+							Error:    err,
+							Category: category,
+							Duration: duration,
+						})
+				} else {
+					res.SuccessfulImports = append(
+						res.SuccessfulImports,
+						SuccessfulImport{
+							Image:    job.image,
+							Target:   job.target.name,
+							Duration: duration,
+						})
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	for _, job := range jobs {
+		queue <- job
+	}
+	close(queue)
+	wg.Wait()
+	f.recordChecksums(checksums)
+
+	// report the imports in a stable order, whatever the order they
+	// completed in
+	sort.Slice(res.SuccessfulImports, func(i, j int) bool {
+		a, b := res.SuccessfulImports[i], res.SuccessfulImports[j]
+		return a.Target < b.Target || (a.Target == b.Target && a.Image < b.Image)
+	})
+	sort.Slice(res.FailedImports, func(i, j int) bool {
+		a, b := res.FailedImports[i], res.FailedImports[j]
+		return a.Target < b.Target || (a.Target == b.Target && a.Image < b.Image)
+	})
+	sort.Slice(res.UpToDateImages, func(i, j int) bool {
+		a, b := res.UpToDateImages[i], res.UpToDateImages[j]
+		return a.Target < b.Target || (a.Target == b.Target && a.Image < b.Image)
+	})
+
+	return res
 }
 
-//normalizeNameTag split the image into it's name and tag.
+// runJob imports the image of job, prepared by the first job of the image.
+// The image file is verified against its checksum by whichever step reads it
+// first. Returns the category of the failure, if any.
+func (f *Feeder) runJob(ctx context.Context, job importJob, tagLock *sync.Mutex, rpmMetadata map[string]ImageType) (string, error) {
+	ctx = withChecksum(ctx, job.checksum)
+	metadata := rpmMetadata[job.image]
+	if job.prepared != nil {
+		defer job.prepared.done()
+		job.prepared.once.Do(func() {
+			f.prepareImage(ctx, job, metadata)
+		})
+		if job.prepared.err != nil {
+			return job.prepared.category, job.prepared.err
+		}
+		job.file = job.prepared.file
+	}
+
+	if err := f.importImage(ctx, job, tagLock); err != nil {
+		return errorCategory(ctx, job.target.name, err), err
+	}
+	return "", nil
+}
+
+// prepareImage prepares the file of job to be imported into every target,
+// converting it when it is shipped as a root filesystem tarball. When a
+// signature policy is configured, the copy of the image accepted by the
+// policy is imported.
+func (f *Feeder) prepareImage(ctx context.Context, job importJob, metadata ImageType) {
+	p := job.prepared
+	p.file = job.file
+	if metadata.Type == rootfsImageType {
+		image, err := convertRootfsImage(ctx, p.file, job.image, metadata.Config)
+		if err != nil {
+			p.err = job.checksum.failure(err)
+			log.Warnf("Could not convert root filesystem %s: %v", p.file, p.err)
+			p.category = CategoryConversion
+			if _, ok := p.err.(checksumError); ok {
+				p.category = CategoryChecksum
+			}
+			return
+		}
+		p.addTemporary(image)
+		p.file = image
+	}
+	if f.config.SignaturePolicy != "" {
+		verified, err := verifiedCopy(ctx, f.config.SignaturePolicy, p.file, job.format, job.image, signatureFiles(metadata))
+		if err != nil {
+			p.err = job.checksum.failure(err)
+			log.Warnf("Image %s: %v", job.image, p.err)
+			p.category = errorCategory(ctx, job.target.name, p.err)
+			return
+		}
+		p.addTemporary(verified)
+		p.file = verified
+	}
+}
+
+// importImage loads the image of job into its target and tags it, holding
+// tagLock while tagging. The import is given up once ctx is done or the
+// configured image timeout expires. The import is all or nothing: when the
+// image file does not match its checksum or a tag cannot be applied the
+// repotags added so far, including the loaded image, are removed.
+func (f *Feeder) importImage(ctx context.Context, job importJob, tagLock *sync.Mutex) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if f.config.ImageTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(f.config.ImageTimeout))
+		defer cancel()
+	}
+
+	err := retry(ctx, f.config.Retry, job.target.name, "loading "+job.file, func() error {
+		_, err := job.target.feeder.LoadImage(ctx, job.file, job.format)
+		return err
+	})
+	if err != nil {
+		err = job.checksum.failure(err)
+		log.Warnf("Could not load image %s into %s: %v", job.file, job.target.name, err)
+		return err
+	}
+
+	added := []string{}
+	if _, ok := job.present[job.image]; !ok {
+		added = append(added, job.image)
+	}
+	// the loaded image is only trusted once its whole file has been read
+	if err := job.checksum.verify(ctx); err != nil {
+		log.Warnf("Image %s: %v", job.image, err)
+		f.rollback(job.target, added)
+		return err
+	}
+
+	tagLock.Lock()
+	defer tagLock.Unlock()
+	for _, tag := range job.tags {
+		err = retry(ctx, f.config.Retry, job.target.name, "tagging "+job.image, func() error {
+			return job.target.feeder.TagImage(ctx, job.image, []string{tag})
+		})
+		if err != nil {
+			log.Warnf("Could not tag image %s in %s: %v", job.file, job.target.name, err)
+			f.rollback(job.target, added)
+			return err
+		}
+		if _, ok := job.present[tag]; !ok {
+			added = append(added, tag)
+		}
+	}
+	return nil
+}
+
+// rollback removes the repotags added to target by a failed import, the
+// tags first and the name of the loaded image last, which deletes the image
+// once nothing references it anymore. Tags that existed before the import
+// are left alone. Nothing is removed from targets implementing
+// manifestRemover, which would lose the tags pointing to the same content.
+func (f *Feeder) rollback(t target, added []string) {
+	if _, ok := t.feeder.(manifestRemover); ok {
+		log.Warnf("Not rolling back %v in %s: the other tags of the image would be removed too", added, t.name)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+	defer cancel()
+
+	for i := len(added) - 1; i >= 0; i-- {
+		log.Debugf("Rolling back %s in %s", added[i], t.name)
+		err := retry(ctx, f.config.Retry, t.name, "removing "+added[i], func() error {
+			return t.feeder.RemoveImage(ctx, added[i])
+		})
+		if err != nil {
+			log.Warnf("Could not remove %s from %s: %v", added[i], t.name, err)
+		}
+	}
+}
+
+// normalizeNameTag split the image into it's name and tag.
 func normalizeNameTag(image string) (string, string, error) {
 	// Remove illegal characters when image is "<none>:<none>"
 	re := regexp.MustCompile(`<|>`)
@@ -255,7 +865,7 @@ func isWhitelisted(image string, whitelist []string) (bool, error) {
 
 // shouldImportImage will check if any tag under newTags is not inside oldTags.
 // If any tag is found that matches this condition, we should import the image.
-func (f *Feeder) shouldImportImage(oldTags, newTags []string) (bool) {
+func (f *Feeder) shouldImportImage(oldTags, newTags []string) bool {
 	for _, newTag := range newTags {
 		if !stringInSlice(newTag, oldTags) {
 			return true
@@ -264,107 +874,353 @@ func (f *Feeder) shouldImportImage(oldTags, newTags []string) (bool) {
 	return false
 }
 
-// imagesToImport computes the RPMs images that have to be loaded into the CRI
-// and returns a map with the repotag string as key and the name of the file as
-// value and a map with additional repotags.
-func (f *Feeder) imagesToImport(path string) (map[string]string, map[string][]string, error) {
+// whitelistedRPMImages returns the RPMs images stored inside of `dirs`, the
+// configured sources when empty, that are allowed by the whitelist, with the
+// repotag string as key and the name of the file as value, a map with
+// additional repotags, a map with the metadata of the images and the
+// whitelisted images left out because of a conflict.
+func (f *Feeder) whitelistedRPMImages(dirs []string) (map[string]string, map[string][]string, map[string]ImageType, map[string]error, error) {
 	rpmImages := make(map[string]string)
 	rpmImageTags := make(map[string][]string)
+	rpmMetadata := make(map[string]ImageType)
+	conflicts := make(map[string]error)
 
-	currentRpmImages, currentRpmImageTags, err := findRPMImages(path)
+	currentRpmImages, currentRpmImageTags, currentRpmMetadata, currentConflicts, err := findRPMImages(f.config.sourceDirs(dirs), f.state, f.config)
 	if err != nil {
-		return rpmImages, rpmImageTags, err
+		return rpmImages, rpmImageTags, rpmMetadata, conflicts, err
 	}
 
-	images, err := f.feeder.Images()
-	if err != nil {
-		return rpmImages, rpmImageTags, err
-	}
-	if len(images) > 0 {
-		log.Debugf("Found the following images in the local storage:")
-	}
-	for _, img := range images {
-		log.Debugf("%s", img)
+	for rpmImage, err := range currentConflicts {
+		if whitelisted, _ := isWhitelisted(rpmImage, f.config.Whitelist); whitelisted {
+			conflicts[rpmImage] = err
+		}
 	}
-
-	for rpmImage, _ := range currentRpmImages {
+	for rpmImage := range currentRpmImages {
 		whitelisted, err := isWhitelisted(rpmImage, f.config.Whitelist)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, nil, nil, err
 		}
 		if whitelisted == false {
 			log.Debugf("Image %s is not whitelisted: ignoring", rpmImage)
 		} else {
-			if f.shouldImportImage(images, currentRpmImageTags[rpmImage]) {
-				// The image is whitelisted and has not been imported yet
-				log.Debugf("Image %s is whitelisted: marking as to be imported", rpmImage)
-				rpmImages[rpmImage] = currentRpmImages[rpmImage]
-				rpmImageTags[rpmImage] = currentRpmImageTags[rpmImage]
-			} else {
-				log.Debugf("Image %s is whitelisted but has already been imported", rpmImage)
+			log.Debugf("Image %s is whitelisted", rpmImage)
+			rpmImages[rpmImage] = currentRpmImages[rpmImage]
+			rpmImageTags[rpmImage] = currentRpmImageTags[rpmImage]
+			rpmMetadata[rpmImage] = currentRpmMetadata[rpmImage]
+		}
+	}
+
+	return rpmImages, rpmImageTags, rpmMetadata, conflicts, nil
+}
+
+// imagesToImport computes which of the whitelisted RPMs images have to be
+// loaded into the container engine of target t, holding the present
+// repotags, and returns a map with the repotag string as key and the name of
+// the file as value and a map with additional repotags. Images whose tags
+// point to a different content than the one described by their metadata are
+// imported again.
+func (f *Feeder) imagesToImport(t target, present map[string]ImageID, rpmImages map[string]string, rpmImageTags map[string][]string, rpmMetadata map[string]ImageType) (map[string]string, map[string][]string) {
+	images := make(map[string]string)
+	imageTags := make(map[string][]string)
+
+	if len(present) > 0 {
+		log.Debugf("Found the following images in the local storage of %s:", t.name)
+	}
+	for img, id := range present {
+		log.Debugf("%s %s", img, id)
+	}
+
+	for rpmImage, file := range rpmImages {
+		reason := f.importReason(t, present, rpmImage, rpmImageTags[rpmImage], rpmMetadata[rpmImage])
+		switch {
+		case reason == "":
+			// remember the content already in place, to notice when it
+			// gets replaced
+			record := f.state.fileRecord(rpmMetadata[rpmImage])
+			if record != nil && record.ImageIDs[t.name] == (ImageID{}) && !record.Outdated {
+				f.state.recordImageID(t.name, rpmMetadata[rpmImage], present[rpmImage])
+			}
+			log.Debugf("Image %s has already been imported into %s", rpmImage, t.name)
+			continue
+		case f.shouldImportImage(presentTags(present), rpmImageTags[rpmImage]):
+			log.Debugf("Image %s: marking as to be imported into %s", rpmImage, t.name)
+		default:
+			log.Infof("Image %s: %s in %s, importing it again", rpmImage, reason, t.name)
+		}
+		images[rpmImage] = file
+		imageTags[rpmImage] = rpmImageTags[rpmImage]
+	}
+
+	log.Debugf("Images to be imported into %s %+v", t.name, imageTags)
+
+	return images, imageTags
+}
+
+// importReason returns why the RPM image repotag, with the additional tags,
+// has to be imported into target t holding the present repotags. An empty
+// string is returned when the image is already in place.
+func (f *Feeder) importReason(t target, present map[string]ImageID, repotag string, tags []string, metadata ImageType) string {
+	record := f.state.fileRecord(metadata)
+	if f.shouldImportImage(presentTags(present), tags) {
+		missing := []string{}
+		for _, tag := range tags {
+			if _, ok := present[tag]; !ok {
+				missing = append(missing, tag)
 			}
 		}
+		return fmt.Sprintf("%s missing", strings.Join(missing, ", "))
+	}
+	if reason := contentMismatch(present, repotag, tags, expectedImageID(t, metadata, record)); reason != "" {
+		return reason
+	}
+	if record != nil && record.Outdated && !hasDigests(metadata) && record.ImageIDs[t.name] == (ImageID{}) {
+		return fmt.Sprintf("%s changed since the last import", metadata.metadataFile)
+	}
+	return ""
+}
+
+// presentTags returns the repotags of present
+func presentTags(present map[string]ImageID) []string {
+	tags := []string{}
+	for tag := range present {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// hasDigests returns true if metadata describes the content of the image
+func hasDigests(metadata ImageType) bool {
+	return metadata.ConfigDigest != "" || metadata.ManifestDigest != ""
+}
+
+// expectedImageID returns the content the tags of an RPM image should point
+// to in target t: the one described by its metadata or, failing that, the
+// one produced by the last import of the unchanged files.
+func expectedImageID(t target, metadata ImageType, record *fileRecord) ImageID {
+	if hasDigests(metadata) {
+		return ImageID{Config: metadata.ConfigDigest, Manifest: metadata.ManifestDigest}
 	}
+	if record != nil {
+		return record.ImageIDs[t.name]
+	}
+	return ImageID{}
+}
 
-	log.Debugf("Images to be imported %+v", rpmImageTags)
+// contentMismatch returns why the content behind the repotag of an RPM image
+// or one of its tags differs from the expected one, an empty string when it
+// does not or cannot be told. The config digest is preferred over the
+// manifest digest, which changes when an engine converts the manifest.
+func contentMismatch(present map[string]ImageID, repotag string, tags []string, expected ImageID) string {
+	for _, tag := range append([]string{repotag}, tags...) {
+		id, ok := present[tag]
+		if !ok {
+			continue
+		}
+		if expected.Config != "" && id.Config != "" {
+			if id.Config != expected.Config {
+				return fmt.Sprintf("%s has config digest %s instead of %s", tag, id.Config, expected.Config)
+			}
+			continue
+		}
+		if expected.Manifest != "" && id.Manifest != "" && id.Manifest != expected.Manifest {
+			return fmt.Sprintf("%s has manifest digest %s instead of %s", tag, id.Manifest, expected.Manifest)
+		}
+	}
+	return ""
+}
 
-	return rpmImages, rpmImageTags, nil
+// presentImages returns the repotags stored inside of the target with the
+// content they point to
+func (f *Feeder) presentImages(ctx context.Context, t target) (map[string]ImageID, error) {
+	var present map[string]ImageID
+	err := retry(ctx, f.config.Retry, t.name, "listing images", func() error {
+		var err error
+		present, err = t.feeder.Images(ctx)
+		return err
+	})
+	return present, err
 }
 
-// Finds all the Docker images shipped by RPMs
+// Finds all the Docker images shipped by RPMs inside of the dirs
 // Returns a map with the repotag string as key and the full path to the
-// file as value, and a map with additional repotags
-func findRPMImages(path string) (map[string]string, map[string][]string, error) {
-	log.Debugf("Searching images in %s", path)
-	walker := wlk.NewWalker(path, ".metadata")
+// file as value, a map with additional repotags, a map with the metadata
+// of the images and the images left out because of a conflict that cannot be
+// resolved, by repotag. The files recorded in the journal of state, when not
+// nil, are verified again only once they changed.
+func findRPMImages(dirs []string, state *feederState, config FeederConfig) (map[string]string, map[string][]string, map[string]ImageType, map[string]error, error) {
 	images := make(map[string]string)
 	image_tags := make(map[string][]string)
+	image_metadata := make(map[string]ImageType)
+
+	found := []rpmImage{}
+	for _, path := range dirs {
+		dirImages, err := findDirImages(path, state, config)
+		if err != nil {
+			return images, image_tags, image_metadata, nil, err
+		}
+		found = append(found, dirImages...)
+	}
+	if state != nil {
+		seen := make(map[string]bool)
+		for _, image := range found {
+			seen[image.metadata.metadataFile] = true
+		}
+		state.pruneFiles(dirs, seen)
+	}
+
+	// the same repotag can be shipped inside of several directories
+	found, conflicts := resolveConflicts(found, config.ConflictPolicy)
+	for repotag, err := range conflicts {
+		log.Warnf("Ignoring image %s: %v", repotag, err)
+	}
+	for _, image := range found {
+		images[image.repotag] = image.file
+		image_tags[image.repotag] = image.tags
+		image_metadata[image.repotag] = image.metadata
+	}
+
+	log.Debugf("Found the following RPM images: %+v", images)
+	return images, image_tags, image_metadata, conflicts, nil
+}
+
+// findDirImages returns the images found inside of the directory stored at
+// path, according to its settings
+func findDirImages(path string, state *feederState, config FeederConfig) ([]rpmImage, error) {
+	log.Debugf("Searching images in %s", path)
+	verification := config.verification(path)
+	verifier, err := wlk.NewVerifier(verification)
+	if err != nil {
+		return nil, err
+	}
+	walker := config.newWalker(path)
+	walker.Verifier = verifier
+	if state != nil {
+		walker.Verified = func(file string) bool {
+			return state.verified(file, verification)
+		}
+	}
 
-	if err := filepath.Walk(path, walker.Scan); err != nil {
-		return images, image_tags, err
+	if err := walker.Walk(); err != nil {
+		return nil, err
+	}
+	failed := []string{}
+	for file := range walker.Failures {
+		failed = append(failed, file)
+	}
+	sort.Strings(failed)
+	for _, file := range failed {
+		log.Warnf("Ignoring file %s because verification failed: %v", filepath.Join(path, file), walker.Failures[file])
 	}
 
+	found := []rpmImage{}
 	for _, file := range walker.Files {
 		file_path := filepath.Join(path, file)
 		repotag, repotags, image, err := repotagFromRPMFile(file_path)
 		if err != nil {
-			return images, image_tags, err
+			return nil, err
 		}
-		// Check if image exist on disk
-		image_path := filepath.Join(path, image)
+		// Check if image exist on disk, next to its .metadata file
+		image_path := filepath.Join(filepath.Dir(file_path), image.File)
 		if _, err := os.Stat(image_path); err == nil {
-			images[repotag] = image_path
-			image_tags[repotag] = repotags
+			image.metadataFile = file_path
+			nevra, verified := walker.Packages[file]
+			// the image file is verified along with its .metadata file
+			if verified {
+				if _, err := walker.Verifier.Verify(image_path); err != nil {
+					log.Warnf("Ignoring file %s because verification failed: %v", file_path, err)
+					continue
+				}
+			}
+			if state != nil {
+				state.updateFile(file_path, image_path, nevra, verification)
+				if record := state.fileRecord(image); record != nil {
+					// the checksum verifier checked the image file already
+					if verified && verification == wlk.VerifierChecksum {
+						record.ImageChecksum = image.SHA256
+					}
+					nevra = record.NEVRA
+				}
+			}
+			found = append(found, rpmImage{
+				repotag:      repotag,
+				tags:         repotags,
+				file:         image_path,
+				metadata:     image,
+				nevra:        nevra,
+				verification: verification,
+			})
 		} else {
 			log.Debugf("Image %s does not exist", image_path)
 		}
 	}
-
-	log.Debugf("Found the following RPM images: %+v", images)
-	return images, image_tags, nil
+	return found, nil
 }
 
 // Compute the repotag (`<name>:<tag>`) starting from the name of the tar.xz
 // file shipped by RPM
-// Returns repotag (`<name>:<tag>`), a list of additional tags, and image name
-func repotagFromRPMFile(file string) (string, []string, string, error) {
+// Returns repotag (`<name>:<tag>`), a list of additional tags, and the image
+// metadata
+func repotagFromRPMFile(file string) (string, []string, ImageType, error) {
 	data, err := ioutil.ReadFile(file)
 	if err != nil {
-		return "", nil, "", err
+		return "", nil, ImageType{}, err
 	}
 
 	var metadata MetadataType
 	if err := json.Unmarshal(data, &metadata); err != nil {
-		return "", nil, "", err
+		return "", nil, ImageType{}, err
+	}
+
+	if metadata.Image.Type != "" && metadata.Image.Type != rootfsImageType {
+		return "", nil, ImageType{}, fmt.Errorf("%s: unknown image type '%s'", file, metadata.Image.Type)
+	}
+	switch metadata.Image.Format {
+	case "":
+		metadata.Image.Format = dockerArchiveFormat
+	case dockerArchiveFormat, ociArchiveFormat, ociLayoutFormat:
+		if metadata.Image.Type == rootfsImageType {
+			return "", nil, ImageType{}, fmt.Errorf("%s: the format of rootfs images cannot be specified", file)
+		}
+	default:
+		return "", nil, ImageType{}, fmt.Errorf("%s: unknown image format '%s'", file, metadata.Image.Format)
+	}
+
+	for _, d := range []string{metadata.Image.ConfigDigest, metadata.Image.ManifestDigest} {
+		if d == "" {
+			continue
+		}
+		if _, err := digest.Parse(d); err != nil {
+			return "", nil, ImageType{}, fmt.Errorf("%s: invalid digest '%s': %v", file, d, err)
+		}
+	}
+	// the images built out of a root filesystem are not reproducible
+	if metadata.Image.Type == rootfsImageType && (metadata.Image.ConfigDigest != "" || metadata.Image.ManifestDigest != "") {
+		return "", nil, ImageType{}, fmt.Errorf("%s: the digests of rootfs images cannot be specified", file)
+	}
+	if metadata.Image.Type == rootfsImageType && len(metadata.Image.Signatures) > 0 {
+		return "", nil, ImageType{}, fmt.Errorf("%s: rootfs images cannot be signed", file)
+	}
+	if metadata.Image.SHA256 != "" {
+		if err := digest.NewDigestFromHex("sha256", metadata.Image.SHA256).Validate(); err != nil {
+			return "", nil, ImageType{}, fmt.Errorf("%s: invalid sha256 '%s': %v", file, metadata.Image.SHA256, err)
+		}
+	}
+	if metadata.Image.Size < 0 {
+		return "", nil, ImageType{}, fmt.Errorf("%s: invalid size %d", file, metadata.Image.Size)
+	}
+	// the checksum covers a single file
+	if metadata.Image.Format == ociLayoutFormat && (metadata.Image.SHA256 != "" || metadata.Image.Size != 0) {
+		return "", nil, ImageType{}, fmt.Errorf("%s: the checksum of oci layout directories cannot be specified", file)
 	}
 
 	normalizedName, _, err := normalizeNameTag(metadata.Image.Name)
 	if err != nil {
-		return "", nil, "", err
+		return "", nil, ImageType{}, err
 	}
 
 	repotag := normalizedName + ":" + metadata.Image.Tags[0]
-	image := metadata.Image.File
+	image := metadata.Image
 
 	repotags := make([]string, 0)
 
@@ -374,24 +1230,3 @@ func repotagFromRPMFile(file string) (string, []string, string, error) {
 
 	return repotag, repotags, image, nil
 }
-
-// runCommand executes the program specified in args with env and writes to
-// stdout.
-func runCommand(args []string, env string, stdout *os.File) error {
-	var cmd *exec.Cmd
-	var serr bytes.Buffer
-
-	log.Debugf("runCommand(args=%s, env=%s)", args, env)
-
-	cmd = exec.Command(args[0], args[1:]...)
-	cmd.Stdout = stdout
-	cmd.Stderr = &serr
-	cmd.Env = []string{env}
-
-	err := cmd.Run()
-	if err != nil {
-		log.Debugf("Error executing command: %s", serr.String())
-		return fmt.Errorf("error running command: %s", err.Error())
-	}
-	return nil
-}
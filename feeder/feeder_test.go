@@ -18,9 +18,56 @@
 package feeder
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
+// fakeFeeder is an in-memory FeederIface implementation
+type fakeFeeder struct {
+	images []string
+	// the content of the images, if known
+	ids map[string]ImageID
+}
+
+func (f *fakeFeeder) Images(ctx context.Context) (map[string]ImageID, error) {
+	images := make(map[string]ImageID)
+	for _, image := range f.images {
+		images[image] = f.ids[image]
+	}
+	return images, nil
+}
+
+func (f *fakeFeeder) LoadImage(ctx context.Context, path, format string) (string, error) {
+	return path, nil
+}
+
+func (f *fakeFeeder) TagImage(ctx context.Context, image string, tags []string) error {
+	for _, tag := range tags {
+		if !stringInSlice(tag, f.images) {
+			f.images = append(f.images, tag)
+		}
+	}
+	return nil
+}
+
+func (f *fakeFeeder) RemoveImage(ctx context.Context, image string) error {
+	for i, img := range f.images {
+		if img == image {
+			f.images = append(f.images[:i], f.images[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("image %s not found", image)
+}
+
 func TestNormalizeNameTag(t *testing.T) {
 	var name, tag string
 	var err error
@@ -118,3 +165,319 @@ func TestIsWhitelisted(t *testing.T) {
 		t.Error("Image should be whitelisted")
 	}
 }
+
+func TestFeederTargets(t *testing.T) {
+	var config FeederConfig
+
+	if err := json.Unmarshal([]byte(`{"feeder-target": "docker"}`), &config); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(config.Targets) != 1 || config.Targets[0] != "docker" {
+		t.Errorf("unexpected targets: %v", config.Targets)
+	}
+
+	if err := json.Unmarshal([]byte(`{"feeder-target": ["docker", "crio"]}`), &config); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(config.Targets) != 2 || config.Targets[0] != "docker" || config.Targets[1] != "crio" {
+		t.Errorf("unexpected targets: %v", config.Targets)
+	}
+
+	if err := json.Unmarshal([]byte(`{"feeder-target": 42}`), &config); err == nil {
+		t.Error("error expected but not received")
+	}
+}
+
+func TestImagesToImportPerTarget(t *testing.T) {
+	f := &Feeder{}
+	rpmImages := map[string]string{
+		"docker.io/opensuse/salt-api:13":    "/salt-api.tar.xz",
+		"docker.io/opensuse/salt-master:13": "/salt-master.tar.xz",
+	}
+	rpmImageTags := map[string][]string{
+		"docker.io/opensuse/salt-api:13":    {"docker.io/opensuse/salt-api:latest"},
+		"docker.io/opensuse/salt-master:13": {"docker.io/opensuse/salt-master:latest"},
+	}
+
+	docker := target{name: "docker", feeder: &fakeFeeder{
+		images: []string{"docker.io/opensuse/salt-api:latest"},
+	}}
+	crio := target{name: "crio", feeder: &fakeFeeder{}}
+
+	present, err := f.presentImages(context.Background(), docker)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	images, _ := f.imagesToImport(docker, present, rpmImages, rpmImageTags, map[string]ImageType{})
+	if len(images) != 1 || images["docker.io/opensuse/salt-master:13"] == "" {
+		t.Errorf("unexpected images to import into docker: %v", images)
+	}
+
+	present, err = f.presentImages(context.Background(), crio)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	images, _ = f.imagesToImport(crio, present, rpmImages, rpmImageTags, map[string]ImageType{})
+	if len(images) != 2 {
+		t.Errorf("unexpected images to import into crio: %v", images)
+	}
+}
+
+func TestImagesToImportContent(t *testing.T) {
+	f := &Feeder{}
+	rpmImages := map[string]string{"docker.io/opensuse/salt-api:13": "/salt-api.tar.xz"}
+	rpmImageTags := map[string][]string{"docker.io/opensuse/salt-api:13": {"docker.io/opensuse/salt-api:latest"}}
+	present := map[string]ImageID{
+		"docker.io/opensuse/salt-api:13":     {Config: "sha256:aaaa", Manifest: "sha256:cccc"},
+		"docker.io/opensuse/salt-api:latest": {Config: "sha256:aaaa", Manifest: "sha256:cccc"},
+	}
+	docker := target{name: "docker", feeder: &fakeFeeder{}}
+
+	tests := []struct {
+		metadata ImageType
+		expected int
+	}{
+		// nothing to compare with: the tags are enough
+		{ImageType{}, 0},
+		{ImageType{ConfigDigest: "sha256:aaaa"}, 0},
+		{ImageType{ConfigDigest: "sha256:bbbb"}, 1},
+		// the config digest takes precedence
+		{ImageType{ConfigDigest: "sha256:aaaa", ManifestDigest: "sha256:dddd"}, 0},
+		{ImageType{ManifestDigest: "sha256:dddd"}, 1},
+	}
+	for _, test := range tests {
+		rpmMetadata := map[string]ImageType{"docker.io/opensuse/salt-api:13": test.metadata}
+		images, _ := f.imagesToImport(docker, present, rpmImages, rpmImageTags, rpmMetadata)
+		if len(images) != test.expected {
+			t.Errorf("metadata %+v: expected %d images to import, got %v", test.metadata, test.expected, images)
+		}
+	}
+
+	// someone tagged a different image as latest
+	present["docker.io/opensuse/salt-api:latest"] = ImageID{Config: "sha256:bbbb"}
+	rpmMetadata := map[string]ImageType{"docker.io/opensuse/salt-api:13": {ConfigDigest: "sha256:aaaa"}}
+	if images, _ := f.imagesToImport(docker, present, rpmImages, rpmImageTags, rpmMetadata); len(images) != 1 {
+		t.Errorf("expected retagged image to be imported again, got %v", images)
+	}
+}
+
+func TestImageFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-image-format")
+	if err != nil {
+		t.Fatalf("error while creating test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for metadata, format := range map[string]string{
+		`{"image": {"name": "opensuse/salt-api", "tags": ["13"], "file": "salt-api.tar.xz"}}`:                          dockerArchiveFormat,
+		`{"image": {"name": "opensuse/salt-api", "tags": ["13"], "file": "salt-api.tar.xz", "format": "oci-archive"}}`: ociArchiveFormat,
+		`{"image": {"name": "opensuse/salt-api", "tags": ["13"], "file": "salt-api", "format": "oci"}}`:                ociLayoutFormat,
+		`{"image": {"name": "opensuse/salt-api", "tags": ["13"], "file": "salt-api.tar.xz", "format": "squashfs"}}`:    "",
+		`{"image": {"name": "opensuse/salt-api", "tags": ["13"], "file": "salt-api.tar.xz", "config-digest": "42"}}`:   "",
+	} {
+		file := filepath.Join(dir, "salt-api.metadata")
+		if err := ioutil.WriteFile(file, []byte(metadata), 0644); err != nil {
+			t.Fatalf("error writing metadata: %v", err)
+		}
+		_, _, image, err := repotagFromRPMFile(file)
+		if format == "" {
+			if err == nil {
+				t.Errorf("error expected for %s", metadata)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %s: %v", metadata, err)
+		} else if image.Format != format {
+			t.Errorf("expected format %s, got %s", format, image.Format)
+		}
+	}
+}
+
+func TestUnsupportedFormat(t *testing.T) {
+	if _, err := (&DockerFeeder{}).LoadImage(context.Background(), "/salt-api.tar.xz", ociArchiveFormat); err == nil {
+		t.Error("error expected when loading an oci-archive into docker")
+	}
+	if _, err := (&ContainerdFeeder{}).LoadImage(context.Background(), "/salt-api", ociLayoutFormat); err == nil {
+		t.Error("error expected when loading an oci layout into containerd")
+	}
+}
+
+// slowFeeder is a fakeFeeder taking some time to load images, recording how
+// many images it loaded at the same time.
+type slowFeeder struct {
+	fakeFeeder
+	mutex      sync.Mutex
+	loading    int
+	maxLoading int
+}
+
+func (f *slowFeeder) LoadImage(ctx context.Context, path, format string) (string, error) {
+	f.mutex.Lock()
+	f.loading++
+	if f.loading > f.maxLoading {
+		f.maxLoading = f.loading
+	}
+	f.mutex.Unlock()
+
+	select {
+	case <-time.After(20 * time.Millisecond):
+	case <-ctx.Done():
+	}
+
+	f.mutex.Lock()
+	f.loading--
+	f.mutex.Unlock()
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if path == "/broken.tar.xz" {
+		return "", fmt.Errorf("broken image")
+	}
+	return path, nil
+}
+
+func TestImportImagesConcurrency(t *testing.T) {
+	rpmImages := map[string]string{}
+	rpmImageTags := map[string][]string{}
+	rpmMetadata := map[string]ImageType{}
+	for i := 0; i < 8; i++ {
+		image := fmt.Sprintf("docker.io/opensuse/image%d:13", i)
+		rpmImages[image] = fmt.Sprintf("/image%d.tar.xz", i)
+		rpmImageTags[image] = []string{fmt.Sprintf("docker.io/opensuse/image%d:latest", i)}
+		rpmMetadata[image] = ImageType{Format: dockerArchiveFormat}
+	}
+	rpmImages["docker.io/opensuse/broken:13"] = "/broken.tar.xz"
+	rpmImageTags["docker.io/opensuse/broken:13"] = []string{"docker.io/opensuse/broken:latest"}
+
+	docker, crio := &slowFeeder{}, &slowFeeder{}
+	f := &Feeder{
+		targets: []target{{name: "docker", feeder: docker}, {name: "crio", feeder: crio}},
+		config:  FeederConfig{Concurrency: 3},
+	}
+
+	res := f.importImages(context.Background(), rpmImages, rpmImageTags, rpmMetadata)
+	if len(res.SuccessfulImports) != 16 {
+		t.Errorf("expected 16 successful imports, got %d", len(res.SuccessfulImports))
+	}
+	if len(res.FailedImports) != 2 {
+		t.Errorf("expected 2 failed imports, got %d", len(res.FailedImports))
+	}
+	if res.SuccessfulImports[0].Target != "crio" || res.SuccessfulImports[15].Target != "docker" {
+		t.Errorf("imports are not sorted: %v", res.SuccessfulImports)
+	}
+
+	maxLoading := docker.maxLoading + crio.maxLoading
+	if maxLoading < 2 || docker.maxLoading > 3 || crio.maxLoading > 3 {
+		t.Errorf("unexpected concurrent loads: docker %d, crio %d", docker.maxLoading, crio.maxLoading)
+	}
+	if len(docker.images) != 8 || len(crio.images) != 8 {
+		t.Errorf("unexpected tags: docker %v, crio %v", docker.images, crio.images)
+	}
+}
+
+func TestImportImagesTimeout(t *testing.T) {
+	rpmImages := map[string]string{"docker.io/opensuse/salt-api:13": "/salt-api.tar.xz"}
+	rpmImageTags := map[string][]string{"docker.io/opensuse/salt-api:13": {"docker.io/opensuse/salt-api:latest"}}
+
+	var config FeederConfig
+	if err := json.Unmarshal([]byte(`{"image-timeout": "5ms"}`), &config); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := json.Unmarshal([]byte(`{"timeout": 5}`), &FeederConfig{}); err == nil {
+		t.Error("error expected but not received")
+	}
+
+	f := &Feeder{targets: []target{{name: "docker", feeder: &slowFeeder{}}}, config: config}
+	res := f.importImages(context.Background(), rpmImages, rpmImageTags, map[string]ImageType{})
+	if len(res.FailedImports) != 1 || res.FailedImports[0].Error != context.DeadlineExceeded {
+		t.Errorf("expected the import to time out: %+v", res)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	f.config = FeederConfig{}
+	res = f.importImages(ctx, rpmImages, rpmImageTags, map[string]ImageType{})
+	if len(res.FailedImports) != 1 || res.FailedImports[0].Error != context.Canceled {
+		t.Errorf("expected the import to be canceled: %+v", res)
+	}
+}
+
+// loadingFeeder is a fakeFeeder recording the loaded image and failing to
+// apply the "broken" tag
+type loadingFeeder struct {
+	fakeFeeder
+}
+
+func (f *loadingFeeder) LoadImage(ctx context.Context, path, format string) (string, error) {
+	f.images = append(f.images, "docker.io/opensuse/salt-api:13")
+	return "docker.io/opensuse/salt-api:13", nil
+}
+
+func (f *loadingFeeder) TagImage(ctx context.Context, image string, tags []string) error {
+	for _, tag := range tags {
+		if strings.HasSuffix(tag, ":broken") {
+			return fmt.Errorf("cannot apply tag %s", tag)
+		}
+	}
+	return f.fakeFeeder.TagImage(ctx, image, tags)
+}
+
+func TestImportImageRollback(t *testing.T) {
+	present := map[string]ImageID{"docker.io/opensuse/salt-api:latest": {}}
+	feeder := &loadingFeeder{fakeFeeder{images: presentTags(present)}}
+	f := &Feeder{}
+
+	job := importJob{
+		target: target{name: "docker", feeder: feeder},
+		image:  "docker.io/opensuse/salt-api:13",
+		file:   "/salt-api.tar.xz",
+		format: dockerArchiveFormat,
+		tags: []string{
+			"docker.io/opensuse/salt-api:latest",
+			"docker.io/opensuse/salt-api:13.0.1",
+			"docker.io/opensuse/salt-api:broken",
+		},
+		present: present,
+	}
+	if err := f.importImage(context.Background(), job, &sync.Mutex{}); err == nil {
+		t.Fatal("error expected but not received")
+	}
+
+	// the tags that existed before the import are kept
+	if len(feeder.images) != 1 || feeder.images[0] != "docker.io/opensuse/salt-api:latest" {
+		t.Errorf("import not rolled back: %v", feeder.images)
+	}
+}
+
+// untaggableFeeder is a loadingFeeder whose RemoveImage would delete every
+// tag of the image
+type untaggableFeeder struct {
+	loadingFeeder
+}
+
+func (f *untaggableFeeder) removesManifests() {}
+
+func TestImportImageNoRollback(t *testing.T) {
+	feeder := &untaggableFeeder{}
+	f := &Feeder{}
+
+	job := importJob{
+		target: target{name: "registry", feeder: feeder},
+		image:  "docker.io/opensuse/salt-api:13",
+		file:   "/salt-api.tar.xz",
+		format: dockerArchiveFormat,
+		tags: []string{
+			"docker.io/opensuse/salt-api:13.0.1",
+			"docker.io/opensuse/salt-api:broken",
+		},
+		present: map[string]ImageID{},
+	}
+	if err := f.importImage(context.Background(), job, &sync.Mutex{}); err == nil {
+		t.Fatal("error expected but not received")
+	}
+
+	if len(feeder.images) != 2 {
+		t.Errorf("import rolled back: %v", feeder.images)
+	}
+}
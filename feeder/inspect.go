@@ -0,0 +1,445 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package feeder
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/containers/image/signature"
+	wlk "github.com/kubic-project/container-feeder/walker"
+	log "github.com/sirupsen/logrus"
+)
+
+// The states of an RPM image in a target
+const (
+	// the image and its tags are in place
+	StateImported = "imported"
+	// the image has to be imported, see TargetState.Reason
+	StatePending = "pending"
+	// the image is not allowed by the whitelist
+	StateIgnored = "ignored"
+	// the images of the target could not be listed
+	StateUnknown = "unknown"
+)
+
+type FailedTarget struct {
+	Target string
+	Error  error
+}
+
+type TargetState struct {
+	Target string
+	State  string
+	// why the image has to be imported
+	Reason string
+}
+
+type ListedImage struct {
+	Image    string
+	Tags     []string
+	File     string
+	Metadata string
+	// the RPM shipping the image, empty when unknown
+	Package string
+	Targets []TargetState
+}
+
+type FeederListResponse struct {
+	Images        []ListedImage
+	FailedTargets []FailedTarget
+}
+
+type PlannedImport struct {
+	Image  string
+	Tags   []string
+	Target string
+	Reason string
+}
+
+type FeederPlanResponse struct {
+	PlannedImports []PlannedImport
+	FailedTargets  []FailedTarget
+}
+
+type VerifiedFile struct {
+	Metadata string
+	Image    string
+	Package  string
+	Error    error
+}
+
+type FeederVerifyResponse struct {
+	Files []VerifiedFile
+}
+
+type TargetStatus struct {
+	Target string
+	// nil when the target is reachable
+	Error error
+	// the number of images stored inside of the target
+	Images int
+	// the number of images recorded as imported by container-feeder
+	Imported int
+	// the number of RPM images waiting to be imported
+	Pending int
+	// the number of imported images that would be pruned
+	Stale int
+	// the time of the most recent import
+	LastImport time.Time
+}
+
+type FeederStatusResponse struct {
+	StateFile string
+	// the number of .metadata files recorded in the journal
+	Files   int
+	Targets []TargetStatus
+}
+
+// inspectedFeeder returns a feeder reading the configuration and the state
+// without ever changing them. The targets are not waited for: the ones that
+// cannot be reached are returned apart.
+func inspectedFeeder(ctx context.Context) (*Feeder, []FailedTarget, error) {
+	config, err := loadConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	f := &Feeder{config: config}
+	f.loadFeederState()
+
+	names, err := expandTargets(ctx, config, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	failed := []FailedTarget{}
+	seen := []string{}
+	for _, name := range names {
+		if stringInSlice(name, seen) {
+			continue
+		}
+		seen = append(seen, name)
+		feeder, err := newTargetFeeder(ctx, name, config)
+		if err != nil {
+			log.Warnf("Could not connect to %s: %v", name, err)
+			failed = append(failed, FailedTarget{Target: name, Error: err})
+			continue
+		}
+		f.targets = append(f.targets, target{name: name, feeder: feeder})
+	}
+	return f, failed, nil
+}
+
+// presentInTargets lists the images of every target of f, the targets that
+// cannot be listed are appended to failed
+func (f *Feeder) presentInTargets(ctx context.Context, failed []FailedTarget) (map[string]map[string]ImageID, []FailedTarget) {
+	present := make(map[string]map[string]ImageID)
+	for _, t := range f.targets {
+		images, err := f.presentImages(ctx, t)
+		if err != nil {
+			log.Warnf("Could not list the images of %s: %v", t.name, err)
+			failed = append(failed, FailedTarget{Target: t.name, Error: err})
+			continue
+		}
+		present[t.name] = images
+	}
+	return present, failed
+}
+
+// sortedRepotags returns the keys of rpmImages sorted
+func sortedRepotags(rpmImages map[string]string) []string {
+	repotags := []string{}
+	for repotag := range rpmImages {
+		repotags = append(repotags, repotag)
+	}
+	sort.Strings(repotags)
+	return repotags
+}
+
+// List returns all the RPMs images stored inside of `dirs`, the configured
+// sources when empty, with their state in every configured target. Nothing
+// is changed.
+func List(ctx context.Context, dirs []string) (FeederListResponse, error) {
+	res := FeederListResponse{}
+
+	f, failed, err := inspectedFeeder(ctx)
+	if err != nil {
+		return res, err
+	}
+	rpmImages, rpmImageTags, rpmMetadata, _, err := findRPMImages(f.config.sourceDirs(dirs), f.state, f.config)
+	if err != nil {
+		return res, err
+	}
+	present, failed := f.presentInTargets(ctx, failed)
+	res.FailedTargets = failed
+
+	for _, repotag := range sortedRepotags(rpmImages) {
+		metadata := rpmMetadata[repotag]
+		image := ListedImage{
+			Image:    repotag,
+			Tags:     rpmImageTags[repotag],
+			File:     rpmImages[repotag],
+			Metadata: metadata.metadataFile,
+		}
+		if record := f.state.fileRecord(metadata); record != nil {
+			image.Package = record.NEVRA
+		}
+		whitelisted, err := isWhitelisted(repotag, f.config.Whitelist)
+		if err != nil {
+			return res, err
+		}
+
+		for _, t := range f.targets {
+			state := TargetState{Target: t.name}
+			if images, ok := present[t.name]; !ok {
+				state.State = StateUnknown
+			} else if !whitelisted {
+				state.State = StateIgnored
+			} else if state.Reason = f.importReason(t, images, repotag, rpmImageTags[repotag], metadata); state.Reason != "" {
+				state.State = StatePending
+			} else {
+				state.State = StateImported
+			}
+			image.Targets = append(image.Targets, state)
+		}
+		for _, failedTarget := range failed {
+			if !targetConnected(f.targets, failedTarget.Target) {
+				image.Targets = append(image.Targets, TargetState{Target: failedTarget.Target, State: StateUnknown})
+			}
+		}
+		res.Images = append(res.Images, image)
+	}
+	return res, nil
+}
+
+// Plan returns the imports Import would perform, with the reason of each of
+// them, without performing them
+func Plan(ctx context.Context, dirs []string) (FeederPlanResponse, error) {
+	res := FeederPlanResponse{}
+
+	f, failed, err := inspectedFeeder(ctx)
+	if err != nil {
+		return res, err
+	}
+	rpmImages, rpmImageTags, rpmMetadata, _, err := findRPMImages(f.config.sourceDirs(dirs), f.state, f.config)
+	if err != nil {
+		return res, err
+	}
+	present, failed := f.presentInTargets(ctx, failed)
+	res.FailedTargets = failed
+
+	res.PlannedImports, err = f.plannedImports(present, rpmImages, rpmImageTags, rpmMetadata)
+	return res, err
+}
+
+// plannedImports returns the imports of the whitelisted RPMs images into the
+// targets of f holding the present repotags, target by target. The targets
+// missing from present are skipped.
+func (f *Feeder) plannedImports(present map[string]map[string]ImageID, rpmImages map[string]string, rpmImageTags map[string][]string, rpmMetadata map[string]ImageType) ([]PlannedImport, error) {
+	planned := []PlannedImport{}
+	for _, t := range f.targets {
+		images, ok := present[t.name]
+		if !ok {
+			continue
+		}
+		for _, repotag := range sortedRepotags(rpmImages) {
+			whitelisted, err := isWhitelisted(repotag, f.config.Whitelist)
+			if err != nil {
+				return planned, err
+			}
+			if !whitelisted {
+				continue
+			}
+			reason := f.importReason(t, images, repotag, rpmImageTags[repotag], rpmMetadata[repotag])
+			if reason == "" {
+				continue
+			}
+			planned = append(planned, PlannedImport{
+				Image:  repotag,
+				Tags:   rpmImageTags[repotag],
+				Target: t.name,
+				Reason: reason,
+			})
+		}
+	}
+	return planned, nil
+}
+
+// Verify checks the integrity of every .metadata file stored inside of
+// `dirs`, the configured sources when empty, and of the image file it
+// references, with the configured verifier, against the checksums of the
+// metadata and the configured signature policy. The journal is ignored: every
+// file is verified again. The container engines are not involved.
+func Verify(ctx context.Context, dirs []string) (FeederVerifyResponse, error) {
+	res := FeederVerifyResponse{}
+
+	config, err := loadConfig()
+	if os.IsNotExist(err) {
+		config = FeederConfig{}
+	} else if err != nil {
+		return res, err
+	}
+	var policyContext *signature.PolicyContext
+	if config.SignaturePolicy != "" {
+		if policyContext, err = newSignaturePolicyContext(config.SignaturePolicy); err != nil {
+			return res, err
+		}
+		defer policyContext.Destroy()
+	}
+
+	for _, path := range config.sourceDirs(dirs) {
+		files, err := verifyDir(ctx, path, config, policyContext)
+		res.Files = append(res.Files, files...)
+		if err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// verifyDir checks the integrity of every .metadata file stored inside of
+// the directory stored at path, according to its settings, and of the image
+// file it references
+func verifyDir(ctx context.Context, path string, config FeederConfig, policyContext *signature.PolicyContext) ([]VerifiedFile, error) {
+	files := []VerifiedFile{}
+
+	walker := config.newWalker(path)
+	walker.VerifyFiles = false
+	verifier, err := wlk.NewVerifier(config.verification(path))
+	if err != nil {
+		return files, err
+	}
+	if err := walker.Walk(); err != nil {
+		return files, err
+	}
+
+	for _, file := range walker.Files {
+		if err := ctx.Err(); err != nil {
+			return files, err
+		}
+		metadataFile := filepath.Join(path, file)
+		verified := VerifiedFile{Metadata: metadataFile}
+
+		repotag, _, image, err := repotagFromRPMFile(metadataFile)
+		if err != nil {
+			verified.Error = err
+			files = append(files, verified)
+			continue
+		}
+		verified.Image = repotag
+		imageFile := filepath.Join(filepath.Dir(metadataFile), image.File)
+		if _, err := os.Stat(imageFile); err != nil {
+			verified.Error = err
+			files = append(files, verified)
+			continue
+		}
+		if verified.Package, verified.Error = verifier.Verify(metadataFile); verified.Error == nil {
+			_, verified.Error = verifier.Verify(imageFile)
+		}
+		if verified.Error == nil {
+			verified.Error = verifyChecksum(ctx, imageFile, image)
+		}
+		if verified.Error == nil && policyContext != nil {
+			image.metadataFile = metadataFile
+			verified.Error = verifyRPMImageSignature(ctx, policyContext, imageFile, repotag, image)
+		}
+		files = append(files, verified)
+	}
+	return files, nil
+}
+
+// verifyRPMImageSignature checks the RPM image stored at path against the
+// policy of policyContext, converting it first when it is a root filesystem
+func verifyRPMImageSignature(ctx context.Context, policyContext *signature.PolicyContext, path, repotag string, metadata ImageType) error {
+	if metadata.Type == rootfsImageType {
+		converted, err := convertRootfsImage(ctx, path, repotag, metadata.Config)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(converted)
+		path = converted
+	}
+	return verifySignature(ctx, policyContext, path, metadata.Format, repotag, signatureFiles(metadata))
+}
+
+// Status returns a summary of every configured target: whether it can be
+// reached, the images imported into it, waiting to be imported and waiting
+// to be pruned. Nothing is changed.
+func Status(ctx context.Context, dirs []string) (FeederStatusResponse, error) {
+	res := FeederStatusResponse{}
+
+	f, failed, err := inspectedFeeder(ctx)
+	if err != nil {
+		return res, err
+	}
+	res.StateFile = stateFile(f.config)
+	res.Files = len(f.state.Files)
+
+	// the whitelist is ignored for the stale images, like Prune does
+	rpmImages, rpmImageTags, rpmMetadata, _, err := findRPMImages(f.config.sourceDirs(dirs), f.state, f.config)
+	if err != nil {
+		return res, err
+	}
+	present, failed := f.presentInTargets(ctx, failed)
+	planned, err := f.plannedImports(present, rpmImages, rpmImageTags, rpmMetadata)
+	if err != nil {
+		return res, err
+	}
+
+	for _, t := range f.targets {
+		status := TargetStatus{Target: t.name}
+		records := f.state.Targets[t.name]
+		status.Imported = len(records)
+		status.Stale = len(staleRecords(records, f.config.sourceDirs(dirs), rpmMetadata, f.config))
+		for _, record := range records {
+			if record.Imported.After(status.LastImport) {
+				status.LastImport = record.Imported
+			}
+		}
+		for _, p := range planned {
+			if p.Target == t.name {
+				status.Pending++
+			}
+		}
+		for _, failedTarget := range failed {
+			if failedTarget.Target == t.name {
+				status.Error = failedTarget.Error
+			}
+		}
+		status.Images = len(present[t.name])
+		res.Targets = append(res.Targets, status)
+	}
+	for _, failedTarget := range failed {
+		if !targetConnected(f.targets, failedTarget.Target) {
+			res.Targets = append(res.Targets, TargetStatus{Target: failedTarget.Target, Error: failedTarget.Error})
+		}
+	}
+	return res, nil
+}
+
+// targetConnected returns true if the named target is one of targets
+func targetConnected(targets []target, name string) bool {
+	for _, t := range targets {
+		if t.name == name {
+			return true
+		}
+	}
+	return false
+}
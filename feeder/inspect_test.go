@@ -0,0 +1,74 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package feeder
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPlannedImports(t *testing.T) {
+	f := &Feeder{
+		targets: []target{
+			{name: "crio", feeder: &fakeFeeder{}},
+			{name: "docker", feeder: &fakeFeeder{}},
+			{name: "containerd", feeder: &fakeFeeder{}},
+		},
+		config: FeederConfig{Whitelist: []string{"docker.io/opensuse/salt-api", "docker.io/opensuse/salt-master"}},
+	}
+	rpmImages := map[string]string{
+		"docker.io/opensuse/salt-api:13":    "/salt-api.tar.xz",
+		"docker.io/opensuse/salt-master:13": "/salt-master.tar.xz",
+		"docker.io/library/busybox:1":       "/busybox.tar.xz",
+	}
+	rpmImageTags := map[string][]string{
+		"docker.io/opensuse/salt-api:13":    {"docker.io/opensuse/salt-api:latest"},
+		"docker.io/opensuse/salt-master:13": {"docker.io/opensuse/salt-master:latest"},
+		"docker.io/library/busybox:1":       {"docker.io/library/busybox:latest"},
+	}
+	rpmMetadata := map[string]ImageType{
+		"docker.io/opensuse/salt-api:13": {ConfigDigest: "sha256:aaaa"},
+	}
+	present := map[string]map[string]ImageID{
+		"crio": {},
+		"docker": {
+			"docker.io/opensuse/salt-api:13":        {Config: "sha256:bbbb"},
+			"docker.io/opensuse/salt-api:latest":    {Config: "sha256:bbbb"},
+			"docker.io/opensuse/salt-master:13":     {Config: "sha256:cccc"},
+			"docker.io/opensuse/salt-master:latest": {Config: "sha256:cccc"},
+		},
+		// containerd could not be listed
+	}
+
+	planned, err := f.plannedImports(present, rpmImages, rpmImageTags, rpmMetadata)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(planned) != 3 {
+		t.Fatalf("unexpected imports: %+v", planned)
+	}
+	for i, expected := range []PlannedImport{
+		{Image: "docker.io/opensuse/salt-api:13", Target: "crio", Reason: "docker.io/opensuse/salt-api:latest missing"},
+		{Image: "docker.io/opensuse/salt-master:13", Target: "crio", Reason: "docker.io/opensuse/salt-master:latest missing"},
+		{Image: "docker.io/opensuse/salt-api:13", Target: "docker", Reason: "config digest sha256:bbbb"},
+	} {
+		if planned[i].Image != expected.Image || planned[i].Target != expected.Target || !strings.Contains(planned[i].Reason, expected.Reason) {
+			t.Errorf("expected %+v, got %+v", expected, planned[i])
+		}
+	}
+}
@@ -0,0 +1,179 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package feeder
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	wlk "github.com/kubic-project/container-feeder/walker"
+	log "github.com/sirupsen/logrus"
+)
+
+// fileRecord is the journal entry of a verified .metadata file. It stays
+// valid, sparing the verification of the RPM, as long as the .metadata file
+// and the image file it references are unchanged.
+type fileRecord struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	// the sha256 digest of the .metadata file
+	Checksum     string    `json:"checksum"`
+	Image        string    `json:"image"`
+	ImageSize    int64     `json:"image-size"`
+	ImageModTime time.Time `json:"image-mtime"`
+	// the package shipping the files: name-epoch:version-release.arch
+	NEVRA string `json:"nevra,omitempty"`
+	// the verifier the files have been verified by (default: "rpm")
+	Verification string `json:"verification,omitempty"`
+	// the sha256 checksum the image file has been verified against
+	ImageChecksum string `json:"image-checksum,omitempty"`
+	// the image produced out of the files in every target
+	ImageIDs map[string]ImageID `json:"image-ids,omitempty"`
+	// the files changed after being imported: the targets lacking an
+	// image ID may hold the previous content
+	Outdated bool `json:"outdated,omitempty"`
+}
+
+// newFileRecord returns the record of the metadata file and of the image file
+// it references, as they are on disk
+func newFileRecord(metadataFile, imageFile string) (*fileRecord, error) {
+	data, err := ioutil.ReadFile(metadataFile)
+	if err != nil {
+		return nil, err
+	}
+	metadataInfo, err := os.Stat(metadataFile)
+	if err != nil {
+		return nil, err
+	}
+	imageInfo, err := os.Stat(imageFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileRecord{
+		Size:         metadataInfo.Size(),
+		ModTime:      metadataInfo.ModTime(),
+		Checksum:     fmt.Sprintf("sha256:%x", sha256.Sum256(data)),
+		Image:        imageFile,
+		ImageSize:    imageInfo.Size(),
+		ImageModTime: imageInfo.ModTime(),
+		ImageIDs:     make(map[string]ImageID),
+	}, nil
+}
+
+// sameFiles returns true if r and o describe the same files
+func (r *fileRecord) sameFiles(o *fileRecord) bool {
+	return r.Size == o.Size && r.ModTime.Equal(o.ModTime) && r.Checksum == o.Checksum &&
+		r.Image == o.Image && r.ImageSize == o.ImageSize && r.ImageModTime.Equal(o.ImageModTime)
+}
+
+// verified returns true if the metadata file has been verified by a previous
+// run, with the named verifier, and neither it nor its image file changed
+// since.
+func (s *feederState) verified(metadataFile, verification string) bool {
+	previous, ok := s.Files[metadataFile]
+	if !ok || previous.verification() != verification {
+		return false
+	}
+	current, err := newFileRecord(metadataFile, previous.Image)
+	if err != nil {
+		return false
+	}
+	if !current.sameFiles(previous) {
+		return false
+	}
+	log.Debugf("File %s is unchanged since it has been verified by %s", metadataFile, verification)
+	return true
+}
+
+// verification returns the name of the verifier the files have been verified
+// by, the records predating the verifiers being verified against the RPM
+// database
+func (r *fileRecord) verification() string {
+	if r.Verification == "" {
+		return wlk.VerifierRPM
+	}
+	return r.Verification
+}
+
+// updateFile records the metadata file, shipped by the package nevra and
+// verified by the named verifier, and the image file it references. The
+// record of unchanged files is kept as it is.
+func (s *feederState) updateFile(metadataFile, imageFile, nevra, verification string) {
+	current, err := newFileRecord(metadataFile, imageFile)
+	if err != nil {
+		log.Debugf("Could not record %s: %v", metadataFile, err)
+		delete(s.Files, metadataFile)
+		return
+	}
+
+	previous, ok := s.Files[metadataFile]
+	if ok && previous.sameFiles(current) {
+		// unchanged files verified again by another verifier
+		if previous.verification() != verification {
+			previous.NEVRA = nevra
+			previous.Verification = verification
+		}
+		return
+	}
+	current.NEVRA = nevra
+	current.Verification = verification
+	current.Outdated = ok && (previous.Outdated || len(previous.ImageIDs) > 0)
+	s.Files[metadataFile] = current
+}
+
+// pruneFiles forgets the metadata files stored inside of dirs, or of their
+// subdirectories, that are not listed in seen
+func (s *feederState) pruneFiles(dirs []string, seen map[string]bool) {
+	for metadataFile := range s.Files {
+		if seen[metadataFile] {
+			continue
+		}
+		for _, dir := range dirs {
+			if insideDir(dir, metadataFile) {
+				delete(s.Files, metadataFile)
+				break
+			}
+		}
+	}
+}
+
+// recordImageID records id as the image produced in the named target out of
+// the files described by metadata
+func (s *feederState) recordImageID(target string, metadata ImageType, id ImageID) {
+	record, ok := s.Files[metadata.metadataFile]
+	if !ok || (id.Config == "" && id.Manifest == "") {
+		return
+	}
+	if record.ImageIDs == nil {
+		record.ImageIDs = make(map[string]ImageID)
+	}
+	record.ImageIDs[target] = id
+}
+
+// fileRecord returns the journal entry of the files described by metadata,
+// nil if there is none
+func (s *feederState) fileRecord(metadata ImageType) *fileRecord {
+	if s == nil {
+		return nil
+	}
+	return s.Files[metadata.metadataFile]
+}
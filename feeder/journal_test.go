@@ -0,0 +1,124 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package feeder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	wlk "github.com/kubic-project/container-feeder/walker"
+)
+
+// writeMetadata writes the .metadata file of opensuse/salt-api and the image
+// file it references into dir and returns their paths
+func writeMetadata(t *testing.T, dir string) (string, string) {
+	metadata := filepath.Join(dir, "salt-api.metadata")
+	content := `{"image": {"name": "opensuse/salt-api", "tags": ["13", "latest"], "file": "salt-api.tar.xz"}}`
+	if err := ioutil.WriteFile(metadata, []byte(content), 0644); err != nil {
+		t.Fatalf("error writing metadata: %v", err)
+	}
+	image := filepath.Join(dir, "salt-api.tar.xz")
+	if err := ioutil.WriteFile(image, []byte("image"), 0644); err != nil {
+		t.Fatalf("error writing image: %v", err)
+	}
+	return metadata, image
+}
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-journal")
+	if err != nil {
+		t.Fatalf("error while creating test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	metadata, image := writeMetadata(t, dir)
+	state := newFeederState()
+	if state.verified(metadata, wlk.VerifierRPM) {
+		t.Error("unknown file reported as verified")
+	}
+	state.updateFile(metadata, image, "salt-api-0:13-1.1.x86_64", wlk.VerifierRPM)
+	if !state.verified(metadata, wlk.VerifierRPM) {
+		t.Error("unchanged file reported as not verified")
+	}
+
+	// the verification is skipped: no rpm is needed
+	rpmImages, _, rpmMetadata, _, err := findRPMImages([]string{dir}, state, FeederConfig{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(rpmImages) != 1 || rpmMetadata["docker.io/opensuse/salt-api:13"].metadataFile != metadata {
+		t.Fatalf("unexpected images: %v", rpmImages)
+	}
+	state.recordImageID("docker", rpmMetadata["docker.io/opensuse/salt-api:13"], ImageID{Config: "sha256:aaaa"})
+
+	// an update ships new content
+	if err := ioutil.WriteFile(image, []byte("new image"), 0644); err != nil {
+		t.Fatalf("error writing image: %v", err)
+	}
+	if state.verified(metadata, wlk.VerifierRPM) {
+		t.Error("changed file reported as verified")
+	}
+	state.updateFile(metadata, image, "salt-api-0:13-1.2.x86_64", wlk.VerifierRPM)
+	record := state.Files[metadata]
+	if !record.Outdated || len(record.ImageIDs) != 0 || record.NEVRA != "salt-api-0:13-1.2.x86_64" {
+		t.Errorf("unexpected record: %+v", record)
+	}
+
+	state.pruneFiles([]string{dir}, map[string]bool{})
+	if len(state.Files) != 0 {
+		t.Errorf("removed file not forgotten: %v", state.Files)
+	}
+}
+
+func TestImagesToImportJournal(t *testing.T) {
+	metadata := ImageType{metadataFile: "/salt-api.metadata"}
+	f := &Feeder{state: newFeederState()}
+	f.state.Files[metadata.metadataFile] = &fileRecord{ImageIDs: map[string]ImageID{}}
+
+	rpmImages := map[string]string{"docker.io/opensuse/salt-api:13": "/salt-api.tar.xz"}
+	rpmImageTags := map[string][]string{"docker.io/opensuse/salt-api:13": {"docker.io/opensuse/salt-api:latest"}}
+	rpmMetadata := map[string]ImageType{"docker.io/opensuse/salt-api:13": metadata}
+	present := map[string]ImageID{
+		"docker.io/opensuse/salt-api:13":     {Config: "sha256:aaaa"},
+		"docker.io/opensuse/salt-api:latest": {Config: "sha256:aaaa"},
+	}
+	docker := target{name: "docker", feeder: &fakeFeeder{}}
+
+	// the content in place is remembered
+	if images, _ := f.imagesToImport(docker, present, rpmImages, rpmImageTags, rpmMetadata); len(images) != 0 {
+		t.Errorf("unexpected images to import: %v", images)
+	}
+	if id := f.state.Files[metadata.metadataFile].ImageIDs["docker"]; id.Config != "sha256:aaaa" {
+		t.Fatalf("image ID not recorded: %v", id)
+	}
+
+	// and noticed once replaced
+	present["docker.io/opensuse/salt-api:latest"] = ImageID{Config: "sha256:bbbb"}
+	if images, _ := f.imagesToImport(docker, present, rpmImages, rpmImageTags, rpmMetadata); len(images) != 1 {
+		t.Errorf("expected retagged image to be imported again, got %v", images)
+	}
+
+	// the files changed after the import
+	present["docker.io/opensuse/salt-api:latest"] = ImageID{Config: "sha256:aaaa"}
+	f.state.Files[metadata.metadataFile] = &fileRecord{ImageIDs: map[string]ImageID{}, Outdated: true}
+	if images, _ := f.imagesToImport(docker, present, rpmImages, rpmImageTags, rpmMetadata); len(images) != 1 {
+		t.Errorf("expected updated image to be imported again, got %v", images)
+	}
+}
@@ -0,0 +1,277 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package feeder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/containers/image/oci/layout"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// OCIConfig holds the OCI image layout specific settings of the
+// container-feeder.json config
+type OCIConfig struct {
+	Directory string `json:"directory"`
+}
+
+// OCIFeeder exports images into a single OCI image layout. Every repotag is
+// recorded as an org.opencontainers.image.ref.name annotation of index.json,
+// blobs are stored once no matter how many images share them.
+type OCIFeeder struct {
+	dir string
+	// serializes the updates of index.json
+	mutex sync.Mutex
+}
+
+// NewOCIFeeder returns a pointer to an initialized OCIFeeder. Takes care of
+// creating the layout directory.
+func NewOCIFeeder(config OCIConfig) (*OCIFeeder, error) {
+	if config.Directory == "" {
+		return nil, fmt.Errorf("no oci directory configured")
+	}
+	if err := os.MkdirAll(config.Directory, 0755); err != nil {
+		return nil, fmt.Errorf("error creating %s: %v", config.Directory, err)
+	}
+	return &OCIFeeder{dir: config.Directory}, nil
+}
+
+// indexPath returns the path of the index.json of the layout
+func (f *OCIFeeder) indexPath() string {
+	return filepath.Join(f.dir, "index.json")
+}
+
+// readIndex returns the index.json of the layout; an empty index is returned
+// when the layout has not been written yet.
+func (f *OCIFeeder) readIndex() (*imgspecv1.Index, error) {
+	index := &imgspecv1.Index{}
+	data, err := ioutil.ReadFile(f.indexPath())
+	if os.IsNotExist(err) {
+		index.SchemaVersion = 2
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", f.indexPath(), err)
+	}
+	return index, nil
+}
+
+// writeIndex replaces the index.json of the layout with index
+func (f *OCIFeeder) writeIndex(index *imgspecv1.Index) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(f.indexPath(), data, 0644)
+}
+
+// blobPath returns the path of the blob identified by d
+func (f *OCIFeeder) blobPath(d digest.Digest) string {
+	return filepath.Join(f.dir, "blobs", d.Algorithm().String(), d.Hex())
+}
+
+// readManifest returns the manifest identified by d
+func (f *OCIFeeder) readManifest(d digest.Digest) (*imgspecv1.Manifest, error) {
+	data, err := ioutil.ReadFile(f.blobPath(d))
+	if err != nil {
+		return nil, err
+	}
+	manifest := &imgspecv1.Manifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("error parsing manifest %s: %v", d, err)
+	}
+	return manifest, nil
+}
+
+// Images returns the images recorded in the layout in the form
+// "<repo>:<tag>" with the digests of their manifest and config.
+func (f *OCIFeeder) Images(ctx context.Context) (map[string]ImageID, error) {
+	tags := make(map[string]ImageID)
+
+	index, err := f.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	for _, desc := range index.Manifests {
+		name, ok := desc.Annotations[imgspecv1.AnnotationRefName]
+		if !ok {
+			continue
+		}
+		normalizedName, normalizedTag, err := normalizeNameTag(name)
+		if err != nil {
+			log.Debugf("Ignoring image %s: %v", name, err)
+			continue
+		}
+		id := ImageID{Manifest: desc.Digest.String()}
+		if manifest, err := f.readManifest(desc.Digest); err == nil {
+			id.Config = manifest.Config.Digest.String()
+		}
+		tags[normalizedName+":"+normalizedTag] = id
+	}
+
+	return tags, nil
+}
+
+// LoadImage exports the specified image into the layout, using the repotag
+// stored inside of the image. Returns the image name.
+func (f *OCIFeeder) LoadImage(ctx context.Context, path, format string) (string, error) {
+	src, repotags, closeSrc, err := openImage(ctx, path, format)
+	if err != nil {
+		return "", err
+	}
+	defer closeSrc()
+
+	if len(repotags) == 0 {
+		return "", fmt.Errorf("image %s is not named", path)
+	}
+	normalizedName, normalizedTag, err := normalizeNameTag(repotags[0])
+	if err != nil {
+		return "", err
+	}
+	imgName := normalizedName + ":" + normalizedTag
+
+	dest, err := layout.NewReference(f.dir, imgName)
+	if err != nil {
+		return "", err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := copyImage(ctx, dest, src, nil, nil); err != nil {
+		return "", fmt.Errorf("error exporting image: %v", err)
+	}
+
+	log.Debugf("Loaded image: %v", imgName)
+	return imgName, nil
+}
+
+// TagImage tags the specified image with the supplied tags by adding an
+// index.json entry, pointing to the same manifest, for every tag.
+func (f *OCIFeeder) TagImage(ctx context.Context, image string, tags []string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	index, err := f.readIndex()
+	if err != nil {
+		return err
+	}
+
+	var source *imgspecv1.Descriptor
+	for i, manifest := range index.Manifests {
+		if manifest.Annotations[imgspecv1.AnnotationRefName] == image {
+			source = &index.Manifests[i]
+			break
+		}
+	}
+	if source == nil {
+		return fmt.Errorf("image %s not found in %s", image, f.dir)
+	}
+
+	for _, tag := range tags {
+		log.Debug("Tagging image: ", image, " with ", tag)
+		desc := *source
+		desc.Annotations = map[string]string{imgspecv1.AnnotationRefName: tag}
+
+		replaced := false
+		for i, manifest := range index.Manifests {
+			if manifest.Annotations[imgspecv1.AnnotationRefName] == tag {
+				index.Manifests[i] = desc
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			index.Manifests = append(index.Manifests, desc)
+		}
+	}
+
+	return f.writeIndex(index)
+}
+
+// RemoveImage removes the index.json entry of the specified image, then the
+// blobs no image refers to anymore.
+func (f *OCIFeeder) RemoveImage(ctx context.Context, image string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	index, err := f.readIndex()
+	if err != nil {
+		return err
+	}
+
+	manifests := []imgspecv1.Descriptor{}
+	for _, manifest := range index.Manifests {
+		if manifest.Annotations[imgspecv1.AnnotationRefName] != image {
+			manifests = append(manifests, manifest)
+		}
+	}
+	if len(manifests) == len(index.Manifests) {
+		return fmt.Errorf("image %s not found in %s", image, f.dir)
+	}
+	log.Debug("Removing image: ", image)
+	index.Manifests = manifests
+	if err := f.writeIndex(index); err != nil {
+		return err
+	}
+
+	return f.removeUnreferencedBlobs(index)
+}
+
+// removeUnreferencedBlobs deletes the blobs that are neither a manifest
+// listed in index nor the config or a layer of one of them.
+func (f *OCIFeeder) removeUnreferencedBlobs(index *imgspecv1.Index) error {
+	referenced := make(map[string]bool)
+	for _, desc := range index.Manifests {
+		referenced[f.blobPath(desc.Digest)] = true
+
+		manifest, err := f.readManifest(desc.Digest)
+		if err != nil {
+			return err
+		}
+		referenced[f.blobPath(manifest.Config.Digest)] = true
+		for _, layer := range manifest.Layers {
+			referenced[f.blobPath(layer.Digest)] = true
+		}
+	}
+
+	blobs, err := filepath.Glob(filepath.Join(f.dir, "blobs", "*", "*"))
+	if err != nil {
+		return err
+	}
+	for _, blob := range blobs {
+		if !referenced[blob] {
+			log.Debugf("Removing unreferenced blob %s", blob)
+			if err := os.Remove(blob); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package feeder
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOCIFeeder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-oci-feeder")
+	if err != nil {
+		t.Fatalf("error while creating test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	saltAPI := filepath.Join(dir, "salt-api.tar.xz")
+	writeDockerArchive(t, saltAPI, "opensuse/salt-api:13")
+	saltMaster := filepath.Join(dir, "salt-master.tar.xz")
+	writeDockerArchive(t, saltMaster, "opensuse/salt-master:13")
+
+	layout := filepath.Join(dir, "layout")
+	f, err := NewOCIFeeder(OCIConfig{Directory: layout})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, archive := range []string{saltAPI, saltMaster} {
+		if _, err := f.LoadImage(context.Background(), archive, dockerArchiveFormat); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := f.TagImage(context.Background(), "docker.io/opensuse/salt-api:13", []string{"docker.io/opensuse/salt-api:latest"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := f.TagImage(context.Background(), "docker.io/opensuse/velum:13", []string{"docker.io/opensuse/velum:latest"}); err == nil {
+		t.Error("error expected when tagging a missing image")
+	}
+
+	ids, err := f.Images(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	images := presentTags(ids)
+	expected := []string{
+		"docker.io/opensuse/salt-api:13",
+		"docker.io/opensuse/salt-api:latest",
+		"docker.io/opensuse/salt-master:13",
+	}
+	if len(images) != len(expected) {
+		t.Fatalf("unexpected images: %v", images)
+	}
+	for i := range expected {
+		if images[i] != expected[i] {
+			t.Errorf("unexpected images: %v", images)
+		}
+	}
+	if id := ids["docker.io/opensuse/salt-api:13"]; id.Config == "" || id.Manifest == "" || id != ids["docker.io/opensuse/salt-api:latest"] {
+		t.Errorf("unexpected image IDs: %v", ids)
+	}
+
+	// the layer is shared: one layer, two configs and two manifests
+	blobs, err := ioutil.ReadDir(filepath.Join(layout, "blobs", "sha256"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(blobs) != 5 {
+		t.Errorf("expected 5 blobs, got %d", len(blobs))
+	}
+
+	// the layer is still used by salt-api
+	if err := f.RemoveImage(context.Background(), "docker.io/opensuse/salt-master:13"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	blobs, err = ioutil.ReadDir(filepath.Join(layout, "blobs", "sha256"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(blobs) != 3 {
+		t.Errorf("expected 3 blobs, got %d", len(blobs))
+	}
+	if err := f.RemoveImage(context.Background(), "docker.io/opensuse/salt-master:13"); err == nil {
+		t.Error("error expected when removing a missing image")
+	}
+}
+
+func TestOCIFeederDirectory(t *testing.T) {
+	if _, err := NewOCIFeeder(OCIConfig{}); err == nil {
+		t.Error("error expected when the directory is missing")
+	}
+}
+
+// writeOCIArchive tars the OCI image layout stored at dir into file
+func writeOCIArchive(t *testing.T, dir, file string) {
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatalf("error creating archive: %v", err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	defer tw.Close()
+
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name, _ = filepath.Rel(dir, path)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		_, err = io.Copy(tw, in)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("error writing archive: %v", err)
+	}
+}
+
+func TestOCIFeederFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-oci-feeder")
+	if err != nil {
+		t.Fatalf("error while creating test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive := filepath.Join(dir, "salt-api.tar.xz")
+	writeDockerArchive(t, archive, "opensuse/salt-api:13")
+
+	// an OCI image layout shipping a single image
+	shipped := filepath.Join(dir, "shipped")
+	f, err := NewOCIFeeder(OCIConfig{Directory: shipped})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := f.LoadImage(context.Background(), archive, dockerArchiveFormat); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ociArchive := filepath.Join(dir, "salt-api-oci.tar")
+	writeOCIArchive(t, shipped, ociArchive)
+
+	for path, format := range map[string]string{shipped: ociLayoutFormat, ociArchive: ociArchiveFormat} {
+		f, err := NewOCIFeeder(OCIConfig{Directory: filepath.Join(dir, format)})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		image, err := f.LoadImage(context.Background(), path, format)
+		if err != nil {
+			t.Fatalf("unexpected error loading %s: %v", format, err)
+		}
+		if image != "docker.io/opensuse/salt-api:13" {
+			t.Errorf("unexpected image name loading %s: %s", format, image)
+		}
+	}
+}
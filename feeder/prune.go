@@ -0,0 +1,239 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package feeder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PruneConfig holds the prune settings of the container-feeder.json config
+type PruneConfig struct {
+	// the number of versions of every image kept once their RPM has been
+	// removed or upgraded, the most recently imported first (default: 0)
+	Retention int `json:"retention,omitempty"`
+}
+
+type PrunedImage struct {
+	Image  string
+	Target string
+}
+
+type FailedPruneError struct {
+	Image  string
+	Target string
+	Error  error
+}
+
+type FeederPruneResponse struct {
+	PrunedImages []PrunedImage
+	FailedPrunes []FailedPruneError
+}
+
+// Prune removes from every configured target the images container-feeder
+// imported in the past whose RPM is no longer installed in `dirs`, the
+// configured sources when empty. Images that were not imported by
+// container-feeder are never touched.
+func Prune(ctx context.Context, dirs []string) (FeederPruneResponse, error) {
+	res := FeederPruneResponse{}
+
+	config, err := loadConfig()
+	if err != nil {
+		return res, err
+	}
+	if config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(config.Timeout))
+		defer cancel()
+	}
+
+	f, err := newFeeder(ctx, config)
+	if err != nil {
+		return res, fmt.Errorf("Error creating new feeder: %v", err)
+	}
+
+	state, err := loadState(stateFile(f.config))
+	if err != nil {
+		return res, err
+	}
+	f.state = state
+
+	// the whitelist is ignored on purpose: images still shipped by an RPM
+	// are not stale
+	dirs = f.config.sourceDirs(dirs)
+	rpmImages, rpmImageTags, rpmMetadata, _, err := findRPMImages(dirs, f.state, f.config)
+	if err != nil {
+		return res, err
+	}
+	f.state.recordMetadataFiles(rpmMetadata)
+
+	res = f.pruneImages(ctx, f.state, dirs, rpmImages, rpmImageTags, rpmMetadata)
+	if err := f.state.save(stateFile(f.config)); err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+// staleRecords returns the records of the images that are no longer shipped
+// by an RPM, found in rpmMetadata by scanning dirs, and exceed the retention
+// count of their repository.
+func staleRecords(records []importRecord, dirs []string, rpmMetadata map[string]ImageType, config FeederConfig) []importRecord {
+	byName := make(map[string][]importRecord)
+	for _, record := range records {
+		if !removedImage(record, dirs, rpmMetadata, config) {
+			continue
+		}
+		name, _, err := normalizeNameTag(record.Image)
+		if err != nil {
+			log.Debugf("Ignoring imported image %s: %v", record.Image, err)
+			continue
+		}
+		byName[name] = append(byName[name], record)
+	}
+
+	stale := []importRecord{}
+	for _, versions := range byName {
+		sort.Slice(versions, func(i, j int) bool {
+			return versions[i].Imported.After(versions[j].Imported)
+		})
+		if len(versions) > config.Prune.Retention {
+			stale = append(stale, versions[config.Prune.Retention:]...)
+		}
+	}
+	sort.Slice(stale, func(i, j int) bool {
+		return stale[i].Image < stale[j].Image
+	})
+	return stale
+}
+
+// removedImage returns true if the RPM shipping the image of record has been
+// removed or upgraded: its .metadata file, stored inside of one of the
+// scanned dirs, is gone or names another image now. The images that are not
+// found because their files failed the verification are not removed.
+func removedImage(record importRecord, dirs []string, rpmMetadata map[string]ImageType, config FeederConfig) bool {
+	if _, ok := rpmMetadata[record.Image]; ok {
+		return false
+	}
+	if record.Metadata == "" {
+		log.Debugf("Not pruning %s: its .metadata file is unknown", record.Image)
+		return false
+	}
+	if !config.scanned(dirs, record.Metadata) {
+		return false
+	}
+	if _, err := os.Stat(record.Metadata); os.IsNotExist(err) {
+		return true
+	} else if err != nil {
+		log.Debugf("Not pruning %s: %v", record.Image, err)
+		return false
+	}
+	for _, metadata := range rpmMetadata {
+		if metadata.metadataFile == record.Metadata {
+			return true
+		}
+	}
+	log.Debugf("Not pruning %s: %s could not be verified", record.Image, record.Metadata)
+	return false
+}
+
+// pruneImages removes the stale images recorded in state from every target
+// and forgets them. The repotags still claimed by an RPM, like a "latest"
+// tag moved to the upgraded image, are left alone.
+func (f *Feeder) pruneImages(ctx context.Context, state *feederState, dirs []string, rpmImages map[string]string, rpmImageTags map[string][]string, rpmMetadata map[string]ImageType) FeederPruneResponse {
+	res := FeederPruneResponse{}
+
+	shipped := []string{}
+	for repotag := range rpmImages {
+		shipped = append(shipped, repotag)
+		shipped = append(shipped, rpmImageTags[repotag]...)
+	}
+
+	for _, t := range f.targets {
+		stale := staleRecords(state.Targets[t.name], dirs, rpmMetadata, f.config)
+		if len(stale) == 0 {
+			continue
+		}
+		present, err := f.presentImages(ctx, t)
+		if err != nil {
+			log.Warnf("Could not list the images of %s: %v", t.name, err)
+			for _, record := range stale {
+				res.FailedPrunes = append(res.FailedPrunes, FailedPruneError{
+					Image:  record.Image,
+					Target: t.name,
+					Error:  err,
+				})
+			}
+			continue
+		}
+
+		for _, record := range stale {
+			removed, err := f.pruneImage(ctx, t, record, present, shipped)
+			if err != nil {
+				log.Warnf("Could not prune image %s from %s: %v", record.Image, t.name, err)
+				res.FailedPrunes = append(res.FailedPrunes, FailedPruneError{
+					Image:  record.Image,
+					Target: t.name,
+					Error:  err,
+				})
+				continue
+			}
+			state.forget(t.name, record.Image)
+			if !removed {
+				continue
+			}
+			res.PrunedImages = append(res.PrunedImages, PrunedImage{
+				Image:  record.Image,
+				Target: t.name,
+			})
+		}
+	}
+
+	return res
+}
+
+// pruneImage removes the repotags of record that are present in target and
+// not shipped anymore, the name of the image last. The repotags pointing to
+// another image than the imported one, pulled or tagged again since, are
+// left alone. Returns false when no repotag has been removed.
+func (f *Feeder) pruneImage(ctx context.Context, t target, record importRecord, present map[string]ImageID, shipped []string) (bool, error) {
+	removed := false
+	repotags := append(append([]string{}, record.Tags...), record.Image)
+	for _, repotag := range repotags {
+		if _, ok := present[repotag]; !ok || stringInSlice(repotag, shipped) {
+			continue
+		}
+		if mismatch := contentMismatch(present, repotag, nil, record.ID); mismatch != "" {
+			log.Infof("Not pruning %s from %s: %s", repotag, t.name, mismatch)
+			continue
+		}
+		log.Debugf("Pruning %s from %s", repotag, t.name)
+		err := retry(ctx, f.config.Retry, t.name, "removing "+repotag, func() error {
+			return t.feeder.RemoveImage(ctx, repotag)
+		})
+		if err != nil {
+			return removed, err
+		}
+		removed = true
+	}
+	return removed, nil
+}
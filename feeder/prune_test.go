@@ -0,0 +1,186 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package feeder
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-state")
+	if err != nil {
+		t.Fatalf("error while creating test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "lib", "state.json")
+	state, err := loadState(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	state.recordImport("docker", "docker.io/opensuse/salt-api:12", "/images/salt-api.metadata", nil, time.Now())
+	state.recordImport("docker", "docker.io/opensuse/salt-api:12", "/images/salt-api.metadata", []string{"docker.io/opensuse/salt-api:latest"}, time.Now())
+	if err := state.save(path); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	state, err = loadState(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	records := state.Targets["docker"]
+	if len(records) != 1 || len(records[0].Tags) != 1 {
+		t.Errorf("unexpected records: %+v", records)
+	}
+}
+
+func TestPruneImages(t *testing.T) {
+	now := time.Now()
+	// the .metadata files of the previous versions are gone
+	state := &feederState{Targets: map[string][]importRecord{
+		"docker": {
+			{Image: "docker.io/opensuse/salt-api:11", Imported: now.Add(-2 * time.Hour), Metadata: "/images/salt-api-11.metadata"},
+			{Image: "docker.io/opensuse/salt-api:12", Tags: []string{"docker.io/opensuse/salt-api:latest"}, Imported: now.Add(-time.Hour), Metadata: "/images/salt-api-12.metadata"},
+			{Image: "docker.io/opensuse/salt-api:13", Tags: []string{"docker.io/opensuse/salt-api:latest"}, Imported: now, Metadata: "/images/salt-api-13.metadata"},
+		},
+	}}
+	dirs := []string{"/images"}
+	rpmImages := map[string]string{"docker.io/opensuse/salt-api:13": "/images/salt-api.tar.xz"}
+	rpmImageTags := map[string][]string{"docker.io/opensuse/salt-api:13": {"docker.io/opensuse/salt-api:latest"}}
+	rpmMetadata := map[string]ImageType{"docker.io/opensuse/salt-api:13": {metadataFile: "/images/salt-api-13.metadata"}}
+
+	docker := &fakeFeeder{images: []string{
+		"docker.io/library/busybox:latest",
+		"docker.io/opensuse/salt-api:11",
+		"docker.io/opensuse/salt-api:12",
+		"docker.io/opensuse/salt-api:13",
+		"docker.io/opensuse/salt-api:latest",
+	}}
+	f := &Feeder{
+		targets: []target{{name: "docker", feeder: docker}},
+		config:  FeederConfig{Prune: PruneConfig{Retention: 1}},
+	}
+
+	res := f.pruneImages(context.Background(), state, dirs, rpmImages, rpmImageTags, rpmMetadata)
+	if len(res.PrunedImages) != 1 || res.PrunedImages[0].Image != "docker.io/opensuse/salt-api:11" {
+		t.Errorf("unexpected pruned images: %+v", res)
+	}
+
+	f.config.Prune.Retention = 0
+	res = f.pruneImages(context.Background(), state, dirs, rpmImages, rpmImageTags, rpmMetadata)
+	if len(res.PrunedImages) != 1 || res.PrunedImages[0].Image != "docker.io/opensuse/salt-api:12" {
+		t.Errorf("unexpected pruned images: %+v", res)
+	}
+
+	// images fed by someone else and the tags still shipped are kept
+	sort.Strings(docker.images)
+	expected := []string{
+		"docker.io/library/busybox:latest",
+		"docker.io/opensuse/salt-api:13",
+		"docker.io/opensuse/salt-api:latest",
+	}
+	if len(docker.images) != len(expected) {
+		t.Fatalf("unexpected images: %v", docker.images)
+	}
+	for i := range expected {
+		if docker.images[i] != expected[i] {
+			t.Errorf("unexpected images: %v", docker.images)
+		}
+	}
+	if len(state.Targets["docker"]) != 1 {
+		t.Errorf("pruned images not forgotten: %+v", state.Targets["docker"])
+	}
+}
+
+func TestPruneRetaggedImages(t *testing.T) {
+	imported := ImageID{Config: "sha256:aaaa"}
+	state := &feederState{Targets: map[string][]importRecord{
+		"docker": {
+			{Image: "docker.io/opensuse/salt-api:12", Tags: []string{"docker.io/opensuse/salt-api:stable"}, ID: imported, Metadata: "/images/salt-api.metadata"},
+		},
+	}}
+
+	// the image has been pulled again by an operator, its tag still points
+	// to the imported image
+	docker := &fakeFeeder{
+		images: []string{"docker.io/opensuse/salt-api:12", "docker.io/opensuse/salt-api:stable"},
+		ids: map[string]ImageID{
+			"docker.io/opensuse/salt-api:12":     {Config: "sha256:bbbb"},
+			"docker.io/opensuse/salt-api:stable": imported,
+		},
+	}
+	f := &Feeder{targets: []target{{name: "docker", feeder: docker}}}
+
+	res := f.pruneImages(context.Background(), state, []string{"/images"}, map[string]string{}, map[string][]string{}, map[string]ImageType{})
+	if len(res.PrunedImages) != 1 || len(res.FailedPrunes) != 0 {
+		t.Errorf("unexpected prune: %+v", res)
+	}
+	if len(docker.images) != 1 || docker.images[0] != "docker.io/opensuse/salt-api:12" {
+		t.Errorf("unexpected images: %v", docker.images)
+	}
+	if len(state.Targets["docker"]) != 0 {
+		t.Errorf("pruned image not forgotten: %+v", state.Targets["docker"])
+	}
+}
+
+func TestRemovedImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-prune")
+	if err != nil {
+		t.Fatalf("error while creating test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"unverified.metadata", "upgraded.metadata"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("{}"), 0644); err != nil {
+			t.Fatalf("error writing metadata: %v", err)
+		}
+	}
+	rpmMetadata := map[string]ImageType{
+		"docker.io/opensuse/salt-api:13": {metadataFile: filepath.Join(dir, "upgraded.metadata")},
+	}
+
+	for _, test := range []struct {
+		record  importRecord
+		dirs    []string
+		removed bool
+	}{
+		// the .metadata file is gone
+		{importRecord{Image: "docker.io/opensuse/salt-api:11", Metadata: filepath.Join(dir, "removed.metadata")}, []string{dir}, true},
+		// the .metadata file names the upgraded image
+		{importRecord{Image: "docker.io/opensuse/salt-api:12", Metadata: filepath.Join(dir, "upgraded.metadata")}, []string{dir}, true},
+		// the .metadata file failed the verification
+		{importRecord{Image: "docker.io/opensuse/salt-api:12", Metadata: filepath.Join(dir, "unverified.metadata")}, []string{dir}, false},
+		// the .metadata file is outside of the scanned directories
+		{importRecord{Image: "docker.io/opensuse/salt-api:11", Metadata: filepath.Join(dir, "removed.metadata")}, []string{"/srv/images"}, false},
+		{importRecord{Image: "docker.io/opensuse/salt-api:11", Metadata: filepath.Join(dir, "sub", "removed.metadata")}, []string{dir}, false},
+		// the .metadata file is unknown
+		{importRecord{Image: "docker.io/opensuse/salt-api:11"}, []string{dir}, false},
+		// the image is still shipped
+		{importRecord{Image: "docker.io/opensuse/salt-api:13", Metadata: filepath.Join(dir, "removed.metadata")}, []string{dir}, false},
+	} {
+		if removed := removedImage(test.record, test.dirs, rpmMetadata, FeederConfig{}); removed != test.removed {
+			t.Errorf("%+v in %v: expected removed to be %v", test.record, test.dirs, test.removed)
+		}
+	}
+}
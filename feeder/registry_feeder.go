@@ -0,0 +1,345 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package feeder
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/containers/image/docker"
+	"github.com/containers/image/docker/reference"
+	"github.com/containers/image/manifest"
+	"github.com/containers/image/pkg/tlsclientconfig"
+	"github.com/containers/image/types"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RegistryConfig holds the registry specific settings of the
+// container-feeder.json config
+type RegistryConfig struct {
+	// URL of the registry, eg: "https://registry.local:5000". Plain HTTP is
+	// used when the scheme is "http"
+	URL string `json:"url"`
+	// skip the verification of the TLS certificate of the registry
+	Insecure bool `json:"insecure,omitempty"`
+	// directory holding the CA certificates (*.crt) of the registry and,
+	// optionally, a client certificate (*.cert) and key (*.key)
+	CertDir  string `json:"cert-dir,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// RegistryFeeder pushes images into a Docker registry.
+type RegistryFeeder struct {
+	scheme string
+	host   string
+	sys    *types.SystemContext
+	client *http.Client
+	config RegistryConfig
+}
+
+// NewRegistryFeeder returns a pointer to an initialized RegistryFeeder.
+// Takes care of checking that the registry is reachable.
+func NewRegistryFeeder(ctx context.Context, config RegistryConfig) (*RegistryFeeder, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("no registry url configured")
+	}
+	rawURL := config.URL
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "https://" + rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing registry url '%s': %v", config.URL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported registry url scheme '%s'", u.Scheme)
+	}
+	if u.Host == "" || strings.Trim(u.Path, "/") != "" {
+		return nil, fmt.Errorf("registry url '%s' must be in the form <scheme>://<host>[:<port>]", config.URL)
+	}
+
+	feeder := &RegistryFeeder{
+		scheme: u.Scheme,
+		host:   u.Host,
+		config: config,
+		sys: &types.SystemContext{
+			DockerCertPath: config.CertDir,
+			// containers/image falls back to plain HTTP only when the
+			// verification of the certificates is disabled
+			DockerInsecureSkipTLSVerify: config.Insecure || u.Scheme == "http",
+			DockerDisableV1Ping:         true,
+		},
+	}
+	if config.Username != "" {
+		feeder.sys.DockerAuthConfig = &types.DockerAuthConfig{
+			Username: config.Username,
+			Password: config.Password,
+		}
+	}
+
+	transport := tlsclientconfig.NewTransport()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: config.Insecure}
+	if config.CertDir != "" {
+		if err := tlsclientconfig.SetupCertificates(config.CertDir, transport.TLSClientConfig); err != nil {
+			return nil, fmt.Errorf("error loading certificates from %s: %v", config.CertDir, err)
+		}
+	}
+	feeder.client = &http.Client{Transport: transport}
+
+	if err := feeder.get(ctx, "/v2/", nil); err != nil {
+		return nil, fmt.Errorf("error connecting to registry %s: %v", config.URL, err)
+	}
+
+	return feeder, nil
+}
+
+// get requests path from the registry and decodes the JSON response into v,
+// unless v is nil.
+func (f *RegistryFeeder) get(ctx context.Context, path string, v interface{}) error {
+	_, err := f.getPage(ctx, path, v)
+	return err
+}
+
+// getPage works like get and returns the path of the next page of results,
+// if any.
+func (f *RegistryFeeder) getPage(ctx context.Context, path string, v interface{}) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, f.scheme+"://"+f.host+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	if f.config.Username != "" {
+		req.SetBasicAuth(f.config.Username, f.config.Password)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			return "", fmt.Errorf("error decoding response of GET %s: %v", path, err)
+		}
+	}
+
+	// Link: </v2/_catalog?last=foo&n=100>; rel="next"
+	next := ""
+	if link := resp.Header.Get("Link"); strings.Contains(link, `rel="next"`) {
+		start, end := strings.Index(link, "<"), strings.Index(link, ">")
+		if start >= 0 && end > start {
+			next = link[start+1 : end]
+		}
+	}
+	return next, nil
+}
+
+// reference returns the reference of repotag inside of the registry. The
+// repository is named after the familiar name of the image, eg:
+// "docker.io/opensuse/salt-api:13" is pushed as "<host>/opensuse/salt-api:13".
+func (f *RegistryFeeder) reference(repotag string) (types.ImageReference, error) {
+	named, err := reference.ParseNormalizedNamed(repotag)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing image name '%s': %v", repotag, err)
+	}
+	return docker.ParseReference("//" + f.host + "/" + reference.FamiliarString(reference.TagNameOnly(named)))
+}
+
+// manifestID returns the digests of the manifest reference, a tag or a
+// digest, points to in repository and of its config.
+func (f *RegistryFeeder) manifestID(ctx context.Context, repository, reference string) (ImageID, error) {
+	path := "/v2/" + repository + "/manifests/" + reference
+	req, err := http.NewRequest(http.MethodGet, f.scheme+"://"+f.host+path, nil)
+	if err != nil {
+		return ImageID{}, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", strings.Join([]string{manifest.DockerV2Schema2MediaType, imgspecv1.MediaTypeImageManifest}, ", "))
+	if f.config.Username != "" {
+		req.SetBasicAuth(f.config.Username, f.config.Password)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return ImageID{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ImageID{}, fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+
+	var m struct {
+		Config struct {
+			Digest string `json:"digest"`
+		} `json:"config"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return ImageID{}, fmt.Errorf("error decoding response of GET %s: %v", path, err)
+	}
+	return ImageID{
+		Config:   m.Config.Digest,
+		Manifest: resp.Header.Get("Docker-Content-Digest"),
+	}, nil
+}
+
+// Images returns the images stored inside of the registry in the form
+// "<repo>:<tag>" with the digests of their manifest and config.
+func (f *RegistryFeeder) Images(ctx context.Context) (map[string]ImageID, error) {
+	tags := make(map[string]ImageID)
+
+	repositories := []string{}
+	page := "/v2/_catalog?n=100"
+	for page != "" {
+		var catalog struct {
+			Repositories []string `json:"repositories"`
+		}
+		next, err := f.getPage(ctx, page, &catalog)
+		if err != nil {
+			return nil, fmt.Errorf("error listing registry repositories: %v", err)
+		}
+		repositories = append(repositories, catalog.Repositories...)
+		page = next
+	}
+
+	for _, repository := range repositories {
+		var list struct {
+			Tags []string `json:"tags"`
+		}
+		if err := f.get(ctx, "/v2/"+repository+"/tags/list", &list); err != nil {
+			log.Debugf("Could not list tags of %s: %v", repository, err)
+			continue
+		}
+		for _, tag := range list.Tags {
+			normalizedName, normalizedTag, err := normalizeNameTag(repository + ":" + tag)
+			if err != nil {
+				return nil, err
+			}
+			// the content of the tag is unknown when the manifest cannot
+			// be parsed, eg: schema 1 manifests have no config
+			id, err := f.manifestID(ctx, repository, tag)
+			if err != nil {
+				log.Debugf("Could not get the manifest of %s:%s: %v", repository, tag, err)
+			}
+			tags[normalizedName+":"+normalizedTag] = id
+		}
+	}
+
+	return tags, nil
+}
+
+// LoadImage pushes the specified image into the registry, using the repotag
+// stored inside of the image. Returns the image name.
+func (f *RegistryFeeder) LoadImage(ctx context.Context, path, format string) (string, error) {
+	src, repotags, closeSrc, err := openImage(ctx, path, format)
+	if err != nil {
+		return "", err
+	}
+	defer closeSrc()
+
+	if len(repotags) == 0 {
+		return "", fmt.Errorf("image %s is not named", path)
+	}
+	normalizedName, normalizedTag, err := normalizeNameTag(repotags[0])
+	if err != nil {
+		return "", err
+	}
+	imgName := normalizedName + ":" + normalizedTag
+
+	dest, err := f.reference(imgName)
+	if err != nil {
+		return "", err
+	}
+	if err := copyImage(ctx, dest, src, f.sys, nil); err != nil {
+		return "", fmt.Errorf("error pushing image: %v", err)
+	}
+
+	log.Debugf("Loaded image: %v", imgName)
+	return imgName, nil
+}
+
+// TagImage tags the specified image with the supplied tags by pushing its
+// manifest again under every tag.
+func (f *RegistryFeeder) TagImage(ctx context.Context, image string, tags []string) error {
+	src, err := f.reference(image)
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		log.Debug("Tagging image: ", image, " with ", tag)
+		dest, err := f.reference(tag)
+		if err != nil {
+			return err
+		}
+		if err := copyImage(ctx, dest, src, f.sys, nil); err != nil {
+			return fmt.Errorf("error tagging image: %v", err)
+		}
+	}
+	return nil
+}
+
+// RemoveImage deletes the manifest the specified image points to. The
+// registry must allow deletions; every tag pointing to the same manifest is
+// removed too.
+func (f *RegistryFeeder) RemoveImage(ctx context.Context, image string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ref, err := f.reference(image)
+	if err != nil {
+		return err
+	}
+	log.Debug("Removing image: ", image)
+	if err := ref.DeleteImage(f.sys); err != nil {
+		return fmt.Errorf("error removing image: %v", err)
+	}
+	return nil
+}
+
+// removesManifests marks RegistryFeeder as a manifestRemover: the registry
+// cannot untag an image, the failed imports are not rolled back
+func (f *RegistryFeeder) removesManifests() {}
+
+// the messages of the errors returned while the registry is starting or
+// overloaded
+var transientRegistryErrors = []string{
+	"connection refused",
+	"connection reset by peer",
+	"i/o timeout",
+	"TLS handshake timeout",
+	"429 Too Many Requests",
+	"502 Bad Gateway",
+	"503 Service Unavailable",
+	"504 Gateway Timeout",
+}
+
+// isTransientRegistryError returns true if err is worth retrying
+func isTransientRegistryError(err error) bool {
+	return errorContainsAny(err, transientRegistryErrors)
+}
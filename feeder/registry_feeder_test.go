@@ -0,0 +1,248 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package feeder
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/ulikunitz/xz"
+)
+
+// writeDockerArchive writes a xz compressed docker-archive holding a single
+// layer image named repotag. The layer is the same for every archive.
+func writeDockerArchive(t *testing.T, file, repotag string) {
+	var layer bytes.Buffer
+	lw := tar.NewWriter(&layer)
+	content := []byte("hello")
+	lw.WriteHeader(&tar.Header{Name: "hello", Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+	lw.Write(content)
+	lw.Close()
+
+	config := fmt.Sprintf(`{"architecture":"amd64","os":"linux","config":{"Labels":{"name":"%s"}},"rootfs":{"type":"layers","diff_ids":["%s"]}}`,
+		repotag, digest.FromBytes(layer.Bytes()))
+	tarManifest := fmt.Sprintf(`[{"Config":"config.json","RepoTags":["%s"],"Layers":["layer.tar"]}]`, repotag)
+
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatalf("error creating archive: %v", err)
+	}
+	defer f.Close()
+	xw, err := xz.NewWriter(f)
+	if err != nil {
+		t.Fatalf("error creating xz writer: %v", err)
+	}
+	defer xw.Close()
+	tw := tar.NewWriter(xw)
+	defer tw.Close()
+
+	for _, entry := range []struct {
+		name string
+		data []byte
+	}{
+		{"config.json", []byte(config)},
+		{"layer.tar", layer.Bytes()},
+		{"manifest.json", []byte(tarManifest)},
+	} {
+		hdr := &tar.Header{Name: entry.name, Mode: 0644, Size: int64(len(entry.data)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("error writing archive: %v", err)
+		}
+		if _, err := tw.Write(entry.data); err != nil {
+			t.Fatalf("error writing archive: %v", err)
+		}
+	}
+}
+
+// standInRegistry is a minimal in-memory Docker Registry v2 accepting
+// pushes, protected by basic auth.
+type standInRegistry struct {
+	sync.Mutex
+	username, password string
+	blobs              map[string][]byte
+	uploads            map[string][]byte
+	manifests          map[string]map[string][]byte
+}
+
+func newStandInRegistry() *standInRegistry {
+	return &standInRegistry{
+		username:  "feeder",
+		password:  "secret",
+		blobs:     make(map[string][]byte),
+		uploads:   make(map[string][]byte),
+		manifests: make(map[string]map[string][]byte),
+	}
+}
+
+func (s *standInRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	if user, pass, ok := r.BasicAuth(); !ok || user != s.username || pass != s.password {
+		w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	path := r.URL.Path
+	switch {
+	case path == "/v2/":
+		w.WriteHeader(http.StatusOK)
+	case path == "/v2/_catalog":
+		repositories := []string{}
+		for name := range s.manifests {
+			repositories = append(repositories, name)
+		}
+		sort.Strings(repositories)
+		json.NewEncoder(w).Encode(map[string][]string{"repositories": repositories})
+	case strings.HasSuffix(path, "/tags/list"):
+		name := strings.TrimSuffix(strings.TrimPrefix(path, "/v2/"), "/tags/list")
+		tags := []string{}
+		for ref := range s.manifests[name] {
+			if !strings.HasPrefix(ref, "sha256:") {
+				tags = append(tags, ref)
+			}
+		}
+		sort.Strings(tags)
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": name, "tags": tags})
+	case strings.Contains(path, "/manifests/"):
+		parts := strings.SplitN(strings.TrimPrefix(path, "/v2/"), "/manifests/", 2)
+		name, ref := parts[0], parts[1]
+		if r.Method == http.MethodPut {
+			data, _ := ioutil.ReadAll(r.Body)
+			if s.manifests[name] == nil {
+				s.manifests[name] = make(map[string][]byte)
+			}
+			s.manifests[name][ref] = data
+			s.manifests[name][digest.FromBytes(data).String()] = data
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		data, ok := s.manifests[name][ref]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var m struct {
+			MediaType string `json:"mediaType"`
+		}
+		json.Unmarshal(data, &m)
+		w.Header().Set("Content-Type", m.MediaType)
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(data).String())
+		w.Write(data)
+	case strings.Contains(path, "/blobs/uploads/"):
+		id := path[strings.LastIndex(path, "/")+1:]
+		switch r.Method {
+		case http.MethodPost:
+			id = fmt.Sprintf("upload-%d", len(s.uploads))
+			s.uploads[id] = []byte{}
+			w.Header().Set("Location", path+id)
+			w.WriteHeader(http.StatusAccepted)
+		case http.MethodPatch:
+			data, _ := ioutil.ReadAll(r.Body)
+			s.uploads[id] = append(s.uploads[id], data...)
+			w.Header().Set("Location", path)
+			w.WriteHeader(http.StatusAccepted)
+		case http.MethodPut:
+			data, _ := ioutil.ReadAll(r.Body)
+			s.blobs[r.URL.Query().Get("digest")] = append(s.uploads[id], data...)
+			delete(s.uploads, id)
+			w.WriteHeader(http.StatusCreated)
+		}
+	case strings.Contains(path, "/blobs/"):
+		data, ok := s.blobs[path[strings.LastIndex(path, "/")+1:]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestRegistryFeeder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-registry-feeder")
+	if err != nil {
+		t.Fatalf("error while creating test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive := filepath.Join(dir, "salt-api.tar.xz")
+	writeDockerArchive(t, archive, "opensuse/salt-api:13")
+
+	ts := httptest.NewServer(newStandInRegistry())
+	defer ts.Close()
+
+	if _, err := NewRegistryFeeder(context.Background(), RegistryConfig{URL: ts.URL}); err == nil {
+		t.Error("error expected when credentials are missing")
+	}
+
+	f, err := NewRegistryFeeder(context.Background(), RegistryConfig{URL: ts.URL, Username: "feeder", Password: "secret"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	image, err := f.LoadImage(context.Background(), archive, dockerArchiveFormat)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if image != "docker.io/opensuse/salt-api:13" {
+		t.Errorf("unexpected image name: %s", image)
+	}
+
+	if err := f.TagImage(context.Background(), image, []string{"docker.io/opensuse/salt-api:latest"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ids, err := f.Images(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	images := presentTags(ids)
+	if len(images) != 2 || images[0] != "docker.io/opensuse/salt-api:13" || images[1] != "docker.io/opensuse/salt-api:latest" {
+		t.Errorf("unexpected images: %v", images)
+	}
+	if id := ids["docker.io/opensuse/salt-api:13"]; id.Config == "" || id.Manifest == "" || id != ids["docker.io/opensuse/salt-api:latest"] {
+		t.Errorf("unexpected image IDs: %v", ids)
+	}
+}
+
+func TestRegistryFeederURL(t *testing.T) {
+	for _, url := range []string{"ftp://registry.local", "https://registry.local/v2/", ""} {
+		if _, err := NewRegistryFeeder(context.Background(), RegistryConfig{URL: url}); err == nil {
+			t.Errorf("error expected for url '%s'", url)
+		}
+	}
+}
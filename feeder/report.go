@@ -0,0 +1,213 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package feeder
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The categories of the errors failing an import
+const (
+	// the import has been interrupted
+	CategoryInterrupted = "interrupted"
+	// the import took longer than the configured timeouts
+	CategoryTimeout = "timeout"
+	// the container engine could not be reached or kept failing
+	CategoryEngine = "engine"
+	// the format of the image is not supported by the target
+	CategoryUnsupportedFormat = "unsupported-format"
+	// the image file does not match the checksum of its metadata
+	CategoryChecksum = "checksum"
+	// the root filesystem could not be converted into an image
+	CategoryConversion = "conversion"
+	// the image has been refused by the signature policy
+	CategorySignature = "signature"
+	// the image claims a repotag claimed by other images too
+	CategoryConflict = "conflict"
+	// the image has been rejected by the container engine
+	CategoryImage = "image"
+)
+
+// The outcomes of an import
+const (
+	// all the missing images have been imported
+	ResultSuccess = "success"
+	// some of the images could not be imported
+	ResultPartialFailure = "partial-failure"
+	// none of the images could be imported
+	ResultFailure = "failure"
+	// all the images were already in place
+	ResultNothingToDo = "nothing-to-do"
+)
+
+// The actions taken for an image
+const (
+	ActionImported = "imported"
+	ActionFailed   = "failed"
+	ActionUpToDate = "up-to-date"
+)
+
+// ImageReport is the outcome of the import of an image into a target
+type ImageReport struct {
+	Image   string   `json:"image"`
+	Tags    []string `json:"tags"`
+	File    string   `json:"file,omitempty"`
+	Package string   `json:"package,omitempty"`
+	Target  string   `json:"target"`
+	Action  string   `json:"action"`
+	// the time spent importing the image, in seconds
+	Duration float64 `json:"duration"`
+	// the size of the image file
+	Bytes         int64  `json:"bytes"`
+	Error         string `json:"error,omitempty"`
+	ErrorCategory string `json:"error-category,omitempty"`
+}
+
+// ImportReport is the machine readable outcome of Import
+type ImportReport struct {
+	Result string        `json:"result"`
+	Error  string        `json:"error,omitempty"`
+	Images []ImageReport `json:"images"`
+}
+
+// errorCategory returns the category of err, failing an import into the
+// named target while ctx was running
+func errorCategory(ctx context.Context, target string, err error) string {
+	switch {
+	case ctx.Err() == context.Canceled:
+		return CategoryInterrupted
+	case ctx.Err() == context.DeadlineExceeded || strings.Contains(err.Error(), context.DeadlineExceeded.Error()):
+		return CategoryTimeout
+	}
+	if _, ok := err.(formatError); ok {
+		return CategoryUnsupportedFormat
+	}
+	if _, ok := err.(signatureError); ok {
+		return CategorySignature
+	}
+	if _, ok := err.(checksumError); ok {
+		return CategoryChecksum
+	}
+	if isTransientError(target, err) {
+		return CategoryEngine
+	}
+	return CategoryImage
+}
+
+// rpmImages describes the RPMs images for the report of the import
+func (f *Feeder) rpmImages(rpmImages map[string]string, rpmImageTags map[string][]string, rpmMetadata map[string]ImageType) map[string]RPMImage {
+	images := make(map[string]RPMImage)
+	for repotag, file := range rpmImages {
+		image := RPMImage{
+			Tags:  rpmImageTags[repotag],
+			File:  file,
+			Bytes: diskUsage(file),
+		}
+		if record := f.state.fileRecord(rpmMetadata[repotag]); record != nil {
+			image.Package = record.NEVRA
+		}
+		images[repotag] = image
+	}
+	return images
+}
+
+// diskUsage returns the size of the file, or of all the files inside of the
+// directory, stored at path
+func diskUsage(path string) int64 {
+	var size int64
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		log.Debugf("Could not compute the size of %s: %v", path, err)
+	}
+	return size
+}
+
+// Result returns the outcome of the import described by res
+func (res FeederLoadResponse) Result() string {
+	switch {
+	case len(res.FailedImports) == 0 && len(res.SuccessfulImports) == 0:
+		return ResultNothingToDo
+	case len(res.FailedImports) == 0:
+		return ResultSuccess
+	case len(res.SuccessfulImports) == 0:
+		return ResultFailure
+	}
+	return ResultPartialFailure
+}
+
+// NewImportReport returns the report of the import described by res, which
+// failed altogether when err is not nil
+func NewImportReport(res FeederLoadResponse, err error) ImportReport {
+	report := ImportReport{Result: res.Result(), Images: []ImageReport{}}
+	if err != nil {
+		report.Result = ResultFailure
+		report.Error = err.Error()
+	}
+
+	newImageReport := func(image, target, action string) ImageReport {
+		rpmImage := res.Images[image]
+		tags := rpmImage.Tags
+		if tags == nil {
+			tags = []string{}
+		}
+		return ImageReport{
+			Image:   image,
+			Tags:    tags,
+			File:    rpmImage.File,
+			Package: rpmImage.Package,
+			Target:  target,
+			Action:  action,
+			Bytes:   rpmImage.Bytes,
+		}
+	}
+	for _, imported := range res.SuccessfulImports {
+		image := newImageReport(imported.Image, imported.Target, ActionImported)
+		image.Duration = imported.Duration.Seconds()
+		report.Images = append(report.Images, image)
+	}
+	for _, failed := range res.FailedImports {
+		image := newImageReport(failed.Image, failed.Target, ActionFailed)
+		image.Duration = failed.Duration.Seconds()
+		image.Error = failed.Error.Error()
+		image.ErrorCategory = failed.Category
+		report.Images = append(report.Images, image)
+	}
+	for _, upToDate := range res.UpToDateImages {
+		report.Images = append(report.Images, newImageReport(upToDate.Image, upToDate.Target, ActionUpToDate))
+	}
+
+	sort.SliceStable(report.Images, func(i, j int) bool {
+		a, b := report.Images[i], report.Images[j]
+		return a.Target < b.Target || (a.Target == b.Target && a.Image < b.Image)
+	})
+	return report
+}
@@ -0,0 +1,94 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package feeder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestErrorCategory(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		ctx      context.Context
+		target   string
+		err      error
+		expected string
+	}{
+		{canceled, "docker", errors.New("aborted"), CategoryInterrupted},
+		{context.Background(), "docker", fmt.Errorf("error loading image: %v", context.DeadlineExceeded), CategoryTimeout},
+		{context.Background(), "docker", unsupportedFormatError("docker", ociLayoutFormat), CategoryUnsupportedFormat},
+		{context.Background(), "crio", errors.New("error creating layer: database is locked"), CategoryEngine},
+		{context.Background(), "docker", errors.New("invalid tar header"), CategoryImage},
+	}
+	for _, test := range tests {
+		if category := errorCategory(test.ctx, test.target, test.err); category != test.expected {
+			t.Errorf("%v: expected %s, got %s", test.err, test.expected, category)
+		}
+	}
+}
+
+func TestImportReport(t *testing.T) {
+	res := FeederLoadResponse{}
+	if res.Result() != ResultNothingToDo {
+		t.Errorf("unexpected result: %s", res.Result())
+	}
+
+	res = FeederLoadResponse{
+		SuccessfulImports: []SuccessfulImport{
+			{Image: "docker.io/opensuse/salt-api:13", Target: "docker", Duration: 2 * time.Second},
+		},
+		FailedImports: []FailedImportError{
+			{Image: "docker.io/opensuse/salt-api:13", Target: "crio", Error: errors.New("invalid tar header"), Category: CategoryImage},
+		},
+		UpToDateImages: []UpToDateImage{
+			{Image: "docker.io/opensuse/salt-master:13", Target: "docker"},
+		},
+		Images: map[string]RPMImage{
+			"docker.io/opensuse/salt-api:13": {
+				Tags:    []string{"docker.io/opensuse/salt-api:latest"},
+				File:    "/salt-api.tar.xz",
+				Package: "salt-api-0:13-1.1.x86_64",
+				Bytes:   1024,
+			},
+		},
+	}
+	report := NewImportReport(res, nil)
+	if report.Result != ResultPartialFailure || len(report.Images) != 3 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	failed, imported, upToDate := report.Images[0], report.Images[1], report.Images[2]
+	if failed.Target != "crio" || failed.Action != ActionFailed || failed.ErrorCategory != CategoryImage || failed.Package != "salt-api-0:13-1.1.x86_64" {
+		t.Errorf("unexpected failed image: %+v", failed)
+	}
+	if imported.Action != ActionImported || imported.Duration != 2 || imported.Bytes != 1024 || len(imported.Tags) != 1 {
+		t.Errorf("unexpected imported image: %+v", imported)
+	}
+	if upToDate.Action != ActionUpToDate || upToDate.Image != "docker.io/opensuse/salt-master:13" {
+		t.Errorf("unexpected up to date image: %+v", upToDate)
+	}
+
+	if report := NewImportReport(FeederLoadResponse{}, errors.New("no config")); report.Result != ResultFailure || report.Error != "no config" {
+		t.Errorf("unexpected report: %+v", report)
+	}
+}
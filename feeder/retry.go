@@ -0,0 +1,173 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package feeder
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultRetryAttempts      = 5
+	defaultRetryDelay         = Duration(time.Second)
+	defaultRetryMaxDelay      = Duration(30 * time.Second)
+	defaultRetryEngineTimeout = Duration(2 * time.Minute)
+)
+
+// RetryConfig holds the retry settings of the container-feeder.json config
+type RetryConfig struct {
+	// the number of attempts of an operation failing with a transient
+	// error, 1 disables the retries (default: 5)
+	Attempts int `json:"attempts,omitempty"`
+	// the delay before the first retry, doubled after every attempt
+	// (default: 1s)
+	Delay Duration `json:"delay,omitempty"`
+	// the maximum delay between two attempts (default: 30s)
+	MaxDelay Duration `json:"max-delay,omitempty"`
+	// the time allowed to the engine to become reachable (default: 2m)
+	EngineTimeout Duration `json:"engine-timeout,omitempty"`
+}
+
+// withDefaults returns c with the unset settings replaced by their default
+func (c RetryConfig) withDefaults() RetryConfig {
+	if c.Attempts < 1 {
+		c.Attempts = defaultRetryAttempts
+	}
+	if c.Delay <= 0 {
+		c.Delay = defaultRetryDelay
+	}
+	if c.MaxDelay <= 0 {
+		c.MaxDelay = defaultRetryMaxDelay
+	}
+	if c.MaxDelay < c.Delay {
+		c.MaxDelay = c.Delay
+	}
+	if c.EngineTimeout <= 0 {
+		c.EngineTimeout = defaultRetryEngineTimeout
+	}
+	return c
+}
+
+// backoff returns the delay to wait for after the failed attempt number
+// attempt, starting from 0
+func (c RetryConfig) backoff(attempt int) time.Duration {
+	delay := time.Duration(c.Delay)
+	for i := 0; i < attempt && delay < time.Duration(c.MaxDelay); i++ {
+		delay *= 2
+	}
+	if delay > time.Duration(c.MaxDelay) {
+		delay = time.Duration(c.MaxDelay)
+	}
+	return delay
+}
+
+// sleep waits for d, returning early with an error once ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// errorContainsAny returns true if the message of err contains one of
+// patterns
+func errorContainsAny(err error, patterns []string) bool {
+	msg := err.Error()
+	for _, p := range patterns {
+		if strings.Contains(msg, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTransientError returns true if err, returned by the feeder of the named
+// target, is worth retrying: the engine is not ready yet, busy or the
+// storage is locked by someone else
+func isTransientError(name string, err error) bool {
+	if err == nil || err == context.Canceled || err == context.DeadlineExceeded {
+		return false
+	}
+	switch name {
+	case "docker":
+		return isTransientDockerError(err)
+	case "crio":
+		return isTransientCRIOError(err)
+	case "containerd":
+		return isTransientContainerdError(err)
+	case "registry":
+		return isTransientRegistryError(err)
+	default:
+		return false
+	}
+}
+
+// retry runs fn until it succeeds, fails with a permanent error or the
+// attempts configured in config are exhausted, waiting longer after every
+// failure. what describes the operation in the logs.
+func retry(ctx context.Context, config RetryConfig, name, what string, fn func() error) error {
+	config = config.withDefaults()
+
+	var err error
+	for attempt := 0; attempt < config.Attempts; attempt++ {
+		if attempt > 0 {
+			delay := config.backoff(attempt - 1)
+			log.Warnf("Transient error %s in %s, retrying in %v: %v", what, name, delay, err)
+			if err := sleep(ctx, delay); err != nil {
+				return err
+			}
+		}
+		err = fn()
+		if err == nil || !isTransientError(name, err) {
+			return err
+		}
+	}
+	return err
+}
+
+// waitForEngine calls connect until the engine of the named target is
+// reachable, connect fails with a permanent error or the engine timeout in
+// config expires.
+func waitForEngine(ctx context.Context, config RetryConfig, name string, connect func() (FeederIface, error)) (FeederIface, error) {
+	config = config.withDefaults()
+	deadline := time.Now().Add(time.Duration(config.EngineTimeout))
+
+	for attempt := 0; ; attempt++ {
+		feeder, err := connect()
+		if err == nil || !isTransientError(name, err) {
+			return feeder, err
+		}
+
+		delay := config.backoff(attempt)
+		if time.Now().Add(delay).After(deadline) {
+			return nil, fmt.Errorf("%s did not become reachable within %v: %v", name, time.Duration(config.EngineTimeout), err)
+		}
+		log.Infof("Waiting for %s to become reachable, retrying in %v: %v", name, delay, err)
+		if err := sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
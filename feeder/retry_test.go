@@ -0,0 +1,136 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package feeder
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+func TestTransientErrors(t *testing.T) {
+	tests := []struct {
+		target    string
+		err       error
+		transient bool
+	}{
+		{"docker", client.ErrorConnectionFailed("unix:///var/run/docker.sock"), true},
+		{"docker", fmt.Errorf("exit status 1: Cannot connect to the Docker daemon at unix:///var/run/docker.sock. Is the docker daemon running?"), true},
+		{"docker", fmt.Errorf("Error response from daemon: invalid reference format"), false},
+		{"containerd", fmt.Errorf(`exit status 1: ctr: failed to dial "/run/containerd/containerd.sock": context deadline exceeded`), true},
+		{"containerd", fmt.Errorf("exit status 1: ctr: image \"foo\": not found"), false},
+		{"crio", fmt.Errorf("error loading image: database is locked"), true},
+		{"registry", fmt.Errorf("GET /v2/: 503 Service Unavailable"), true},
+		{"registry", fmt.Errorf("GET /v2/: 401 Unauthorized"), false},
+		{"oci", fmt.Errorf("connection refused"), false},
+		{"docker", context.Canceled, false},
+	}
+
+	for _, test := range tests {
+		if isTransientError(test.target, test.err) != test.transient {
+			t.Errorf("%s error %q: expected transient to be %v", test.target, test.err, test.transient)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	config := RetryConfig{
+		Delay:    Duration(time.Second),
+		MaxDelay: Duration(5 * time.Second),
+	}.withDefaults()
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for attempt, delay := range expected {
+		if d := config.backoff(attempt); d != delay {
+			t.Errorf("attempt %d: expected %v, got %v", attempt, delay, d)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	config := RetryConfig{Attempts: 3, Delay: Duration(time.Millisecond)}
+	refused := fmt.Errorf("connection refused")
+
+	calls := 0
+	err := retry(context.Background(), config, "docker", "loading", func() error {
+		calls++
+		if calls < 3 {
+			return refused
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("expected success after 3 calls, got %v after %d calls", err, calls)
+	}
+
+	calls = 0
+	err = retry(context.Background(), config, "docker", "loading", func() error {
+		calls++
+		return refused
+	})
+	if err != refused || calls != 3 {
+		t.Errorf("expected failure after 3 calls, got %v after %d calls", err, calls)
+	}
+
+	calls = 0
+	err = retry(context.Background(), config, "docker", "loading", func() error {
+		calls++
+		return fmt.Errorf("broken image")
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("expected permanent errors not to be retried, got %v after %d calls", err, calls)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = retry(ctx, RetryConfig{Delay: Duration(time.Hour)}, "docker", "loading", func() error {
+		return refused
+	})
+	if err != context.Canceled {
+		t.Errorf("expected the retries to be canceled, got %v", err)
+	}
+}
+
+func TestWaitForEngine(t *testing.T) {
+	config := RetryConfig{
+		Delay:         Duration(time.Millisecond),
+		MaxDelay:      Duration(time.Millisecond),
+		EngineTimeout: Duration(50 * time.Millisecond),
+	}
+	refused := fmt.Errorf("Cannot connect to the Docker daemon")
+
+	calls := 0
+	feeder, err := waitForEngine(context.Background(), config, "docker", func() (FeederIface, error) {
+		calls++
+		if calls < 3 {
+			return nil, refused
+		}
+		return &fakeFeeder{}, nil
+	})
+	if err != nil || feeder == nil || calls != 3 {
+		t.Errorf("expected the engine to be reachable after 3 calls, got %v after %d calls", err, calls)
+	}
+
+	if _, err := waitForEngine(context.Background(), config, "docker", func() (FeederIface, error) {
+		return nil, refused
+	}); err == nil {
+		t.Error("error expected when the engine never becomes reachable")
+	}
+}
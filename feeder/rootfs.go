@@ -0,0 +1,123 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package feeder
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/containers/image/docker/archive"
+	"github.com/containers/image/tarball"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// rootfsImageType marks the metadata of images shipped as a plain root
+// filesystem tarball
+const rootfsImageType = "rootfs"
+
+// RootfsConfig holds the optional configuration of an image built from a
+// root filesystem tarball
+type RootfsConfig struct {
+	Env        []string          `json:"env,omitempty"`
+	Entrypoint []string          `json:"entrypoint,omitempty"`
+	Cmd        []string          `json:"cmd,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
+
+// rootfsLayer returns the path of a file the tarball transport can read the
+// root filesystem stored at path from, and whether it is a temporary file.
+// The transport only copes with gzip compressed or plain tar archives, other
+// compressions need a decompressed copy.
+func rootfsLayer(ctx context.Context, path string) (string, bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", false, err
+	}
+	c, err := detectCompression(bufio.NewReader(file))
+	file.Close()
+	if err != nil {
+		return "", false, fmt.Errorf("error decompressing %s: %v", path, err)
+	}
+	if c == nil || c.name == "gzip" {
+		return path, false, nil
+	}
+
+	layer, err := decompressToTempFile(ctx, path)
+	if err != nil {
+		return "", false, err
+	}
+	return layer, true, nil
+}
+
+// convertRootfsImage turns the root filesystem tarball stored at path into a
+// single layer image named repotag. Returns the path of a temporary
+// docker-archive holding the image, which can be loaded by every feeder;
+// removing it is up to the caller.
+func convertRootfsImage(ctx context.Context, path, repotag string, config *RootfsConfig) (string, error) {
+	log.Debugf("Converting root filesystem %s into image %s", path, repotag)
+
+	layer, isTemp, err := rootfsLayer(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	if isTemp {
+		defer os.Remove(layer)
+	}
+
+	src, err := tarball.Transport.ParseReference(layer)
+	if err != nil {
+		return "", err
+	}
+	if config != nil {
+		image := imgspecv1.Image{
+			Config: imgspecv1.ImageConfig{
+				Env:        config.Env,
+				Entrypoint: config.Entrypoint,
+				Cmd:        config.Cmd,
+				Labels:     config.Labels,
+			},
+		}
+		if err := src.(tarball.ConfigUpdater).ConfigUpdate(image, nil); err != nil {
+			return "", err
+		}
+	}
+
+	tmpFile, err := ioutil.TempFile("/var/tmp", "container-feeder")
+	if err != nil {
+		return "", fmt.Errorf("error creating temporary file: %v", err)
+	}
+	tmpFile.Close()
+	image := tmpFile.Name()
+
+	dest, err := archive.ParseReference(image + ":" + repotag)
+	if err != nil {
+		os.Remove(image)
+		return "", err
+	}
+	if err := copyImage(ctx, dest, src, nil, nil); err != nil {
+		os.Remove(image)
+		return "", fmt.Errorf("error converting %s: %v", path, err)
+	}
+
+	return image, nil
+}
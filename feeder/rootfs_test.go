@@ -0,0 +1,234 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package feeder
+
+import (
+	"archive/tar"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/image/docker/archive"
+	"github.com/ulikunitz/xz"
+)
+
+// writeRootfsArchive writes a xz compressed root filesystem tarball
+func writeRootfsArchive(t *testing.T, file string) {
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatalf("error creating archive: %v", err)
+	}
+	defer f.Close()
+	xw, err := xz.NewWriter(f)
+	if err != nil {
+		t.Fatalf("error creating xz writer: %v", err)
+	}
+	defer xw.Close()
+	tw := tar.NewWriter(xw)
+	defer tw.Close()
+
+	content := []byte("openSUSE Tumbleweed\n")
+	tw.WriteHeader(&tar.Header{Name: "etc/", Mode: 0755, Typeflag: tar.TypeDir})
+	tw.WriteHeader(&tar.Header{Name: "etc/issue", Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+	tw.Write(content)
+}
+
+func TestRootfsImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-rootfs")
+	if err != nil {
+		t.Fatalf("error while creating test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeRootfsArchive(t, filepath.Join(dir, "tumbleweed-rootfs.tar.xz"))
+	metadata := `{"image": {"name": "opensuse/tumbleweed", "tags": ["20180201", "latest"],
+		"file": "tumbleweed-rootfs.tar.xz", "type": "rootfs",
+		"config": {"cmd": ["/bin/bash"], "labels": {"vendor": "openSUSE"}}}}`
+	file := filepath.Join(dir, "tumbleweed.metadata")
+	if err := ioutil.WriteFile(file, []byte(metadata), 0644); err != nil {
+		t.Fatalf("error writing metadata: %v", err)
+	}
+
+	repotag, _, image, err := repotagFromRPMFile(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	converted, err := convertRootfsImage(context.Background(), filepath.Join(dir, image.File), repotag, image.Config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.Remove(converted)
+
+	_, repotags, closeSrc, err := openDockerArchive(context.Background(), converted)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	closeSrc()
+	if len(repotags) != 1 || repotags[0] != "docker.io/opensuse/tumbleweed:20180201" {
+		t.Errorf("unexpected repotags: %v", repotags)
+	}
+
+	ref, err := archive.ParseReference(converted)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	img, err := ref.NewImage(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer img.Close()
+	config, err := img.OCIConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(config.Config.Cmd) != 1 || config.Config.Cmd[0] != "/bin/bash" {
+		t.Errorf("unexpected cmd: %v", config.Config.Cmd)
+	}
+	if config.Config.Labels["vendor"] != "openSUSE" {
+		t.Errorf("unexpected labels: %v", config.Config.Labels)
+	}
+	if len(config.RootFS.DiffIDs) != 1 {
+		t.Errorf("expected a single layer, got %d", len(config.RootFS.DiffIDs))
+	}
+}
+
+func TestRootfsUnknownType(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-rootfs")
+	if err != nil {
+		t.Fatalf("error while creating test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	metadata := `{"image": {"name": "opensuse/tumbleweed", "tags": ["20180201"], "file": "tumbleweed.tar.xz", "type": "squashfs"}}`
+	file := filepath.Join(dir, "tumbleweed.metadata")
+	if err := ioutil.WriteFile(file, []byte(metadata), 0644); err != nil {
+		t.Fatalf("error writing metadata: %v", err)
+	}
+	if _, _, _, err := repotagFromRPMFile(file); err == nil {
+		t.Error("error expected but not received")
+	}
+}
+
+func TestRootfsSignatures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-rootfs")
+	if err != nil {
+		t.Fatalf("error while creating test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	metadata := `{"image": {"name": "opensuse/tumbleweed", "tags": ["20180201"], "file": "tumbleweed.tar.xz", "type": "rootfs", "signatures": ["tumbleweed.sig"]}}`
+	file := filepath.Join(dir, "tumbleweed.metadata")
+	if err := ioutil.WriteFile(file, []byte(metadata), 0644); err != nil {
+		t.Fatalf("error writing metadata: %v", err)
+	}
+	if _, _, _, err := repotagFromRPMFile(file); err == nil {
+		t.Error("error expected but not received")
+	}
+}
+
+// archiveFeeder is a fakeFeeder recording the files it loads, and whether
+// they existed while being loaded
+type archiveFeeder struct {
+	fakeFeeder
+	loaded map[string]bool
+}
+
+func (f *archiveFeeder) LoadImage(ctx context.Context, path, format string) (string, error) {
+	_, err := os.Stat(path)
+	f.loaded[path] = err == nil
+	return path, nil
+}
+
+func TestImportRootfsImages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-rootfs")
+	if err != nil {
+		t.Fatalf("error while creating test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tumbleweed := filepath.Join(dir, "tumbleweed-rootfs.tar.xz")
+	writeRootfsArchive(t, tumbleweed)
+	rpmImages := map[string]string{
+		"docker.io/opensuse/tumbleweed:20180201": tumbleweed,
+		// up to date: never converted, although the file is missing
+		"docker.io/opensuse/leap:15":  filepath.Join(dir, "leap-rootfs.tar.xz"),
+		"docker.io/opensuse/broken:1": filepath.Join(dir, "broken-rootfs.tar.xz"),
+	}
+	rpmImageTags := map[string][]string{}
+	rpmMetadata := map[string]ImageType{}
+	for repotag := range rpmImages {
+		rpmImageTags[repotag] = []string{repotag}
+		rpmMetadata[repotag] = ImageType{Type: rootfsImageType}
+	}
+
+	docker := &archiveFeeder{
+		fakeFeeder: fakeFeeder{images: []string{"docker.io/opensuse/leap:15"}},
+		loaded:     make(map[string]bool),
+	}
+	crio := &archiveFeeder{
+		fakeFeeder: fakeFeeder{images: []string{"docker.io/opensuse/leap:15"}},
+		loaded:     make(map[string]bool),
+	}
+	f := &Feeder{targets: []target{{name: "docker", feeder: docker}, {name: "crio", feeder: crio}}}
+	res := f.importImages(context.Background(), rpmImages, rpmImageTags, rpmMetadata)
+
+	if len(res.SuccessfulImports) != 2 {
+		t.Errorf("unexpected successful imports: %+v", res.SuccessfulImports)
+	}
+	for _, imported := range res.SuccessfulImports {
+		if imported.Image != "docker.io/opensuse/tumbleweed:20180201" {
+			t.Errorf("unexpected successful import: %+v", imported)
+		}
+	}
+	if len(res.UpToDateImages) != 2 {
+		t.Errorf("unexpected up to date images: %+v", res.UpToDateImages)
+	}
+	for _, upToDate := range res.UpToDateImages {
+		if upToDate.Image != "docker.io/opensuse/leap:15" {
+			t.Errorf("unexpected up to date image: %+v", upToDate)
+		}
+	}
+	if len(res.FailedImports) != 2 {
+		t.Errorf("unexpected failed imports: %+v", res.FailedImports)
+	}
+	for _, failed := range res.FailedImports {
+		if failed.Image != "docker.io/opensuse/broken:1" || failed.Category != CategoryConversion {
+			t.Errorf("unexpected failed import: %+v", failed)
+		}
+	}
+
+	// the image is converted once for both targets
+	if len(docker.loaded) != 1 || len(crio.loaded) != 1 {
+		t.Fatalf("unexpected loaded files: %v, %v", docker.loaded, crio.loaded)
+	}
+	for path := range docker.loaded {
+		if _, ok := crio.loaded[path]; !ok {
+			t.Errorf("crio did not load the archive loaded by docker: %v", crio.loaded)
+		}
+	}
+	for path, existed := range docker.loaded {
+		if path == tumbleweed || !existed {
+			t.Errorf("the converted archive %s was not loaded", path)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("converted archive %s has not been removed", path)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package feeder
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/kubic-project/container-feeder/registry"
+	log "github.com/sirupsen/logrus"
+)
+
+// registryImages converts the RPMs images into the images served by the
+// registry. Only docker-archive images can be served.
+func registryImages(rpmImages map[string]string, rpmImageTags map[string][]string, rpmMetadata map[string]ImageType) ([]registry.Image, error) {
+	images := []registry.Image{}
+	for repotag, file := range rpmImages {
+		if format := rpmMetadata[repotag].Format; format != dockerArchiveFormat {
+			log.Warnf("Not serving image %s: %v", repotag, unsupportedFormatError("serve", format))
+			continue
+		}
+		name, tag, err := normalizeNameTag(repotag)
+		if err != nil {
+			return nil, err
+		}
+		image := registry.Image{Name: name, Tags: []string{tag}, File: file}
+		for _, additional := range rpmImageTags[repotag] {
+			_, tag, err := normalizeNameTag(additional)
+			if err != nil {
+				return nil, err
+			}
+			image.Tags = append(image.Tags, tag)
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+// Serve exposes all the RPMs images stored inside of `dirs`, the configured
+// sources when empty, through a read-only Docker Registry v2 API listening on
+// `address`, until ctx is done
+func Serve(ctx context.Context, dirs []string, address string) error {
+	var err error
+	f := Feeder{}
+
+	f.config, err = loadConfig()
+	if err != nil {
+		return err
+	}
+
+	rpmImages, rpmImageTags, rpmMetadata, _, err := f.whitelistedRPMImages(dirs)
+	if err != nil {
+		return err
+	}
+	for repotag := range f.verifyChecksums(ctx, rpmImages, rpmMetadata) {
+		log.Warnf("Not serving image %s: its checksum does not match", repotag)
+	}
+	// the converted archives are needed as long as the registry is running
+	for _, repotag := range sortedRepotags(rpmImages) {
+		metadata := rpmMetadata[repotag]
+		if metadata.Type != rootfsImageType {
+			continue
+		}
+		converted, err := convertRootfsImage(ctx, rpmImages[repotag], repotag, metadata.Config)
+		if err != nil {
+			log.Warnf("Not serving image %s: %v", repotag, err)
+			delete(rpmImages, repotag)
+			continue
+		}
+		defer os.Remove(converted)
+		rpmImages[repotag] = converted
+	}
+	if f.config.SignaturePolicy != "" {
+		// the copies accepted by the signature policy are served in place
+		// of the images
+		for _, repotag := range sortedRepotags(rpmImages) {
+			metadata := rpmMetadata[repotag]
+			verified, err := verifiedCopy(ctx, f.config.SignaturePolicy, rpmImages[repotag], metadata.Format, repotag, signatureFiles(metadata))
+			if err != nil {
+				log.Warnf("Not serving image %s: %v", repotag, err)
+				delete(rpmImages, repotag)
+				continue
+			}
+			defer os.RemoveAll(verified)
+			rpmImages[repotag] = verified
+		}
+	}
+	images, err := registryImages(rpmImages, rpmImageTags, rpmMetadata)
+	if err != nil {
+		return err
+	}
+
+	server, err := registry.NewServer(images)
+	if err != nil {
+		return fmt.Errorf("error creating registry: %v", err)
+	}
+	defer server.Close()
+	listener, err := registry.Listen(address)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	log.Infof("Serving %d images on %s", len(images), address)
+	err = http.Serve(listener, server)
+	if ctx.Err() != nil {
+		log.Info("Stopped serving the images")
+		return nil
+	}
+	return err
+}
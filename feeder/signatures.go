@@ -0,0 +1,226 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package feeder
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/containers/image/docker"
+	"github.com/containers/image/docker/archive"
+	"github.com/containers/image/image"
+	ociarchive "github.com/containers/image/oci/archive"
+	"github.com/containers/image/oci/layout"
+	"github.com/containers/image/signature"
+	"github.com/containers/image/types"
+	"github.com/opencontainers/go-digest"
+	log "github.com/sirupsen/logrus"
+)
+
+// imageSignatures are the signatures shipped with an image, checked against
+// the policy.json file stored at policy when the image is copied, as if it
+// was pulled as repotag
+type imageSignatures struct {
+	policy     string
+	repotag    string
+	signatures [][]byte
+}
+
+// signatureError is the error reported for the images refused by the
+// signature policy
+type signatureError struct {
+	err error
+}
+
+func (e signatureError) Error() string {
+	return fmt.Sprintf("image refused by the signature policy: %v", e.err)
+}
+
+// signedSource is the source of an image shipped by an RPM as seen by the
+// signature policy: named after its repotag, with the signatures shipped next
+// to it. The manifest is read once, so that the policy and the copy of the
+// image see the same one.
+type signedSource struct {
+	types.ImageSource
+	ref          types.ImageReference
+	signatures   [][]byte
+	manifest     []byte
+	manifestType string
+}
+
+// newSignedSource returns the signedSource of the image read from source
+func newSignedSource(source types.ImageSource, repotag string, signatures [][]byte) (*signedSource, error) {
+	ref, err := docker.ParseReference("//" + repotag)
+	if err != nil {
+		return nil, err
+	}
+	manifest, manifestType, err := source.GetManifest(nil)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %v", err)
+	}
+	return &signedSource{
+		ImageSource:  source,
+		ref:          ref,
+		signatures:   signatures,
+		manifest:     manifest,
+		manifestType: manifestType,
+	}, nil
+}
+
+func (s *signedSource) Reference() types.ImageReference {
+	return s.ref
+}
+
+func (s *signedSource) GetManifest(instanceDigest *digest.Digest) ([]byte, string, error) {
+	if instanceDigest != nil {
+		return s.ImageSource.GetManifest(instanceDigest)
+	}
+	return s.manifest, s.manifestType, nil
+}
+
+func (s *signedSource) GetSignatures(ctx context.Context, instanceDigest *digest.Digest) ([][]byte, error) {
+	return s.signatures, nil
+}
+
+// signatureFiles returns the paths of the signatures of the image described
+// by metadata
+func signatureFiles(metadata ImageType) []string {
+	files := []string{}
+	for _, file := range metadata.Signatures {
+		files = append(files, filepath.Join(filepath.Dir(metadata.metadataFile), file))
+	}
+	return files
+}
+
+// readSignatures returns the content of the signature files
+func readSignatures(files []string) ([][]byte, error) {
+	signatures := [][]byte{}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading signature: %v", err)
+		}
+		signatures = append(signatures, data)
+	}
+	return signatures, nil
+}
+
+// checkSignatures checks the image read from source against the policy of
+// policyContext. Returns why the image is refused, nil if it is allowed.
+func checkSignatures(policyContext *signature.PolicyContext, source types.ImageSource) error {
+	allowed, err := policyContext.IsRunningImageAllowed(image.UnparsedInstance(source, nil))
+	if !allowed {
+		if err == nil {
+			err = fmt.Errorf("no policy requirement accepted it")
+		}
+		return signatureError{err}
+	}
+	return nil
+}
+
+// verifySignature checks the image stored at path in the specified format,
+// to be named repotag, against the policy of policyContext. Returns why the
+// image is refused, nil if it is allowed. Nothing is imported: the images
+// are checked again while being copied by verifiedCopy.
+func verifySignature(ctx context.Context, policyContext *signature.PolicyContext, path, format, repotag string, signatureFiles []string) error {
+	signatures, err := readSignatures(signatureFiles)
+	if err != nil {
+		return err
+	}
+
+	src, _, closeSrc, err := openImage(ctx, path, format)
+	if err != nil {
+		return err
+	}
+	defer closeSrc()
+	source, err := src.NewImageSource(nil)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %v", path, err)
+	}
+	defer source.Close()
+
+	signed, err := newSignedSource(source, repotag, signatures)
+	if err != nil {
+		return err
+	}
+	return checkSignatures(policyContext, signed)
+}
+
+// verifiedCopy copies the image stored at path in the specified format into a
+// temporary file, or directory, of the same format, named repotag. The image
+// is checked against the policy.json file stored at policy while being
+// copied: the copy holds exactly the content accepted by the policy. Returns
+// the path of the copy; removing it is up to the caller.
+func verifiedCopy(ctx context.Context, policy, path, format, repotag string, signatureFiles []string) (string, error) {
+	signatures, err := readSignatures(signatureFiles)
+	if err != nil {
+		return "", signatureError{err}
+	}
+
+	src, _, closeSrc, err := openImage(ctx, path, format)
+	if err != nil {
+		return "", err
+	}
+	defer closeSrc()
+
+	var verified string
+	var dest types.ImageReference
+	if format == ociLayoutFormat {
+		if verified, err = ioutil.TempDir("/var/tmp", "container-feeder"); err != nil {
+			return "", fmt.Errorf("error creating temporary directory: %v", err)
+		}
+		dest, err = layout.NewReference(verified, repotag)
+	} else {
+		var tmpFile *os.File
+		if tmpFile, err = ioutil.TempFile("/var/tmp", "container-feeder"); err != nil {
+			return "", fmt.Errorf("error creating temporary file: %v", err)
+		}
+		tmpFile.Close()
+		verified = tmpFile.Name()
+		if format == ociArchiveFormat {
+			dest, err = ociarchive.NewReference(verified, repotag)
+		} else {
+			dest, err = archive.ParseReference(verified + ":" + repotag)
+		}
+	}
+	if err != nil {
+		os.RemoveAll(verified)
+		return "", err
+	}
+
+	signed := &imageSignatures{policy: policy, repotag: repotag, signatures: signatures}
+	if err := copyImage(ctx, dest, src, nil, signed); err != nil {
+		os.RemoveAll(verified)
+		return "", err
+	}
+	log.Debugf("Image %s: accepted by the signature policy", repotag)
+	return verified, nil
+}
+
+// newSignaturePolicyContext returns the policy context of the policy.json
+// file stored at path
+func newSignaturePolicyContext(path string) (*signature.PolicyContext, error) {
+	policy, err := signature.NewPolicyFromFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error loading %s: %v", path, err)
+	}
+	return signature.NewPolicyContext(policy)
+}
@@ -0,0 +1,249 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package feeder
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containers/image/manifest"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// signManifest returns a simple signing signature of the image stored at path
+// as named repotag, made by signer
+func signManifest(t *testing.T, signer *openpgp.Entity, path, repotag string) []byte {
+	src, _, closeSrc, err := openImage(context.Background(), path, dockerArchiveFormat)
+	if err != nil {
+		t.Fatalf("error opening image: %v", err)
+	}
+	defer closeSrc()
+	source, err := src.NewImageSource(nil)
+	if err != nil {
+		t.Fatalf("error opening image: %v", err)
+	}
+	defer source.Close()
+	m, _, err := source.GetManifest(nil)
+	if err != nil {
+		t.Fatalf("error reading manifest: %v", err)
+	}
+	manifestDigest, err := manifest.Digest(m)
+	if err != nil {
+		t.Fatalf("error computing manifest digest: %v", err)
+	}
+	payload := []byte(fmt.Sprintf(`{"critical":{"type":"atomic container signature","image":{"docker-manifest-digest":"%s"},"identity":{"docker-reference":"%s"}},"optional":{}}`,
+		manifestDigest, repotag))
+
+	var buf bytes.Buffer
+	key := signer.PrivateKey
+	ops := &packet.OnePassSignature{SigType: packet.SigTypeBinary, Hash: crypto.SHA256, PubKeyAlgo: key.PubKeyAlgo, KeyId: key.KeyId, IsLast: true}
+	if err := ops.Serialize(&buf); err != nil {
+		t.Fatalf("error signing: %v", err)
+	}
+	literal, err := packet.SerializeLiteral(nopWriteCloser{&buf}, true, "", 0)
+	if err != nil {
+		t.Fatalf("error signing: %v", err)
+	}
+	literal.Write(payload)
+	literal.Close()
+
+	sig := &packet.Signature{SigType: packet.SigTypeBinary, PubKeyAlgo: key.PubKeyAlgo, Hash: crypto.SHA256, CreationTime: time.Now(), IssuerKeyId: &key.KeyId}
+	h := crypto.SHA256.New()
+	h.Write(payload)
+	if err := sig.Sign(h, key, nil); err != nil {
+		t.Fatalf("error signing: %v", err)
+	}
+	if err := sig.Serialize(&buf); err != nil {
+		t.Fatalf("error signing: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestVerifySignature(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-signatures")
+	if err != nil {
+		t.Fatalf("error while creating test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	repotag := "opensuse/salt-api:13"
+	image := filepath.Join(dir, "salt-api.tar.xz")
+	writeDockerArchive(t, image, repotag)
+
+	signer, err := openpgp.NewEntity("container-feeder", "", "feeder@example.com", nil)
+	if err != nil {
+		t.Fatalf("error creating key: %v", err)
+	}
+	other, err := openpgp.NewEntity("someone else", "", "else@example.com", nil)
+	if err != nil {
+		t.Fatalf("error creating key: %v", err)
+	}
+	// the self signatures are only made when serializing the private key
+	if err := signer.SerializePrivate(ioutil.Discard, nil); err != nil {
+		t.Fatalf("error exporting key: %v", err)
+	}
+	var keyring bytes.Buffer
+	if err := signer.Serialize(&keyring); err != nil {
+		t.Fatalf("error exporting key: %v", err)
+	}
+	keyPath := filepath.Join(dir, "pubring.gpg")
+	if err := ioutil.WriteFile(keyPath, keyring.Bytes(), 0644); err != nil {
+		t.Fatalf("error writing keyring: %v", err)
+	}
+
+	signatures := map[string][]byte{
+		"valid.sig":          signManifest(t, signer, image, "docker.io/"+repotag),
+		"other-identity.sig": signManifest(t, signer, image, "docker.io/opensuse/tumbleweed:13"),
+		"other-key.sig":      signManifest(t, other, image, "docker.io/"+repotag),
+	}
+	for name, data := range signatures {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatalf("error writing signature: %v", err)
+		}
+	}
+
+	signedBy := fmt.Sprintf(`{"default": [{"type": "reject"}], "transports": {"docker": {"docker.io/opensuse": [{"type": "signedBy", "keyType": "GPGKeys", "keyPath": "%s"}]}}}`, keyPath)
+	for _, test := range []struct {
+		policy     string
+		signatures []string
+		allowed    bool
+	}{
+		{signedBy, []string{"valid.sig"}, true},
+		{signedBy, []string{"other-key.sig", "valid.sig"}, true},
+		{signedBy, []string{}, false},
+		{signedBy, []string{"other-identity.sig"}, false},
+		{signedBy, []string{"other-key.sig"}, false},
+		{signedBy, []string{"missing.sig"}, false},
+		{`{"default": [{"type": "insecureAcceptAnything"}]}`, []string{}, true},
+	} {
+		policyFile := filepath.Join(dir, "policy.json")
+		if err := ioutil.WriteFile(policyFile, []byte(test.policy), 0644); err != nil {
+			t.Fatalf("error writing policy: %v", err)
+		}
+		policyContext, err := newSignaturePolicyContext(policyFile)
+		if err != nil {
+			t.Fatalf("error loading policy: %v", err)
+		}
+		files := []string{}
+		for _, name := range test.signatures {
+			files = append(files, filepath.Join(dir, name))
+		}
+
+		err = verifySignature(context.Background(), policyContext, image, dockerArchiveFormat, repotag, files)
+		policyContext.Destroy()
+		if test.allowed && err != nil {
+			t.Errorf("%v: unexpected error: %v", test.signatures, err)
+		} else if !test.allowed && err == nil {
+			t.Errorf("%v: error expected but not received", test.signatures)
+		}
+
+		// the same policy is applied while copying the image
+		verified, err := verifiedCopy(context.Background(), policyFile, image, dockerArchiveFormat, repotag, files)
+		if !test.allowed {
+			if _, ok := err.(signatureError); !ok {
+				t.Errorf("%v: signature error expected, got %v", test.signatures, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", test.signatures, err)
+			continue
+		}
+		_, repotags, closeSrc, err := openDockerArchive(context.Background(), verified)
+		if err != nil {
+			t.Errorf("%v: unexpected error opening the copy: %v", test.signatures, err)
+		} else {
+			closeSrc()
+			if len(repotags) != 1 || repotags[0] != "docker.io/"+repotag {
+				t.Errorf("%v: unexpected repotags of the copy: %v", test.signatures, repotags)
+			}
+		}
+		os.Remove(verified)
+	}
+}
+
+func TestImportSignedImages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-signatures")
+	if err != nil {
+		t.Fatalf("error while creating test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	repotag := "docker.io/opensuse/salt-api:13"
+	image := filepath.Join(dir, "salt-api.tar.xz")
+	writeDockerArchive(t, image, repotag)
+	rpmImages := map[string]string{repotag: image}
+	rpmImageTags := map[string][]string{repotag: {repotag}}
+	rpmMetadata := map[string]ImageType{repotag: {Format: dockerArchiveFormat}}
+
+	acceptFile := filepath.Join(dir, "accept.json")
+	rejectFile := filepath.Join(dir, "reject.json")
+	if err := ioutil.WriteFile(acceptFile, []byte(`{"default": [{"type": "insecureAcceptAnything"}]}`), 0644); err != nil {
+		t.Fatalf("error writing policy: %v", err)
+	}
+	if err := ioutil.WriteFile(rejectFile, []byte(`{"default": [{"type": "reject"}]}`), 0644); err != nil {
+		t.Fatalf("error writing policy: %v", err)
+	}
+
+	for _, policy := range []string{rejectFile, "/non-existent/policy.json"} {
+		docker := &archiveFeeder{loaded: make(map[string]bool)}
+		f := &Feeder{targets: []target{{name: "docker", feeder: docker}}, config: FeederConfig{SignaturePolicy: policy}}
+		res := f.importImages(context.Background(), rpmImages, rpmImageTags, rpmMetadata)
+		if len(res.FailedImports) != 1 || res.FailedImports[0].Category != CategorySignature {
+			t.Errorf("%s: expected the image to be refused: %+v", policy, res)
+		}
+		if len(docker.loaded) != 0 {
+			t.Errorf("%s: unexpected loaded files: %v", policy, docker.loaded)
+		}
+	}
+
+	// the copy accepted by the policy is made once, loaded into every
+	// target, then removed
+	docker := &archiveFeeder{loaded: make(map[string]bool)}
+	crio := &archiveFeeder{loaded: make(map[string]bool)}
+	f := &Feeder{
+		targets: []target{{name: "docker", feeder: docker}, {name: "crio", feeder: crio}},
+		config:  FeederConfig{SignaturePolicy: acceptFile},
+	}
+	res := f.importImages(context.Background(), rpmImages, rpmImageTags, rpmMetadata)
+	if len(res.SuccessfulImports) != 2 {
+		t.Errorf("unexpected result: %+v", res)
+	}
+	if len(docker.loaded) != 1 || len(crio.loaded) != 1 {
+		t.Fatalf("unexpected loaded files: %v, %v", docker.loaded, crio.loaded)
+	}
+	for path, existed := range docker.loaded {
+		if _, ok := crio.loaded[path]; !ok {
+			t.Errorf("crio did not load the copy loaded by docker: %v", crio.loaded)
+		}
+		if path == image || !existed {
+			t.Errorf("the verified copy %s was not loaded", path)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("verified copy %s has not been removed", path)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package feeder
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	wlk "github.com/kubic-project/container-feeder/walker"
+)
+
+// the directory the images are found in when no source is specified
+const defaultSource = "/usr/share/suse-docker-images/native"
+
+// SourceConfig holds the settings of a directory the images are found in
+type SourceConfig struct {
+	// the directory holding the .metadata files
+	Path string `json:"path"`
+	// how the files of the directory are verified: "rpm", "dpkg",
+	// "checksum" or "none" (default: FeederConfig.Verification)
+	Verification string `json:"verification,omitempty"`
+	// look for the .metadata files inside of the subdirectories as well
+	Recursive bool `json:"recursive,omitempty"`
+	// when set, only the .metadata files matching one of these patterns are
+	// considered
+	Include []string `json:"include,omitempty"`
+	// the .metadata files and the subdirectories matching one of these
+	// patterns are ignored
+	Exclude []string `json:"exclude,omitempty"`
+	// how the symbolic links are handled: "files", "follow" or "skip"
+	// (default: "files")
+	Symlinks string `json:"symlinks,omitempty"`
+}
+
+// validVerification returns an error if verification is unknown
+func validVerification(verification string) error {
+	if verification == "" {
+		return nil
+	}
+	_, err := wlk.NewVerifier(verification)
+	return err
+}
+
+// validSources returns an error if one of the sources is invalid
+func validSources(sources []SourceConfig) error {
+	for _, source := range sources {
+		if source.Path == "" {
+			return fmt.Errorf("sources must have a path")
+		}
+		if err := validVerification(source.Verification); err != nil {
+			return fmt.Errorf("error in source '%s': %v", source.Path, err)
+		}
+		for _, pattern := range append(source.Include, source.Exclude...) {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return fmt.Errorf("error in source '%s': invalid pattern '%s': %v", source.Path, pattern, err)
+			}
+		}
+		switch source.Symlinks {
+		case "", wlk.SymlinksFiles, wlk.SymlinksFollow, wlk.SymlinksSkip:
+		default:
+			return fmt.Errorf("error in source '%s': unknown symlinks policy '%s'", source.Path, source.Symlinks)
+		}
+	}
+	return nil
+}
+
+// sourceDirs returns the directories the images are found in: dirs when
+// specified, the configured sources otherwise, defaultSource when there are
+// none
+func (c FeederConfig) sourceDirs(dirs []string) []string {
+	if len(dirs) > 0 {
+		return dirs
+	}
+	if len(c.Sources) == 0 {
+		return []string{defaultSource}
+	}
+	paths := []string{}
+	for _, source := range c.Sources {
+		paths = append(paths, source.Path)
+	}
+	return paths
+}
+
+// source returns the settings of the directory stored at path, the defaults
+// when it is not configured
+func (c FeederConfig) source(path string) SourceConfig {
+	for _, source := range c.Sources {
+		if filepath.Clean(source.Path) == filepath.Clean(path) {
+			return source
+		}
+	}
+	return SourceConfig{Path: path}
+}
+
+// newWalker returns a walker listing the .metadata files of the directory
+// stored at path, according to its settings
+func (c FeederConfig) newWalker(path string) *wlk.Walker {
+	source := c.source(path)
+	walker := wlk.NewWalker(path, ".metadata")
+	walker.Recursive = source.Recursive
+	walker.Include = source.Include
+	walker.Exclude = source.Exclude
+	walker.Symlinks = source.Symlinks
+	return walker
+}
+
+// verification returns the name of the verifier of the files stored inside
+// of the directory stored at path
+func (c FeederConfig) verification(path string) string {
+	if verification := c.source(path).Verification; verification != "" {
+		return verification
+	}
+	if c.Verification != "" {
+		return c.Verification
+	}
+	return wlk.VerifierRPM
+}
+
+// scanned returns true if the file stored at path is looked for by scanning
+// dirs: it is stored inside of one of them, or of one of the subdirectories
+// of a recursive one
+func (c FeederConfig) scanned(dirs []string, path string) bool {
+	for _, dir := range dirs {
+		if filepath.Dir(path) == filepath.Clean(dir) {
+			return true
+		}
+		if c.source(dir).Recursive && insideDir(dir, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// insideDir returns true if the file stored at path is stored inside of dir,
+// or of one of its subdirectories
+func insideDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
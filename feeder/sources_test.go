@@ -0,0 +1,184 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package feeder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	wlk "github.com/kubic-project/container-feeder/walker"
+)
+
+func TestSourceVerification(t *testing.T) {
+	config := FeederConfig{
+		Verification: wlk.VerifierDpkg,
+		Sources: []SourceConfig{
+			{Path: "/usr/share/suse-docker-images/native/", Verification: wlk.VerifierNone},
+			{Path: "/var/lib/images"},
+		},
+	}
+	for path, expected := range map[string]string{
+		"/usr/share/suse-docker-images/native": wlk.VerifierNone,
+		"/var/lib/images":                      wlk.VerifierDpkg,
+		"/srv/images":                          wlk.VerifierDpkg,
+	} {
+		if verification := config.verification(path); verification != expected {
+			t.Errorf("%s: expected %s, got %s", path, expected, verification)
+		}
+	}
+	if verification := (FeederConfig{}).verification("/srv/images"); verification != wlk.VerifierRPM {
+		t.Errorf("expected rpm by default, got %s", verification)
+	}
+
+	for _, sources := range [][]SourceConfig{
+		{{Verification: wlk.VerifierNone}},
+		{{Path: "/srv/images", Verification: "md5"}},
+		{{Path: "/srv/images", Include: []string{"[caasp"}}},
+		{{Path: "/srv/images", Symlinks: "always"}},
+	} {
+		if err := validSources(sources); err == nil {
+			t.Errorf("error expected for %+v", sources)
+		}
+	}
+}
+
+func TestFindRPMImagesSourceVerification(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-sources")
+	if err != nil {
+		t.Fatalf("error while creating test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	metadata, image := writeMetadata(t, dir)
+	state := newFeederState()
+	state.updateFile(metadata, image, "salt-api-0:13-1.1.x86_64", wlk.VerifierRPM)
+
+	// the files verified against the RPM database are trusted by none, with
+	// no rpm involved
+	config := FeederConfig{Sources: []SourceConfig{{Path: dir, Verification: wlk.VerifierNone}}}
+	rpmImages, _, _, _, err := findRPMImages([]string{dir}, state, config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(rpmImages) != 1 {
+		t.Errorf("unexpected images: %v", rpmImages)
+	}
+	if record := state.Files[metadata]; record.Verification != wlk.VerifierNone || record.NEVRA != "" || record.Outdated {
+		t.Errorf("unexpected record: %+v", record)
+	}
+
+	// the files are verified again by the checksum verifier, the metadata
+	// lacks a checksum
+	config.Sources[0].Verification = wlk.VerifierChecksum
+	rpmImages, _, _, _, err = findRPMImages([]string{dir}, state, config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(rpmImages) != 0 {
+		t.Errorf("unexpected images: %v", rpmImages)
+	}
+}
+
+func TestFindRPMImagesSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-sources")
+	if err != nil {
+		t.Fatalf("error while creating test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	vendor := filepath.Join(dir, "native")
+	local := filepath.Join(dir, "local")
+	for file, content := range map[string]string{
+		// the image files are next to the .metadata file naming them
+		"native/caasp/velum.metadata":       `{"image": {"name": "caasp/velum", "tags": ["4.0"], "file": "velum.tar.xz"}}`,
+		"native/caasp/velum.tar.xz":         "image",
+		"native/caasp/debug/gdb.metadata":   `{"image": {"name": "caasp/gdb", "tags": ["1"], "file": "gdb.tar.xz"}}`,
+		"native/caasp/debug/gdb.tar.xz":     "image",
+		"native/salt-api.metadata":          `{"image": {"name": "opensuse/salt-api", "tags": ["13"], "file": "images/salt-api.tar.xz"}}`,
+		"native/images/salt-api.tar.xz":     "image",
+		"local/busybox.metadata":            `{"image": {"name": "busybox", "tags": ["1"], "file": "busybox.tar.xz"}}`,
+		"local/busybox.tar.xz":              "image",
+		"local/nested/salt-master.metadata": `{"image": {"name": "opensuse/salt-master", "tags": ["13"], "file": "salt-master.tar.xz"}}`,
+		"local/nested/salt-master.tar.xz":   "image",
+	} {
+		path := filepath.Join(dir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("error creating dir: %v", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("error writing file: %v", err)
+		}
+	}
+
+	config := FeederConfig{
+		Verification: wlk.VerifierNone,
+		Sources: []SourceConfig{
+			{Path: vendor, Recursive: true, Exclude: []string{"debug"}},
+			{Path: local},
+		},
+	}
+	rpmImages, _, rpmMetadata, _, err := findRPMImages(config.sourceDirs(nil), newFeederState(), config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for repotag, file := range map[string]string{
+		"docker.io/caasp/velum:4.0":      filepath.Join(vendor, "caasp", "velum.tar.xz"),
+		"docker.io/opensuse/salt-api:13": filepath.Join(vendor, "images", "salt-api.tar.xz"),
+		"docker.io/library/busybox:1":    filepath.Join(local, "busybox.tar.xz"),
+	} {
+		if rpmImages[repotag] != file {
+			t.Errorf("%s: expected %s, got %s", repotag, file, rpmImages[repotag])
+		}
+	}
+	if len(rpmImages) != 3 {
+		t.Errorf("unexpected images: %v", rpmImages)
+	}
+	if metadata := rpmMetadata["docker.io/caasp/velum:4.0"].metadataFile; metadata != filepath.Join(vendor, "caasp", "velum.metadata") {
+		t.Errorf("unexpected metadata file %s", metadata)
+	}
+
+	// the same repotag shipped inside of several directories conflicts
+	busybox := `{"image": {"name": "busybox", "tags": ["1"], "file": "busybox.tar.xz"}}`
+	if err := ioutil.WriteFile(filepath.Join(vendor, "busybox.metadata"), []byte(busybox), 0644); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(vendor, "busybox.tar.xz"), []byte("image"), 0644); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	rpmImages, _, _, conflicts, err := findRPMImages(config.sourceDirs(nil), newFeederState(), config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(conflicts) != 1 || conflicts["docker.io/library/busybox:1"] == nil {
+		t.Errorf("expected the conflict to fail the image: %v", conflicts)
+	}
+	if len(rpmImages) != 2 || rpmImages["docker.io/library/busybox:1"] != "" {
+		t.Errorf("expected the other images to be found: %v", rpmImages)
+	}
+
+	// the directories specified replace the configured sources
+	rpmImages, _, _, _, err = findRPMImages(config.sourceDirs([]string{local}), newFeederState(), config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(rpmImages) != 1 {
+		t.Errorf("unexpected images: %v", rpmImages)
+	}
+}
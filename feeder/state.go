@@ -0,0 +1,219 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package feeder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// the default path of the file recording the imported images
+const defaultStateFile = "/var/lib/container-feeder/state.json"
+
+// importRecord is an image imported by container-feeder into a target
+type importRecord struct {
+	Image    string    `json:"image"`
+	Tags     []string  `json:"tags,omitempty"`
+	Imported time.Time `json:"imported"`
+	// the .metadata file the image has been imported from
+	Metadata string `json:"metadata,omitempty"`
+	// the image produced by the import, empty when the target does not
+	// report it
+	ID ImageID `json:"id"`
+}
+
+// feederState records the images container-feeder imported, which are the
+// only ones it is allowed to prune, and the journal of the .metadata files
+// it verified
+type feederState struct {
+	// the imported images by target name
+	Targets map[string][]importRecord `json:"targets"`
+	// the verified files by path of the .metadata file
+	Files map[string]*fileRecord `json:"files,omitempty"`
+}
+
+// newFeederState returns an empty state
+func newFeederState() *feederState {
+	return &feederState{
+		Targets: make(map[string][]importRecord),
+		Files:   make(map[string]*fileRecord),
+	}
+}
+
+// stateFile returns the path of the state file configured in config
+func stateFile(config FeederConfig) string {
+	if config.StateFile != "" {
+		return config.StateFile
+	}
+	return defaultStateFile
+}
+
+// loadState reads the state stored at path; an empty state is returned when
+// nothing has been imported yet.
+func loadState(path string) (*feederState, error) {
+	state := newFeederState()
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+	if state.Targets == nil {
+		state.Targets = make(map[string][]importRecord)
+	}
+	if state.Files == nil {
+		state.Files = make(map[string]*fileRecord)
+	}
+	return state, nil
+}
+
+// save writes the state to path, replacing the previous one atomically
+func (s *feederState) save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("error creating %s: %v", filepath.Dir(path), err)
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), ".state")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file: %v", err)
+	}
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return fmt.Errorf("error writing %s: %v", path, err)
+	}
+	tmpFile.Close()
+	if err := os.Rename(tmpFile.Name(), path); err != nil {
+		os.Remove(tmpFile.Name())
+		return fmt.Errorf("error writing %s: %v", path, err)
+	}
+	return nil
+}
+
+// recordImport records the import of image, out of metadataFile and tagged
+// with tags, into the named target, replacing any previous import of the same
+// image.
+func (s *feederState) recordImport(target, image, metadataFile string, tags []string, imported time.Time) {
+	s.forget(target, image)
+	s.Targets[target] = append(s.Targets[target], importRecord{
+		Image:    image,
+		Tags:     tags,
+		Imported: imported,
+		Metadata: metadataFile,
+	})
+}
+
+// recordMetadataFiles records the .metadata file of the imported images
+// found in rpmMetadata whose record lacks it, the records written before the
+// files were recorded
+func (s *feederState) recordMetadataFiles(rpmMetadata map[string]ImageType) {
+	for _, records := range s.Targets {
+		for i := range records {
+			if metadata, ok := rpmMetadata[records[i].Image]; ok && records[i].Metadata == "" {
+				records[i].Metadata = metadata.metadataFile
+			}
+		}
+	}
+}
+
+// recordImportID records id as the image produced by the import of image
+// into the named target
+func (s *feederState) recordImportID(target, image string, id ImageID) {
+	for i := range s.Targets[target] {
+		if s.Targets[target][i].Image == image {
+			s.Targets[target][i].ID = id
+		}
+	}
+}
+
+// forget removes the record of image from the named target
+func (s *feederState) forget(target, image string) {
+	records := []importRecord{}
+	for _, record := range s.Targets[target] {
+		if record.Image != image {
+			records = append(records, record)
+		}
+	}
+	s.Targets[target] = records
+}
+
+// loadFeederState loads the state file configured for the feeder. A state
+// that cannot be read is started afresh: it only spares work and prevents
+// pruning, hence it is not fatal.
+func (f *Feeder) loadFeederState() {
+	state, err := loadState(stateFile(f.config))
+	if err != nil {
+		log.Warnf("Could not load the state, starting afresh: %v", err)
+		state = newFeederState()
+	}
+	f.state = state
+}
+
+// saveFeederState writes the state of the feeder to the configured state
+// file
+func (f *Feeder) saveFeederState() {
+	if err := f.state.save(stateFile(f.config)); err != nil {
+		log.Warnf("Could not save the state: %v", err)
+	}
+}
+
+// recordImports adds the successful imports to the state of the feeder, with
+// the ID of the images they produced.
+func (f *Feeder) recordImports(ctx context.Context, imports []SuccessfulImport, rpmImageTags map[string][]string, rpmMetadata map[string]ImageType) {
+	now := time.Now()
+	for _, imported := range imports {
+		f.state.recordImport(imported.Target, imported.Image, rpmMetadata[imported.Image].metadataFile, rpmImageTags[imported.Image], now)
+	}
+
+	for _, t := range f.targets {
+		var images []string
+		for _, imported := range imports {
+			if imported.Target == t.name {
+				images = append(images, imported.Image)
+			}
+		}
+		if len(images) == 0 {
+			continue
+		}
+		present, err := f.presentImages(ctx, t)
+		if err != nil {
+			log.Warnf("Could not record the ID of the images imported into %s: %v", t.name, err)
+			continue
+		}
+		for _, image := range images {
+			f.state.recordImportID(t.name, image, present[image])
+			f.state.recordImageID(t.name, rpmMetadata[image], present[image])
+		}
+	}
+}
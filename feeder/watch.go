@@ -0,0 +1,376 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package feeder
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// WatchConfig holds the watch settings of the container-feeder.json config
+type WatchConfig struct {
+	// the time without changes inside of the directory waited for before
+	// importing the images (default: 5s)
+	Debounce Duration `json:"debounce,omitempty"`
+	// the time allowed to an image to become importable, its archive being
+	// written or its RPM being recorded, before giving up (default: 10m)
+	SettleTimeout Duration `json:"settle-timeout,omitempty"`
+}
+
+// withDefaults returns the config with the unset values replaced by the
+// defaults
+func (c WatchConfig) withDefaults() WatchConfig {
+	if c.Debounce <= 0 {
+		c.Debounce = Duration(5 * time.Second)
+	}
+	if c.SettleTimeout <= 0 {
+		c.SettleTimeout = Duration(10 * time.Minute)
+	}
+	return c
+}
+
+// imageWatcher runs imports as the files inside of the watched directories
+// change
+type imageWatcher struct {
+	config WatchConfig
+	// run imports the images affected by the changed files, all of them when
+	// changed is nil, and returns the changed files that cannot be imported
+	// yet
+	run func(ctx context.Context, changed map[string]bool) []string
+	// created, when set, is called with the files and directories created
+	// inside of the watched directories
+	created func(path string)
+}
+
+// Watch imports all the RPMs images stored inside of `dirs`, the configured
+// sources when empty, then keeps importing the images installed there until
+// ctx is done. Every import is passed to report.
+func Watch(ctx context.Context, dirs []string, report func(FeederLoadResponse)) error {
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	dirs = config.sourceDirs(dirs)
+
+	f, err := newFeeder(ctx, config)
+	if err != nil {
+		return fmt.Errorf("Error creating new feeder: %v", err)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("error watching %v: %v", dirs, err)
+	}
+	defer watcher.Close()
+	for _, dir := range dirs {
+		if err := watchDir(watcher, config, dir); err != nil {
+			return fmt.Errorf("error watching %s: %v", dir, err)
+		}
+	}
+
+	watchConfig := config.Watch.withDefaults()
+	w := imageWatcher{
+		config: watchConfig,
+		run: func(ctx context.Context, changed map[string]bool) []string {
+			res, unsettled := f.importChanged(ctx, dirs, changed)
+			if changed == nil || len(res.SuccessfulImports) > 0 || len(res.FailedImports) > 0 {
+				report(res)
+			}
+			return unsettled
+		},
+		created: func(path string) {
+			// the new subdirectories of the recursive sources are watched
+			// as well
+			if info, err := os.Stat(path); err != nil || !info.IsDir() {
+				return
+			}
+			for _, dir := range dirs {
+				if insideDir(dir, path) {
+					if err := watchDir(watcher, config, dir); err != nil {
+						log.Warnf("Error watching %s: %v", dir, err)
+					}
+				}
+			}
+		},
+	}
+	log.Infof("Watching %s", strings.Join(dirs, ", "))
+	w.watch(ctx, watcher.Events, watcher.Errors)
+	return nil
+}
+
+// watchDir adds the directory stored at path to watcher, along with its
+// subdirectories when it is a recursive source
+func watchDir(watcher *fsnotify.Watcher, config FeederConfig, path string) error {
+	walker := config.newWalker(path)
+	walker.VerifyFiles = false
+	if walker.Recursive {
+		if err := walker.Walk(); err != nil {
+			return err
+		}
+	}
+	for _, dir := range append([]string{path}, walker.Dirs...) {
+		if err := watcher.Add(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// watch imports all the images, then the ones affected by events once no
+// event has been received for the debounce time, until ctx is done
+func (w *imageWatcher) watch(ctx context.Context, events <-chan fsnotify.Event, errs <-chan error) {
+	debounce := time.Duration(w.config.Debounce)
+	settleTimeout := time.Duration(w.config.SettleTimeout)
+
+	// the changed files with the time they changed first
+	pending := make(map[string]time.Time)
+	var fire <-chan time.Time
+	for _, name := range w.run(ctx, nil) {
+		pending[name] = time.Now()
+		fire = time.After(debounce)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			// removals are left to prune
+			if event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Chmod) == 0 {
+				continue
+			}
+			log.Debugf("%s changed: %s", event.Name, event.Op)
+			name := filepath.Clean(event.Name)
+			if event.Op&fsnotify.Create != 0 && w.created != nil {
+				w.created(name)
+			}
+			if _, ok := pending[name]; !ok {
+				pending[name] = time.Now()
+			}
+			fire = time.After(debounce)
+		case err, ok := <-errs:
+			if !ok {
+				return
+			}
+			log.Warnf("Error watching the images: %v", err)
+		case <-fire:
+			fire = nil
+			changed := make(map[string]bool)
+			for name := range pending {
+				changed[name] = true
+			}
+
+			next := make(map[string]time.Time)
+			for _, name := range w.run(ctx, changed) {
+				first, ok := pending[name]
+				if !ok {
+					first = time.Now()
+				}
+				if time.Since(first) > settleTimeout {
+					log.Warnf("Giving up on %s: it could not be imported within %v", name, settleTimeout)
+					continue
+				}
+				next[name] = first
+			}
+			pending = next
+			if len(pending) > 0 {
+				fire = time.After(debounce)
+			}
+		}
+	}
+}
+
+// importChanged imports the whitelisted RPMs images stored inside of `dirs`
+// affected by the changed files, all of them when changed is nil. The changed
+// .metadata files that cannot be imported yet are returned.
+func (f *Feeder) importChanged(ctx context.Context, dirs []string, changed map[string]bool) (FeederLoadResponse, []string) {
+	if f.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(f.config.Timeout))
+		defer cancel()
+	}
+	f.loadFeederState()
+	defer f.saveFeederState()
+
+	rpmImages, rpmImageTags, rpmMetadata, conflicts, err := findRPMImages(dirs, f.state, f.config)
+	if err != nil {
+		log.Warnf("Could not look for images inside of %s: %v", strings.Join(dirs, ", "), err)
+		return FeederLoadResponse{}, changedMetadata(changed, nil)
+	}
+
+	// the conflicting images are reported once, when their .metadata file
+	// changes, and are not waited for
+	affectedConflicts := make(map[string]error)
+	conflictFiles := make(map[string]bool)
+	for repotag, err := range conflicts {
+		metadataFile := err.(conflictError).metadataFile
+		conflictFiles[metadataFile] = true
+		whitelisted, _ := isWhitelisted(repotag, f.config.Whitelist)
+		if whitelisted && (changed == nil || changed[metadataFile]) {
+			affectedConflicts[repotag] = err
+		}
+	}
+	selected, waiting := affectedImages(ctx, changed, rpmImages, rpmMetadata)
+	unsettled := []string{}
+	for _, metadataFile := range waiting {
+		if !conflictFiles[metadataFile] {
+			unsettled = append(unsettled, metadataFile)
+		}
+	}
+	images := make(map[string]string)
+	for _, repotag := range selected {
+		whitelisted, err := isWhitelisted(repotag, f.config.Whitelist)
+		if err != nil || !whitelisted {
+			log.Debugf("Image %s is not whitelisted: ignoring", repotag)
+			continue
+		}
+		images[repotag] = rpmImages[repotag]
+	}
+	if changed != nil && len(images) > 0 {
+		log.Infof("Importing the images affected by the changes: %v", sortedRepotags(images))
+	}
+	return f.importRPMImages(ctx, images, rpmImageTags, rpmMetadata, affectedConflicts), unsettled
+}
+
+// affectedImages returns the RPMs images whose .metadata file or image file
+// is among the changed files, by path, all of them when changed is nil, and
+// the .metadata files that cannot be imported yet: the ones that were not
+// found, because they could not be verified yet, and the ones whose changed
+// image file is not complete yet.
+func affectedImages(ctx context.Context, changed map[string]bool, rpmImages map[string]string, rpmMetadata map[string]ImageType) ([]string, []string) {
+	selected := []string{}
+	unsettled := []string{}
+	found := make(map[string]bool)
+
+	for repotag, file := range rpmImages {
+		metadata := rpmMetadata[repotag]
+		metadataFile := metadata.metadataFile
+		found[metadataFile] = true
+		// the changes inside of the oci layout directories are noticed
+		// through the directory itself, or through its content when it is
+		// watched as well
+		fileName := strings.SplitN(filepath.ToSlash(filepath.Clean(metadata.File)), "/", 2)[0]
+		imageFile := filepath.Join(filepath.Dir(metadataFile), fileName)
+		if changed != nil {
+			if !changed[metadataFile] && !changedWithin(changed, imageFile) {
+				continue
+			}
+			if err := settled(ctx, file, metadata); err != nil {
+				log.Infof("Image %s: %s is not complete yet: %v", repotag, file, err)
+				unsettled = append(unsettled, metadataFile)
+				continue
+			}
+		}
+		selected = append(selected, repotag)
+	}
+	unsettled = append(unsettled, changedMetadata(changed, found)...)
+
+	sort.Strings(selected)
+	sort.Strings(unsettled)
+	return selected, unsettled
+}
+
+// changedWithin returns true if the file stored at path, or one of the files
+// stored inside of it, is among the changed files
+func changedWithin(changed map[string]bool, path string) bool {
+	if changed[path] {
+		return true
+	}
+	for name := range changed {
+		if insideDir(path, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// changedMetadata returns the .metadata files among the changed files that
+// are not found
+func changedMetadata(changed map[string]bool, found map[string]bool) []string {
+	names := []string{}
+	for name := range changed {
+		if strings.ToLower(filepath.Ext(name)) == ".metadata" && !found[name] {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// settled returns an error unless the image file stored at path, described
+// by metadata, is complete: its size matches the one of its .metadata file,
+// or its checksum when its size is not specified, or it can be read to its
+// end otherwise. The modification time cannot tell: rpm restores the one of
+// the packaged file.
+func settled(ctx context.Context, path string, metadata ImageType) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		// the oci layouts are complete once their index is
+		data, err := ioutil.ReadFile(filepath.Join(path, "index.json"))
+		if err != nil {
+			return err
+		}
+		if !json.Valid(data) {
+			return fmt.Errorf("%s is not valid JSON", filepath.Join(path, "index.json"))
+		}
+		return nil
+	}
+	switch {
+	case metadata.Size > 0:
+		if info.Size() != metadata.Size {
+			return fmt.Errorf("expected %d bytes, got %d bytes", metadata.Size, info.Size())
+		}
+		return nil
+	case metadata.SHA256 != "":
+		return verifyChecksum(ctx, path, metadata)
+	}
+
+	stream, err := openDecompressed(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	tr := tar.NewReader(stream)
+	for {
+		if _, err := tr.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	// the end of the compressed stream follows the end of the tarball
+	_, err = io.Copy(ioutil.Discard, stream)
+	return err
+}
@@ -0,0 +1,202 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package feeder
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestAffectedImages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-watch")
+	if err != nil {
+		t.Fatalf("error while creating test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the modification time restored by rpm does not matter
+	old := time.Now().Add(-time.Hour)
+	for _, file := range []string{"salt-api.tar.xz", "salt-master.tar.xz", "busybox.tar.xz"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte("image"), 0644); err != nil {
+			t.Fatalf("error writing image: %v", err)
+		}
+		os.Chtimes(filepath.Join(dir, file), old, old)
+	}
+	rpmImages := map[string]string{
+		"docker.io/opensuse/salt-api:13":    filepath.Join(dir, "salt-api.tar.xz"),
+		"docker.io/opensuse/salt-master:13": filepath.Join(dir, "salt-master.tar.xz"),
+		"docker.io/library/busybox:1":       filepath.Join(dir, "busybox.tar.xz"),
+	}
+	rpmMetadata := map[string]ImageType{
+		"docker.io/opensuse/salt-api:13":    {File: "salt-api.tar.xz", Size: 5, metadataFile: filepath.Join(dir, "salt-api.metadata")},
+		"docker.io/opensuse/salt-master:13": {File: "salt-master.tar.xz", metadataFile: filepath.Join(dir, "salt-master.metadata")},
+		"docker.io/library/busybox:1":       {File: "busybox.tar.xz", Size: 10, metadataFile: filepath.Join(dir, "busybox.metadata")},
+	}
+
+	// busybox is still being written, salt-minion is not verified yet
+	changed := map[string]bool{
+		filepath.Join(dir, "salt-api.tar.xz"):      true,
+		filepath.Join(dir, "busybox.metadata"):     true,
+		filepath.Join(dir, "salt-minion.metadata"): true,
+		filepath.Join(dir, "salt-minion.tar.xz"):   true,
+	}
+	selected, unsettled := affectedImages(context.Background(), changed, rpmImages, rpmMetadata)
+	if len(selected) != 1 || selected[0] != "docker.io/opensuse/salt-api:13" {
+		t.Errorf("unexpected selected images: %v", selected)
+	}
+	if len(unsettled) != 2 || unsettled[0] != filepath.Join(dir, "busybox.metadata") || unsettled[1] != filepath.Join(dir, "salt-minion.metadata") {
+		t.Errorf("unexpected unsettled files: %v", unsettled)
+	}
+
+	selected, _ = affectedImages(context.Background(), nil, rpmImages, rpmMetadata)
+	if len(selected) != 3 {
+		t.Errorf("expected all the images to be selected, got %v", selected)
+	}
+}
+
+func TestSettled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-watch")
+	if err != nil {
+		t.Fatalf("error while creating test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// without size nor checksum, the archive has to be read to its end
+	complete := filepath.Join(dir, "complete.tar.xz")
+	writeRootfsArchive(t, complete)
+	data, err := ioutil.ReadFile(complete)
+	if err != nil {
+		t.Fatalf("error reading archive: %v", err)
+	}
+	truncated := filepath.Join(dir, "truncated.tar.xz")
+	if err := ioutil.WriteFile(truncated, data[:len(data)/2], 0644); err != nil {
+		t.Fatalf("error writing archive: %v", err)
+	}
+	checksum := fmt.Sprintf("%x", sha256.Sum256(data))
+
+	layout := filepath.Join(dir, "salt-api")
+	if err := os.Mkdir(layout, 0755); err != nil {
+		t.Fatalf("error creating dir: %v", err)
+	}
+
+	for _, test := range []struct {
+		path     string
+		metadata ImageType
+		settled  bool
+	}{
+		{complete, ImageType{}, true},
+		{truncated, ImageType{}, false},
+		{complete, ImageType{Size: int64(len(data))}, true},
+		{truncated, ImageType{Size: int64(len(data))}, false},
+		{complete, ImageType{SHA256: checksum}, true},
+		{truncated, ImageType{SHA256: checksum}, false},
+		{filepath.Join(dir, "missing.tar.xz"), ImageType{}, false},
+		{layout, ImageType{}, false},
+	} {
+		err := settled(context.Background(), test.path, test.metadata)
+		if test.settled && err != nil {
+			t.Errorf("%s %+v: unexpected error: %v", test.path, test.metadata, err)
+		} else if !test.settled && err == nil {
+			t.Errorf("%s %+v: expected not to be settled", test.path, test.metadata)
+		}
+	}
+
+	// the oci layouts are complete once their index is
+	if err := ioutil.WriteFile(filepath.Join(layout, "index.json"), []byte(`{"schemaVersion": 2`), 0644); err != nil {
+		t.Fatalf("error writing index: %v", err)
+	}
+	if err := settled(context.Background(), layout, ImageType{}); err == nil {
+		t.Error("expected the partial index not to be settled")
+	}
+	if err := ioutil.WriteFile(filepath.Join(layout, "index.json"), []byte(`{"schemaVersion": 2}`), 0644); err != nil {
+		t.Fatalf("error writing index: %v", err)
+	}
+	if err := settled(context.Background(), layout, ImageType{}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestWatchDebounce(t *testing.T) {
+	runs := make(chan map[string]bool, 10)
+	retried := false
+	w := imageWatcher{
+		config: WatchConfig{Debounce: Duration(50 * time.Millisecond), SettleTimeout: Duration(time.Minute)},
+		run: func(ctx context.Context, changed map[string]bool) []string {
+			runs <- changed
+			if changed["/images/salt-api.metadata"] && !retried {
+				retried = true
+				return []string{"/images/salt-api.metadata"}
+			}
+			return nil
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan fsnotify.Event)
+	go w.watch(ctx, events, make(chan error))
+
+	next := func() map[string]bool {
+		select {
+		case changed := <-runs:
+			return changed
+		case <-time.After(5 * time.Second):
+			t.Fatal("no import has been run")
+		}
+		return nil
+	}
+	if changed := next(); changed != nil {
+		t.Fatalf("expected all the images to be imported first, got %v", changed)
+	}
+
+	// a burst of writes triggers a single import
+	for _, event := range []fsnotify.Event{
+		{Name: "/images/salt-api.tar.xz;5a3b", Op: fsnotify.Create},
+		{Name: "/images/salt-api.tar.xz;5a3b", Op: fsnotify.Write},
+		{Name: "/images/salt-api.tar.xz", Op: fsnotify.Create},
+		{Name: "/images/salt-api.tar.xz;5a3b", Op: fsnotify.Rename},
+		{Name: "/images/salt-api.metadata", Op: fsnotify.Create},
+		{Name: "/images/salt-api-12.metadata", Op: fsnotify.Remove},
+	} {
+		events <- event
+		time.Sleep(10 * time.Millisecond)
+	}
+	changed := next()
+	if len(changed) != 3 || !changed["/images/salt-api.tar.xz"] || !changed["/images/salt-api.metadata"] {
+		t.Errorf("unexpected changed files: %v", changed)
+	}
+
+	// the files that could not be imported are retried
+	changed = next()
+	if len(changed) != 1 || !changed["/images/salt-api.metadata"] {
+		t.Errorf("unexpected changed files: %v", changed)
+	}
+	select {
+	case changed := <-runs:
+		t.Errorf("unexpected import: %v", changed)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
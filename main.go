@@ -18,9 +18,16 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/kubic-project/container-feeder/feeder"
 	log "github.com/sirupsen/logrus"
@@ -32,7 +39,7 @@ func setLogLevel(logLevel string) {
 		lvl, err := log.ParseLevel(logLevel)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Unable to parse logging level: %s\n", logLevel)
-			os.Exit(1)
+			os.Exit(exitUsage)
 		}
 		log.SetLevel(lvl)
 	} else {
@@ -40,32 +47,349 @@ func setLogLevel(logLevel string) {
 	}
 }
 
-func main() {
-	const defaultImageLocation string = "/usr/share/suse-docker-images/native"
+// The exit codes of container-feeder
+const (
+	// all the missing images have been imported
+	exitSuccess = 0
+	// nothing could be done: none of the images could be imported, the
+	// configuration is broken or container-feeder has been interrupted
+	exitFailure = 1
+	// the command line is wrong
+	exitUsage = 2
+	// some of the images could not be imported
+	exitPartialFailure = 3
+	// all the images were already in place, only told apart from
+	// exitSuccess with the json output
+	exitNothingToDo = 4
+)
+
+// the format of the import report, "text" or "json"
+var output = flag.String("output", "text", "Report the outcome of import and watch as \"text\" or \"json\"")
+
+// commands are the subcommands of container-feeder, import being the default
+var commands = []struct {
+	name  string
+	args  string
+	usage string
+	run   func(ctx context.Context, dirs []string, args []string)
+}{
+	{"import", "", "Import the missing RPM images into the container engines (default)", importImages},
+	{"list", "", "List the RPM images and their state in every container engine", listImages},
+	{"plan", "", "Show what import would do, and why, without doing it", planImports},
+	{"verify", "", "Verify the integrity of the RPM images against the RPM database", verifyImages},
+	{"watch", "", "Import the images as RPMs install them, until container-feeder is stopped", watchImages},
+	{"prune", "", "Remove the imported images whose RPM has been removed or upgraded", pruneImages},
+	{"status", "", "Summarize the state of every container engine", showStatus},
+	{"serve", "ADDRESS", "Serve the images through a read-only registry on ADDRESS (\"unix:///path\"|\"127.0.0.1:5000\")", serveImages},
+}
+
+// usage prints the subcommands and the flags
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] [command] [flags]\n\nCommands:\n", os.Args[0])
+	w := tabwriter.NewWriter(os.Stderr, 0, 8, 2, ' ', 0)
+	for _, command := range commands {
+		fmt.Fprintf(w, "  %s %s\t%s\n", command.name, command.args, command.usage)
+	}
+	w.Flush()
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// dirList is a flag accepting several directories, one per occurrence
+type dirList []string
+
+func (d *dirList) String() string {
+	return strings.Join(*d, ",")
+}
+
+func (d *dirList) Set(dir string) error {
+	*d = append(*d, dir)
+	return nil
+}
 
-	var dir = flag.String("dir", defaultImageLocation, "Import container images from this directory")
+func main() {
+	var dirs dirList
+	flag.Var(&dirs, "dir", "Import container images from this directory, can be repeated (default: the sources of the config, or /usr/share/suse-docker-images/native)")
 	var logLevel = flag.String("log-level", "info", "Set the logging level (\"debug\"|\"info\"|\"warn\"|\"error\"|\"fatal\")")
+	var serve = flag.String("serve", "", "Same as the serve command")
+	var prune = flag.Bool("prune", false, "Same as the prune command")
+	flag.Usage = usage
 	flag.Parse()
 
+	// the flags are accepted after the command as well
+	name := "import"
+	args := flag.Args()
+	if len(args) > 0 {
+		name = args[0]
+		flag.CommandLine.Parse(args[1:])
+		args = flag.Args()
+	} else if *serve != "" {
+		name, args = "serve", []string{*serve}
+	} else if *prune {
+		name = "prune"
+	}
+
 	setLogLevel(*logLevel)
+	if *output != "text" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "Unknown output format: %s\n", *output)
+		os.Exit(exitUsage)
+	}
+	if *output == "json" && name != "import" && name != "watch" {
+		fmt.Fprintf(os.Stderr, "Only import and watch support the json output\n")
+		os.Exit(exitUsage)
+	}
+
+	// stop cleanly, removing the temporary files, when systemd stops us
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Warnf("Received %s: stopping", sig)
+		cancel()
+	}()
+
+	for _, command := range commands {
+		if command.name != name {
+			continue
+		}
+		expected := len(strings.Fields(command.args))
+		if len(args) != expected {
+			fmt.Fprintf(os.Stderr, "Wrong number of arguments for %s\n", name)
+			usage()
+			os.Exit(exitUsage)
+		}
+		command.run(ctx, dirs, args)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command: %s\n", name)
+	usage()
+	os.Exit(exitUsage)
+}
 
-	importResp, err := feeder.Import(*dir)
+// importImages imports the missing images, reports the outcome and exits
+// with the code matching it
+func importImages(ctx context.Context, dirs []string, args []string) {
+	importResp, err := feeder.Import(ctx, dirs)
+	if *output == "json" {
+		printImportReport(importResp, err)
+	}
 	if err != nil {
 		log.Errorf("Something went wrong while importing the images: %v\n", err)
-		os.Exit(1)
+		os.Exit(exitFailure)
+	}
+	logImportResponse(importResp)
+
+	if ctx.Err() != nil {
+		log.Error("The import has been interrupted")
+		os.Exit(exitFailure)
+	}
+
+	switch importResp.Result() {
+	case feeder.ResultFailure:
+		os.Exit(exitFailure)
+	case feeder.ResultPartialFailure:
+		os.Exit(exitPartialFailure)
+	case feeder.ResultNothingToDo:
+		log.Info("All the images are up to date")
+		if *output == "json" {
+			os.Exit(exitNothingToDo)
+		}
 	}
+	os.Exit(exitSuccess)
+}
+
+// watchImages imports the images as they are installed, reporting every
+// import, until container-feeder is stopped
+func watchImages(ctx context.Context, dirs []string, args []string) {
+	err := feeder.Watch(ctx, dirs, func(importResp feeder.FeederLoadResponse) {
+		if *output == "json" {
+			printImportReport(importResp, nil)
+		}
+		logImportResponse(importResp)
+	})
+	if err != nil {
+		log.Errorf("Something went wrong while watching the images: %v\n", err)
+		os.Exit(exitFailure)
+	}
+}
 
+// logImportResponse logs the images imported and the ones that failed
+func logImportResponse(importResp feeder.FeederLoadResponse) {
 	if len(importResp.SuccessfulImports) > 0 {
 		log.Info("Successfully imported the following images:")
 	}
 	for _, image := range importResp.SuccessfulImports {
-		log.Infof("  - %s", image)
+		log.Infof("  - %s into %s", image.Image, image.Target)
 	}
 
 	if len(importResp.FailedImports) > 0 {
 		log.Error("The following images failed to be imported:")
 	}
 	for _, failedImport := range importResp.FailedImports {
-		log.Errorf("  - %s with error: %v", failedImport.Image, failedImport.Error)
+		log.Errorf("  - %s into %s with error: %v", failedImport.Image, failedImport.Target, failedImport.Error)
+	}
+}
+
+// printImportReport prints the JSON report of an import on a single line
+func printImportReport(importResp feeder.FeederLoadResponse, err error) {
+	if err := json.NewEncoder(os.Stdout).Encode(feeder.NewImportReport(importResp, err)); err != nil {
+		log.Errorf("Could not print the report: %v", err)
+	}
+}
+
+// serveImages serves the images until container-feeder is stopped
+func serveImages(ctx context.Context, dirs []string, args []string) {
+	if err := feeder.Serve(ctx, dirs, args[0]); err != nil {
+		log.Errorf("Something went wrong while serving the images: %v\n", err)
+		os.Exit(exitFailure)
+	}
+}
+
+// listImages prints the RPM images and their state in every target
+func listImages(ctx context.Context, dirs []string, args []string) {
+	listResp, err := feeder.List(ctx, dirs)
+	if err != nil {
+		log.Errorf("Something went wrong while listing the images: %v\n", err)
+		os.Exit(exitFailure)
+	}
+	reportFailedTargets(listResp.FailedTargets)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "IMAGE\tTAGS\tPACKAGE\tTARGET\tSTATE")
+	for _, image := range listResp.Images {
+		for _, state := range image.Targets {
+			description := state.State
+			if state.Reason != "" {
+				description += ": " + state.Reason
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", image.Image, tags(image.Tags), orNone(image.Package), state.Target, description)
+		}
+	}
+	w.Flush()
+}
+
+// planImports prints the imports import would perform
+func planImports(ctx context.Context, dirs []string, args []string) {
+	planResp, err := feeder.Plan(ctx, dirs)
+	if err != nil {
+		log.Errorf("Something went wrong while planning the imports: %v\n", err)
+		os.Exit(exitFailure)
+	}
+	reportFailedTargets(planResp.FailedTargets)
+
+	if len(planResp.PlannedImports) == 0 {
+		fmt.Println("Nothing to import")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "IMAGE\tTAGS\tTARGET\tREASON")
+	for _, planned := range planResp.PlannedImports {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", planned.Image, tags(planned.Tags), planned.Target, planned.Reason)
+	}
+	w.Flush()
+}
+
+// verifyImages prints the outcome of the verification of every image and
+// exits with an error if one of them failed
+func verifyImages(ctx context.Context, dirs []string, args []string) {
+	verifyResp, err := feeder.Verify(ctx, dirs)
+	if err != nil {
+		log.Errorf("Something went wrong while verifying the images: %v\n", err)
+		os.Exit(exitFailure)
+	}
+
+	failed := false
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "METADATA\tIMAGE\tPACKAGE\tRESULT")
+	for _, file := range verifyResp.Files {
+		result := "ok"
+		if file.Error != nil {
+			result = fmt.Sprintf("failed: %v", file.Error)
+			failed = true
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", file.Metadata, orNone(file.Image), orNone(file.Package), result)
+	}
+	w.Flush()
+	if failed {
+		os.Exit(exitFailure)
+	}
+}
+
+// showStatus prints the summary of every target
+func showStatus(ctx context.Context, dirs []string, args []string) {
+	statusResp, err := feeder.Status(ctx, dirs)
+	if err != nil {
+		log.Errorf("Something went wrong while computing the status: %v\n", err)
+		os.Exit(exitFailure)
+	}
+
+	fmt.Printf("State file: %s (%d files recorded)\n\n", statusResp.StateFile, statusResp.Files)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TARGET\tREACHABLE\tIMAGES\tIMPORTED\tPENDING\tSTALE\tLAST IMPORT")
+	for _, status := range statusResp.Targets {
+		if status.Error != nil {
+			fmt.Fprintf(w, "%s\tno: %v\t-\t%d\t-\t%d\t%s\n", status.Target, status.Error, status.Imported, status.Stale, lastImport(status.LastImport))
+			continue
+		}
+		fmt.Fprintf(w, "%s\tyes\t%d\t%d\t%d\t%d\t%s\n", status.Target, status.Images, status.Imported, status.Pending, status.Stale, lastImport(status.LastImport))
+	}
+	w.Flush()
+}
+
+// reportFailedTargets logs the targets that could not be inspected
+func reportFailedTargets(failed []feeder.FailedTarget) {
+	for _, failedTarget := range failed {
+		log.Warnf("Could not inspect %s: %v", failedTarget.Target, failedTarget.Error)
+	}
+}
+
+// tags joins tags, or returns "-" when there are none
+func tags(tags []string) string {
+	return orNone(strings.Join(tags, ","))
+}
+
+// orNone returns s, or "-" when s is empty
+func orNone(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// lastImport formats the time of the last import
+func lastImport(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// pruneImages removes the stale images and reports the outcome
+func pruneImages(ctx context.Context, dirs []string, args []string) {
+	pruneResp, err := feeder.Prune(ctx, dirs)
+	if err != nil {
+		log.Errorf("Something went wrong while pruning the images: %v\n", err)
+		os.Exit(exitFailure)
+	}
+
+	if len(pruneResp.PrunedImages) > 0 {
+		log.Info("Successfully pruned the following images:")
+	}
+	for _, image := range pruneResp.PrunedImages {
+		log.Infof("  - %s from %s", image.Image, image.Target)
+	}
+
+	if len(pruneResp.FailedPrunes) > 0 {
+		log.Error("The following images failed to be pruned:")
+	}
+	for _, failedPrune := range pruneResp.FailedPrunes {
+		log.Errorf("  - %s from %s with error: %v", failedPrune.Image, failedPrune.Target, failedPrune.Error)
+	}
+
+	if ctx.Err() != nil {
+		log.Error("The pruning has been interrupted")
+		os.Exit(exitFailure)
 	}
 }
@@ -61,6 +61,7 @@ Source:         ${SAFE_BRANCH}.tar.gz
 Source1:        sysconfig.%{name}
 Source2:        %{name}.service
 Source3:        %{name}-rpmlintrc
+Source4:        %{name}-watch.service
 BuildRoot:      %{_tmppath}/%{name}-%{version}-build
 BuildRequires:  device-mapper-devel
 BuildRequires:  fdupes
@@ -104,17 +105,17 @@ go build -tags "containers_image_ostree_stub seccomp apparmor" \
          main.go
 
 %pre
-%service_add_pre %{name}.service
+%service_add_pre %{name}.service %{name}-watch.service
 
 %post
-%service_add_post %{name}.service
+%service_add_post %{name}.service %{name}-watch.service
 %fillup_only -n %{name}
 
 %preun
-%service_del_preun %{name}.service
+%service_del_preun %{name}.service %{name}-watch.service
 
 %postun
-%service_del_postun %{name}.service
+%service_del_postun %{name}.service %{name}-watch.service
 
 %install
 cd \$HOME/go/src/%{import_path}
@@ -126,6 +127,7 @@ install -D -m 0644 %{SOURCE1} %{buildroot}/%{_fillupdir}
 
 mkdir -p %{buildroot}/%{_unitdir}
 install -D -m 0644 %{SOURCE2} %{buildroot}/%{_unitdir}/
+install -D -m 0644 %{SOURCE4} %{buildroot}/%{_unitdir}/
 mkdir -p %{buildroot}/%{_sbindir}
 ln -s %{_sbindir}/service %{buildroot}/%{_sbindir}/rc%{name}
 
@@ -141,6 +143,7 @@ ln -s %{_sbindir}/service %{buildroot}/%{_sbindir}/rc%{name}
 %{_bindir}/%{name}
 %{_sbindir}/rc%{name}
 %{_unitdir}/%{name}.service
+%{_unitdir}/%{name}-watch.service
 %{_fillupdir}/sysconfig.%{name}
 %config(noreplace) %{_sysconfdir}/container-feeder.json
 
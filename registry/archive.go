@@ -0,0 +1,274 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registry
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/containers/image/docker/tarfile"
+	"github.com/containers/image/manifest"
+	"github.com/containers/image/pkg/compression"
+	"github.com/opencontainers/go-digest"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// the name of the file listing the images of a docker-archive
+const manifestFileName = "manifest.json"
+
+// blob is a file stored inside of an archive
+type blob struct {
+	entry string
+	// the offset of the content of the file inside of the tarball
+	offset int64
+	size   int64
+}
+
+// archiveIndex is what an archive holds, as found while indexing it
+type archiveIndex struct {
+	// the size and the modification time of the archive when it has been
+	// indexed
+	size    int64
+	modTime time.Time
+	// the tarball the blobs are read from: the archive itself, or its
+	// decompressed copy when it is compressed
+	tarball        string
+	manifest       []byte
+	manifestDigest digest.Digest
+	blobs          map[digest.Digest]blob
+}
+
+// archive is a docker-archive, compressed or not. The archive is indexed the
+// first time one of its manifests or blobs is requested, and again once it
+// changed. Compressed archives are decompressed once, while being indexed,
+// into a temporary file the blobs are then read from.
+type archive struct {
+	file string
+
+	mu      sync.Mutex
+	indexed *archiveIndex
+}
+
+// index returns the index of the archive, reading the whole archive unless
+// its size and modification time did not change since it has been indexed.
+// Failures are not kept: the next request indexes the archive again.
+func (a *archive) index() (*archiveIndex, error) {
+	info, err := os.Stat(a.file)
+	if err != nil {
+		return nil, fmt.Errorf("error indexing %s: %v", a.file, err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.indexed != nil && a.indexed.size == info.Size() && a.indexed.modTime.Equal(info.ModTime()) {
+		return a.indexed, nil
+	}
+
+	log.Debugf("Indexing %s", a.file)
+	index, err := indexArchive(a.file)
+	if err != nil {
+		return nil, fmt.Errorf("error indexing %s: %v", a.file, err)
+	}
+	index.size, index.modTime = info.Size(), info.ModTime()
+	a.release()
+	a.indexed = index
+	return index, nil
+}
+
+// release removes the decompressed copy of the archive, if any. The caller
+// must hold the lock of the archive.
+func (a *archive) release() {
+	if a.indexed != nil && a.indexed.tarball != a.file {
+		os.Remove(a.indexed.tarball)
+	}
+	a.indexed = nil
+}
+
+// countingReader counts the bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// indexArchive reads the whole archive stored at file, computing the digest
+// and the offset of every file and generating the schema 2 manifest of the
+// image
+func indexArchive(file string) (*archiveIndex, error) {
+	a := &archiveIndex{tarball: file}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stream, compressed, err := compression.AutoDecompress(f)
+	if err != nil {
+		return nil, err
+	}
+	if compressed {
+		tmpFile, err := ioutil.TempFile("/var/tmp", "container-feeder")
+		if err != nil {
+			return nil, fmt.Errorf("error creating temporary file: %v", err)
+		}
+		defer tmpFile.Close()
+		a.tarball = tmpFile.Name()
+		stream = io.TeeReader(stream, tmpFile)
+	}
+	if err := a.read(stream); err != nil {
+		if compressed {
+			os.Remove(a.tarball)
+		}
+		return nil, err
+	}
+	return a, nil
+}
+
+// read indexes the tarball streamed by stream
+func (a *archiveIndex) read(stream io.Reader) error {
+	counter := &countingReader{r: stream}
+	entries := make(map[string]blob)
+	digests := make(map[string]digest.Digest)
+	links := make(map[string]string)
+	var tarManifest, config []byte
+	jsonFiles := make(map[string][]byte)
+
+	tr := tar.NewReader(counter)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean(hdr.Name)
+
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			links[name] = path.Join(path.Dir(name), hdr.Linkname)
+		case tar.TypeReg, tar.TypeRegA:
+			// the content of the file follows its header
+			offset := counter.n
+			digester := digest.Canonical.Digester()
+			var reader io.Reader = io.TeeReader(tr, digester.Hash())
+			if path.Ext(name) == ".json" {
+				data, err := ioutil.ReadAll(reader)
+				if err != nil {
+					return err
+				}
+				jsonFiles[name] = data
+			} else if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+				return err
+			}
+			entries[name] = blob{entry: name, offset: offset, size: hdr.Size}
+			digests[name] = digester.Digest()
+		}
+	}
+
+	// docker save stores layers shared by multiple images only once and
+	// links them
+	lookup := func(name string) (blob, digest.Digest, error) {
+		name = path.Clean(name)
+		if target, ok := links[name]; ok {
+			name = target
+		}
+		b, ok := entries[name]
+		if !ok {
+			return blob{}, "", fmt.Errorf("file %s not found in the archive", name)
+		}
+		return b, digests[name], nil
+	}
+
+	tarManifest, ok := jsonFiles[manifestFileName]
+	if !ok {
+		return fmt.Errorf("%s not found in the archive", manifestFileName)
+	}
+	var items []tarfile.ManifestItem
+	if err := json.Unmarshal(tarManifest, &items); err != nil {
+		return fmt.Errorf("error parsing %s: %v", manifestFileName, err)
+	}
+	if len(items) == 0 {
+		return fmt.Errorf("%s does not list any image", manifestFileName)
+	}
+	// like `docker load`, only the first image is taken into account
+	item := items[0]
+
+	a.blobs = make(map[digest.Digest]blob)
+
+	configBlob, configDigest, err := lookup(item.Config)
+	if err != nil {
+		return err
+	}
+	config = jsonFiles[configBlob.entry]
+	a.blobs[configDigest] = configBlob
+
+	layers := []manifest.Schema2Descriptor{}
+	for _, layer := range item.Layers {
+		layerBlob, layerDigest, err := lookup(layer)
+		if err != nil {
+			return err
+		}
+		a.blobs[layerDigest] = layerBlob
+		// like containers/image, uncompressed layers are announced with
+		// the generic layer type: clients detect the compression
+		layers = append(layers, manifest.Schema2Descriptor{
+			MediaType: manifest.DockerV2Schema2LayerMediaType,
+			Size:      layerBlob.size,
+			Digest:    layerDigest,
+		})
+	}
+
+	m := manifest.Schema2FromComponents(manifest.Schema2Descriptor{
+		MediaType: manifest.DockerV2Schema2ConfigMediaType,
+		Size:      int64(len(config)),
+		Digest:    configDigest,
+	}, layers)
+	a.manifest, err = m.Serialize()
+	if err != nil {
+		return err
+	}
+	a.manifestDigest = digest.FromBytes(a.manifest)
+
+	return nil
+}
+
+// copyBlob writes the content of b, found in the tarball of index, to w
+func copyBlob(w io.Writer, index *archiveIndex, b blob) error {
+	file, err := os.Open(index.tarball)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(w, io.NewSectionReader(file, b.offset, b.size))
+	return err
+}
@@ -0,0 +1,298 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/containers/image/manifest"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/api/v2"
+	"github.com/gorilla/mux"
+	"github.com/opencontainers/go-digest"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Image is a docker-archive, shipped by an RPM, to be served by the registry
+type Image struct {
+	Name string   // the normalized repository name, eg: docker.io/opensuse/salt-api
+	Tags []string // the tags of the image, eg: 13, latest
+	File string   // the full path to the archive
+}
+
+// Server is a read-only Docker Registry v2 serving images straight out of
+// their archives.
+type Server struct {
+	// the tags of every repository, keyed by the familiar repository name
+	repositories map[string]map[string]*archive
+	router       *mux.Router
+}
+
+// NewServer returns a Server exposing the specified images. Archives are
+// only read when a client asks for one of their manifests or blobs. The
+// server has to be closed once done.
+func NewServer(images []Image) (*Server, error) {
+	s := &Server{
+		repositories: make(map[string]map[string]*archive),
+	}
+
+	archives := make(map[string]*archive)
+	for _, image := range images {
+		named, err := reference.ParseNormalizedNamed(image.Name)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing image name '%s': %v", image.Name, err)
+		}
+		name := reference.FamiliarName(named)
+
+		a, ok := archives[image.File]
+		if !ok {
+			a = &archive{file: image.File}
+			archives[image.File] = a
+		}
+
+		if _, ok := s.repositories[name]; !ok {
+			s.repositories[name] = make(map[string]*archive)
+		}
+		for _, tag := range image.Tags {
+			s.repositories[name][tag] = a
+		}
+	}
+
+	s.router = v2.Router()
+	s.router.GetRoute(v2.RouteNameBase).Handler(readOnly(s.base))
+	s.router.GetRoute(v2.RouteNameCatalog).Handler(readOnly(s.catalog))
+	s.router.GetRoute(v2.RouteNameTags).Handler(readOnly(s.tags))
+	s.router.GetRoute(v2.RouteNameManifest).Handler(readOnly(s.manifest))
+	s.router.GetRoute(v2.RouteNameBlob).Handler(readOnly(s.blob))
+	s.router.GetRoute(v2.RouteNameBlobUpload).Handler(readOnly(nil))
+	s.router.GetRoute(v2.RouteNameBlobUploadChunk).Handler(readOnly(nil))
+
+	return s, nil
+}
+
+// Close removes the decompressed copies of the archives served by s
+func (s *Server) Close() {
+	for _, repository := range s.repositories {
+		for _, a := range repository {
+			a.mu.Lock()
+			a.release()
+			a.mu.Unlock()
+		}
+	}
+}
+
+// Listen returns a listener for address, which is either a unix socket in
+// the form "unix:///path/to/socket" or a "<host>:<port>" pair where host must
+// be a loopback address.
+func Listen(address string) (net.Listener, error) {
+	if strings.HasPrefix(address, "unix://") {
+		path := strings.TrimPrefix(address, "unix://")
+		// remove the socket left behind by a previous run
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return net.Listen("unix", path)
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing address '%s': %v", address, err)
+	}
+	if host != "localhost" {
+		ip := net.ParseIP(host)
+		if ip == nil || !ip.IsLoopback() {
+			return nil, fmt.Errorf("refusing to listen on '%s': only loopback addresses are allowed", address)
+		}
+	}
+	return net.Listen("tcp", address)
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Debugf("%s %s", r.Method, r.URL.Path)
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	s.router.ServeHTTP(w, r)
+}
+
+// readOnly only lets GET and HEAD requests reach the handler. A nil handler
+// refuses every request.
+func readOnly(handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if handler == nil || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+			serveError(w, errcode.ErrorCodeUnsupported.WithMessage("the registry is read-only"))
+			return
+		}
+		handler(w, r)
+	})
+}
+
+// serveError writes err in the JSON envelope of the registry API
+func serveError(w http.ResponseWriter, err error) {
+	if err := errcode.ServeJSON(w, err); err != nil {
+		log.Warnf("Could not write error response: %v", err)
+	}
+}
+
+// serveJSON writes v as a JSON response
+func serveJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write(data)
+}
+
+// base answers the API version check
+func (s *Server) base(w http.ResponseWriter, r *http.Request) {
+	serveJSON(w, r, struct{}{})
+}
+
+// catalog lists the repositories
+func (s *Server) catalog(w http.ResponseWriter, r *http.Request) {
+	names := []string{}
+	for name := range s.repositories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	serveJSON(w, r, struct {
+		Repositories []string `json:"repositories"`
+	}{names})
+}
+
+// tags lists the tags of a repository
+func (s *Server) tags(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	repository, ok := s.repositories[name]
+	if !ok {
+		serveError(w, v2.ErrorCodeNameUnknown.WithDetail(map[string]string{"name": name}))
+		return
+	}
+
+	tags := []string{}
+	for tag := range repository {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	serveJSON(w, r, struct {
+		Name string   `json:"name"`
+		Tags []string `json:"tags"`
+	}{name, tags})
+}
+
+// manifest serves the manifest of an image, either by tag or by digest
+func (s *Server) manifest(w http.ResponseWriter, r *http.Request) {
+	name, ref := mux.Vars(r)["name"], mux.Vars(r)["reference"]
+	repository, ok := s.repositories[name]
+	if !ok {
+		serveError(w, v2.ErrorCodeNameUnknown.WithDetail(map[string]string{"name": name}))
+		return
+	}
+
+	var found *archiveIndex
+	if dgst, err := digest.Parse(ref); err == nil {
+		for _, a := range repository {
+			index, err := a.index()
+			if err != nil {
+				serveError(w, err)
+				return
+			}
+			if index.manifestDigest == dgst {
+				found = index
+				break
+			}
+		}
+	} else if a, ok := repository[ref]; ok {
+		index, err := a.index()
+		if err != nil {
+			serveError(w, err)
+			return
+		}
+		found = index
+	}
+	if found == nil {
+		serveError(w, v2.ErrorCodeManifestUnknown.WithDetail(map[string]string{"name": name, "reference": ref}))
+		return
+	}
+
+	w.Header().Set("Content-Type", manifest.DockerV2Schema2MediaType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(found.manifest)))
+	w.Header().Set("Docker-Content-Digest", found.manifestDigest.String())
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write(found.manifest)
+}
+
+// blob streams a config or layer blob out of the archive containing it
+func (s *Server) blob(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	repository, ok := s.repositories[name]
+	if !ok {
+		serveError(w, v2.ErrorCodeNameUnknown.WithDetail(map[string]string{"name": name}))
+		return
+	}
+	dgst, err := digest.Parse(mux.Vars(r)["digest"])
+	if err != nil {
+		serveError(w, v2.ErrorCodeDigestInvalid.WithDetail(err.Error()))
+		return
+	}
+
+	for _, a := range repository {
+		index, err := a.index()
+		if err != nil {
+			serveError(w, err)
+			return
+		}
+		b, ok := index.blobs[dgst]
+		if !ok {
+			continue
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(b.size, 10))
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		if r.Method == http.MethodHead {
+			return
+		}
+		if err := copyBlob(w, index, b); err != nil {
+			// the headers are gone already, the client will notice the
+			// short read
+			log.Warnf("Could not serve blob %s from %s: %v", dgst, a.file, err)
+		}
+		return
+	}
+
+	serveError(w, v2.ErrorCodeBlobUnknown.WithDetail(dgst))
+}
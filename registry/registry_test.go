@@ -0,0 +1,238 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registry
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containers/image/manifest"
+	"github.com/opencontainers/go-digest"
+	"github.com/ulikunitz/xz"
+)
+
+var (
+	testConfig = []byte(`{"architecture":"amd64","os":"linux","rootfs":{"type":"layers","diff_ids":[]}}`)
+	testLayer  = []byte("not really a tar layer")
+)
+
+// writeTestArchive writes a docker-archive compressed with xz, holding layer
+func writeTestArchive(t *testing.T, file string, layer []byte) {
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatalf("error creating archive: %v", err)
+	}
+	defer f.Close()
+
+	xw, err := xz.NewWriter(f)
+	if err != nil {
+		t.Fatalf("error creating xz writer: %v", err)
+	}
+	defer xw.Close()
+
+	tw := tar.NewWriter(xw)
+	defer tw.Close()
+
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{"abcdef.json", testConfig},
+		{"0123/layer.tar", layer},
+		{"manifest.json", []byte(`[{"Config":"abcdef.json","RepoTags":["opensuse/salt-api:13"],"Layers":["0123/layer.tar"]}]`)},
+	}
+	for _, file := range files {
+		hdr := &tar.Header{Name: file.name, Mode: 0644, Size: int64(len(file.data)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("error writing archive: %v", err)
+		}
+		if _, err := tw.Write(file.data); err != nil {
+			t.Fatalf("error writing archive: %v", err)
+		}
+	}
+}
+
+func get(t *testing.T, url string) (*http.Response, []byte) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("error requesting %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("error reading %s: %v", url, err)
+	}
+	return resp, body
+}
+
+func TestServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-registry")
+	if err != nil {
+		t.Fatalf("error while creating test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "salt-api.tar.xz")
+	writeTestArchive(t, file, testLayer)
+
+	s, err := NewServer([]Image{{
+		Name: "docker.io/opensuse/salt-api",
+		Tags: []string{"13", "latest"},
+		File: file,
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer s.Close()
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	resp, body := get(t, ts.URL+"/v2/_catalog")
+	if resp.StatusCode != http.StatusOK || string(body) != `{"repositories":["opensuse/salt-api"]}` {
+		t.Errorf("unexpected catalog: %d %s", resp.StatusCode, body)
+	}
+
+	resp, body = get(t, ts.URL+"/v2/opensuse/salt-api/tags/list")
+	if resp.StatusCode != http.StatusOK || string(body) != `{"name":"opensuse/salt-api","tags":["13","latest"]}` {
+		t.Errorf("unexpected tags: %d %s", resp.StatusCode, body)
+	}
+
+	resp, body = get(t, ts.URL+"/v2/opensuse/salt-api/manifests/latest")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %d %s", resp.StatusCode, body)
+	}
+	if resp.Header.Get("Docker-Content-Digest") != digest.FromBytes(body).String() {
+		t.Errorf("unexpected manifest digest: %s", resp.Header.Get("Docker-Content-Digest"))
+	}
+	var m manifest.Schema2
+	if err := json.Unmarshal(body, &m); err != nil {
+		t.Fatalf("error parsing manifest: %v", err)
+	}
+	if m.ConfigDescriptor.Digest != digest.FromBytes(testConfig) {
+		t.Errorf("unexpected config digest: %s", m.ConfigDescriptor.Digest)
+	}
+	if len(m.LayersDescriptors) != 1 || m.LayersDescriptors[0].Digest != digest.FromBytes(testLayer) {
+		t.Errorf("unexpected layers: %+v", m.LayersDescriptors)
+	}
+
+	resp, body = get(t, ts.URL+"/v2/opensuse/salt-api/manifests/"+resp.Header.Get("Docker-Content-Digest"))
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("unexpected status fetching manifest by digest: %d %s", resp.StatusCode, body)
+	}
+
+	resp, body = get(t, ts.URL+"/v2/opensuse/salt-api/blobs/"+digest.FromBytes(testLayer).String())
+	if resp.StatusCode != http.StatusOK || string(body) != string(testLayer) {
+		t.Errorf("unexpected layer: %d %s", resp.StatusCode, body)
+	}
+
+	resp, _ = get(t, ts.URL+"/v2/opensuse/salt-api/manifests/14")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unexpected status for unknown tag: %d", resp.StatusCode)
+	}
+
+	resp, _ = get(t, ts.URL+"/v2/opensuse/unknown/tags/list")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unexpected status for unknown repository: %d", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/v2/opensuse/salt-api/manifests/latest", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusAccepted {
+		t.Errorf("unexpected status for DELETE: %d", resp.StatusCode)
+	}
+}
+
+func TestServerReindex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-registry")
+	if err != nil {
+		t.Fatalf("error while creating test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "salt-api.tar.xz")
+	s, err := NewServer([]Image{{Name: "docker.io/opensuse/salt-api", Tags: []string{"13"}, File: file}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	// the failure to index a missing archive is not kept
+	if resp, _ := get(t, ts.URL+"/v2/opensuse/salt-api/manifests/13"); resp.StatusCode == http.StatusOK {
+		t.Errorf("unexpected status for missing archive: %d", resp.StatusCode)
+	}
+	writeTestArchive(t, file, testLayer)
+	resp, body := get(t, ts.URL+"/v2/opensuse/salt-api/blobs/"+digest.FromBytes(testLayer).String())
+	if resp.StatusCode != http.StatusOK || string(body) != string(testLayer) {
+		t.Errorf("unexpected layer: %d %s", resp.StatusCode, body)
+	}
+
+	// the blobs are read from the decompressed copy of the archive
+	a := s.repositories["opensuse/salt-api"]["13"]
+	tarball := a.indexed.tarball
+	if tarball == file {
+		t.Fatalf("expected a decompressed copy of %s", file)
+	}
+	if _, err := os.Stat(tarball); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// the archive is indexed again once it changed
+	newLayer := []byte("another layer")
+	writeTestArchive(t, file, newLayer)
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(file, later, later); err != nil {
+		t.Fatalf("error touching archive: %v", err)
+	}
+	resp, body = get(t, ts.URL+"/v2/opensuse/salt-api/blobs/"+digest.FromBytes(newLayer).String())
+	if resp.StatusCode != http.StatusOK || string(body) != string(newLayer) {
+		t.Errorf("unexpected layer: %d %s", resp.StatusCode, body)
+	}
+	if _, err := os.Stat(tarball); !os.IsNotExist(err) {
+		t.Errorf("the previous copy %s has not been removed", tarball)
+	}
+
+	tarball = a.indexed.tarball
+	s.Close()
+	if _, err := os.Stat(tarball); !os.IsNotExist(err) {
+		t.Errorf("the copy %s has not been removed", tarball)
+	}
+}
+
+func TestListen(t *testing.T) {
+	if _, err := Listen("192.0.2.1:5000"); err == nil {
+		t.Error("error expected but not received")
+	}
+
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	l.Close()
+}
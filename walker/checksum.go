@@ -0,0 +1,117 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package walker
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// checksumMetadata is the part of a .metadata file describing its image file
+type checksumMetadata struct {
+	Image struct {
+		File   string `json:"file"`
+		SHA256 string `json:"sha256"`
+		Size   int64  `json:"size"`
+	} `json:"image"`
+}
+
+// checksum is the expected content of an image file
+type checksum struct {
+	sha256 string
+	size   int64
+}
+
+// ChecksumVerifier verifies the image files against the sha256 checksum of
+// the .metadata files referencing them. The .metadata files are trusted as
+// they are, provided they describe the checksum of their image file: they
+// have to be verified before their image file.
+type ChecksumVerifier struct {
+	cache fileCache
+
+	mu sync.Mutex
+	// the checksums of the image files, by path
+	checksums map[string]checksum
+}
+
+func NewChecksumVerifier() *ChecksumVerifier {
+	return &ChecksumVerifier{checksums: make(map[string]checksum)}
+}
+
+// Verify checks that the .metadata file stored at path describes the checksum
+// of its image file, or that the image file stored at path matches the
+// checksum of its .metadata file. The package shipping the files is never
+// known.
+func (v *ChecksumVerifier) Verify(path string) (string, error) {
+	if strings.ToLower(filepath.Ext(path)) == ".metadata" {
+		return "", v.readMetadata(path)
+	}
+	return v.cache.verify(path, v.checkFile)
+}
+
+// readMetadata records the checksum described by the .metadata file stored
+// at path
+func (v *ChecksumVerifier) readMetadata(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return &VerificationError{File: path, Reason: ReasonUnreadable, Err: err}
+	}
+	var metadata checksumMetadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return &VerificationError{File: path, Reason: ReasonUnreadable, Err: err}
+	}
+	if metadata.Image.SHA256 == "" {
+		return &VerificationError{File: path, Reason: ReasonNoChecksum}
+	}
+
+	image, err := filepath.Abs(filepath.Join(filepath.Dir(path), metadata.Image.File))
+	if err != nil {
+		return &VerificationError{File: path, Reason: ReasonUnreadable, Err: err}
+	}
+	expected := checksum{sha256: metadata.Image.SHA256, size: metadata.Image.Size}
+
+	v.mu.Lock()
+	previous, ok := v.checksums[image]
+	v.checksums[image] = expected
+	v.mu.Unlock()
+	// the image file has to match the new checksum
+	if ok && previous != expected {
+		v.cache.forget(image)
+	}
+	return nil
+}
+
+// checkFile compares the image file stored at path with its checksum
+func (v *ChecksumVerifier) checkFile(path string) (string, error) {
+	v.mu.Lock()
+	expected, ok := v.checksums[path]
+	v.mu.Unlock()
+	if !ok {
+		return "", &VerificationError{File: path, Reason: ReasonNoChecksum}
+	}
+
+	size := expected.size
+	if size == 0 {
+		size = -1
+	}
+	return "", verifyDigest(path, "", size, expected.sha256, sha256.New)
+}
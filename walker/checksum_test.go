@@ -0,0 +1,113 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package walker
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChecksumVerifier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-checksum")
+	if err != nil {
+		t.Fatalf("error while creating test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	checksum := fmt.Sprintf("%x", sha256.Sum256([]byte("image")))
+	for file, content := range map[string]string{
+		"salt-api.metadata":   fmt.Sprintf(`{"image": {"file": "salt-api.tar.xz", "sha256": "%s", "size": 5}}`, checksum),
+		"salt-api.tar.xz":     "image",
+		"tampered.metadata":   fmt.Sprintf(`{"image": {"file": "tampered.tar.xz", "sha256": "%s"}}`, checksum),
+		"tampered.tar.xz":     "IMAGE",
+		"truncated.metadata":  fmt.Sprintf(`{"image": {"file": "truncated.tar.xz", "sha256": "%s", "size": 5}}`, checksum),
+		"truncated.tar.xz":    "ima",
+		"unchecked.metadata":  `{"image": {"file": "unchecked.tar.xz"}}`,
+		"unchecked.tar.xz":    "image",
+		"unreadable.metadata": "{",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(content), 0644); err != nil {
+			t.Fatalf("error writing file: %v", err)
+		}
+	}
+
+	v := NewChecksumVerifier()
+	for _, test := range []struct {
+		file   string
+		reason string
+	}{
+		{"salt-api.metadata", ""},
+		{"salt-api.tar.xz", ""},
+		{"tampered.metadata", ""},
+		{"tampered.tar.xz", ReasonDigestMismatch},
+		{"truncated.metadata", ""},
+		{"truncated.tar.xz", ReasonSizeMismatch},
+		{"unchecked.metadata", ReasonNoChecksum},
+		{"unchecked.tar.xz", ReasonNoChecksum},
+		{"unreadable.metadata", ReasonUnreadable},
+	} {
+		_, err := v.Verify(filepath.Join(dir, test.file))
+		if test.reason == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.file, err)
+			}
+			continue
+		}
+		verr, ok := err.(*VerificationError)
+		if !ok {
+			t.Errorf("%s: expected verification error, got %v", test.file, err)
+		} else if verr.Reason != test.reason {
+			t.Errorf("%s: expected %s, got %s", test.file, test.reason, verr.Reason)
+		}
+	}
+
+	// the image file is verified again once its checksum changed
+	other := fmt.Sprintf("%x", sha256.Sum256([]byte("other")))
+	metadata := fmt.Sprintf(`{"image": {"file": "salt-api.tar.xz", "sha256": "%s"}}`, other)
+	if err := ioutil.WriteFile(filepath.Join(dir, "salt-api.metadata"), []byte(metadata), 0644); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	if _, err := v.Verify(filepath.Join(dir, "salt-api.metadata")); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := v.Verify(filepath.Join(dir, "salt-api.tar.xz")); err == nil {
+		t.Error("expected the image file to fail the new checksum")
+	}
+}
+
+func TestNewVerifier(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"":               true,
+		VerifierRPM:      true,
+		VerifierDpkg:     true,
+		VerifierChecksum: true,
+		VerifierNone:     true,
+		"md5":            false,
+	} {
+		_, err := NewVerifier(name)
+		if valid && err != nil {
+			t.Errorf("unexpected error for '%s': %v", name, err)
+		} else if !valid && err == nil {
+			t.Errorf("error expected for '%s'", name)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package walker
+
+import (
+	"bufio"
+	"crypto/md5"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// dpkgFile is a file as recorded by its package
+type dpkgFile struct {
+	pkg    string
+	digest string
+}
+
+// DpkgVerifier verifies files against the md5 digests recorded in the dpkg
+// database. The database is read once, and again once a package has been
+// installed or removed. The outcome of the verification of every file is
+// cached until the file changes.
+type DpkgVerifier struct {
+	// the directory holding the <package>.md5sums files
+	InfoDir string
+	// the file listing the versions of the installed packages
+	StatusFile string
+
+	cache fileCache
+	// the modification time of InfoDir when the database has been read
+	loaded time.Time
+	// the files shipped by the packages, by path
+	files map[string]dpkgFile
+}
+
+func NewDpkgVerifier() *DpkgVerifier {
+	return &DpkgVerifier{
+		InfoDir:    "/var/lib/dpkg/info",
+		StatusFile: "/var/lib/dpkg/status",
+	}
+}
+
+// the verifier shared by the walkers using dpkg
+var defaultDpkgVerifier = NewDpkgVerifier()
+
+// Verify checks the file stored at path, or all the files stored inside of it
+// when it is a directory, against the dpkg database. Returns the package
+// shipping it, in the form name_version_arch, or a *VerificationError.
+func (v *DpkgVerifier) Verify(path string) (string, error) {
+	return v.cache.verify(path, v.checkFile)
+}
+
+// checkFile compares the file stored at path with the record of its package
+func (v *DpkgVerifier) checkFile(path string) (string, error) {
+	if err := v.load(); err != nil {
+		return "", &VerificationError{File: path, Reason: ReasonQueryFailed, Err: err}
+	}
+	recorded, ok := v.files[path]
+	if !ok {
+		return "", &VerificationError{File: path, Reason: ReasonNotOwned}
+	}
+	// the sizes are not recorded
+	if err := verifyDigest(path, recorded.pkg, -1, recorded.digest, md5.New); err != nil {
+		return "", err
+	}
+	return recorded.pkg, nil
+}
+
+// load reads the dpkg database, unless it did not change since it has been
+// read
+func (v *DpkgVerifier) load() error {
+	info, err := os.Stat(v.InfoDir)
+	if err != nil {
+		return err
+	}
+	if v.files != nil && info.ModTime().Equal(v.loaded) {
+		return nil
+	}
+	log.Debugf("Reading the dpkg database in %s", v.InfoDir)
+
+	versions, err := v.packageVersions()
+	if err != nil {
+		return err
+	}
+	md5sums, err := filepath.Glob(filepath.Join(v.InfoDir, "*.md5sums"))
+	if err != nil {
+		return err
+	}
+	files := make(map[string]dpkgFile)
+	for _, md5sum := range md5sums {
+		name := strings.TrimSuffix(filepath.Base(md5sum), ".md5sums")
+		// the files of the packages removed, or not fully installed, are
+		// not trusted
+		pkg, ok := versions[name]
+		if !ok {
+			continue
+		}
+		if err := readMD5Sums(md5sum, pkg, files); err != nil {
+			return err
+		}
+	}
+	v.files = files
+	v.loaded = info.ModTime()
+	return nil
+}
+
+// readMD5Sums adds the files listed in the md5sums file stored at path,
+// shipped by pkg, to files
+func readMD5Sums(path, pkg string, files map[string]dpkgFile) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// <md5>  <path relative to />
+		fields := strings.SplitN(scanner.Text(), "  ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		files["/"+strings.TrimPrefix(fields[1], "/")] = dpkgFile{pkg: pkg, digest: fields[0]}
+	}
+	return scanner.Err()
+}
+
+// packageVersions returns the installed packages, as name_version_arch, by
+// the possible names of their md5sums file: name and name:arch, used by the
+// multi-arch packages
+func (v *DpkgVerifier) packageVersions() (map[string]string, error) {
+	file, err := os.Open(v.StatusFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	versions := make(map[string]string)
+	fields := make(map[string]string)
+	record := func() {
+		if name := fields["Package"]; name != "" && fields["Status"] == "install ok installed" {
+			pkg := fmt.Sprintf("%s_%s_%s", name, fields["Version"], fields["Architecture"])
+			versions[name] = pkg
+			versions[name+":"+fields["Architecture"]] = pkg
+		}
+		fields = make(map[string]string)
+	}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			record()
+			continue
+		}
+		if kv := strings.SplitN(line, ":", 2); len(kv) == 2 && !strings.HasPrefix(line, " ") {
+			fields[kv[0]] = strings.TrimSpace(kv[1])
+		}
+	}
+	record()
+	return versions, scanner.Err()
+}
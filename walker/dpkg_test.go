@@ -0,0 +1,158 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package walker
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const dpkgStatus = `Package: images
+Status: install ok installed
+Architecture: amd64
+Version: 1.0-1
+Description: container images
+ shipped as files
+
+Package: tools
+Status: install ok installed
+Architecture: all
+Version: 2.0
+
+Package: removed
+Status: deinstall ok config-files
+Architecture: all
+Version: 1.0
+
+Package: unpacked
+Status: install ok unpacked
+Architecture: all
+Version: 1.0
+`
+
+// writeMD5Sums writes the md5sums file of pkg, inside of info, listing the
+// files of packaged with their content
+func writeMD5Sums(t *testing.T, info, pkg string, packaged map[string]string) {
+	md5sums := ""
+	for file, content := range packaged {
+		md5sums += fmt.Sprintf("%x  %s\n", md5.Sum([]byte(content)), strings.TrimPrefix(file, "/"))
+	}
+	if err := ioutil.WriteFile(filepath.Join(info, pkg+".md5sums"), []byte(md5sums), 0644); err != nil {
+		t.Fatalf("error writing md5sums: %v", err)
+	}
+}
+
+func TestDpkgVerifier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-dpkg")
+	if err != nil {
+		t.Fatalf("error while creating test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	images := filepath.Join(dir, "images")
+	info := filepath.Join(dir, "info")
+	for _, d := range []string{images, info} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatalf("error creating dir: %v", err)
+		}
+	}
+	for file, content := range map[string]string{
+		"salt-api.metadata":  "metadata",
+		"salt-api.tar.xz":    "image",
+		"tampered.tar.xz":    "tampered",
+		"not-owned.metadata": "metadata",
+		"removed.metadata":   "metadata",
+		"unpacked.metadata":  "metadata",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(images, file), []byte(content), 0644); err != nil {
+			t.Fatalf("error writing file: %v", err)
+		}
+	}
+	status := filepath.Join(dir, "status")
+	if err := ioutil.WriteFile(status, []byte(dpkgStatus), 0644); err != nil {
+		t.Fatalf("error writing status: %v", err)
+	}
+	writeMD5Sums(t, info, "images:amd64", map[string]string{
+		filepath.Join(images, "salt-api.metadata"): "metadata",
+		filepath.Join(images, "salt-api.tar.xz"):   "image",
+		filepath.Join(images, "tampered.tar.xz"):   "original",
+	})
+
+	// the packages which are not fully installed do not own their files
+	writeMD5Sums(t, info, "removed", map[string]string{
+		filepath.Join(images, "removed.metadata"): "metadata",
+	})
+	writeMD5Sums(t, info, "unpacked", map[string]string{
+		filepath.Join(images, "unpacked.metadata"): "metadata",
+	})
+
+	v := NewDpkgVerifier()
+	v.InfoDir = info
+	v.StatusFile = status
+
+	for file, reason := range map[string]string{
+		"salt-api.metadata":  "",
+		"salt-api.tar.xz":    "",
+		"tampered.tar.xz":    ReasonDigestMismatch,
+		"not-owned.metadata": ReasonNotOwned,
+		"removed.metadata":   ReasonNotOwned,
+		"unpacked.metadata":  ReasonNotOwned,
+		"missing.metadata":   ReasonUnreadable,
+	} {
+		pkg, err := v.Verify(filepath.Join(images, file))
+		if reason == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", file, err)
+			} else if pkg != "images_1.0-1_amd64" {
+				t.Errorf("%s: unexpected package %s", file, pkg)
+			}
+			continue
+		}
+		verr, ok := err.(*VerificationError)
+		if !ok {
+			t.Errorf("%s: expected verification error, got %v", file, err)
+		} else if verr.Reason != reason {
+			t.Errorf("%s: expected %s, got %s", file, reason, verr.Reason)
+		}
+	}
+
+	// the database is read again once a package has been installed
+	writeMD5Sums(t, info, "tools", map[string]string{
+		filepath.Join(images, "not-owned.metadata"): "metadata",
+	})
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(info, later, later); err != nil {
+		t.Fatalf("error touching info dir: %v", err)
+	}
+	// the outcome of the previous verification is cached until the file
+	// changes
+	if err := os.Chtimes(filepath.Join(images, "not-owned.metadata"), later, later); err != nil {
+		t.Fatalf("error touching file: %v", err)
+	}
+	if pkg, err := v.Verify(filepath.Join(images, "not-owned.metadata")); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if pkg != "tools_2.0_all" {
+		t.Errorf("unexpected package %s", pkg)
+	}
+}
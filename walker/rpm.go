@@ -0,0 +1,226 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package walker
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// the digest algorithms of the files, by their rpm identifier
+var rpmDigestAlgorithms = map[string]func() hash.Hash{
+	"1":  md5.New,
+	"2":  sha1.New,
+	"8":  sha256.New,
+	"9":  sha512.New384,
+	"10": sha512.New,
+	"11": sha256.New224,
+}
+
+// rpmFile is a file as recorded by its package
+type rpmFile struct {
+	size   int64
+	digest string
+}
+
+// rpmPackage is the list of the files shipped by a package
+type rpmPackage struct {
+	nevra string
+	// the digest algorithm of the files
+	algorithm func() hash.Hash
+	files     map[string]rpmFile
+}
+
+// RPMVerifier verifies files against the digests recorded in the RPM
+// database. The files shipped by a package are queried once, and the outcome
+// of the verification of every file is cached until the file changes.
+type RPMVerifier struct {
+	// the rpm program
+	Command string
+
+	cache fileCache
+
+	mu sync.Mutex
+	// the packages queried so far, by NEVRA
+	packages map[string]*rpmPackage
+}
+
+func NewRPMVerifier() *RPMVerifier {
+	return &RPMVerifier{
+		Command:  "rpm",
+		packages: make(map[string]*rpmPackage),
+	}
+}
+
+// the verifier shared by the walkers and VerifyPackage
+var defaultRPMVerifier = NewRPMVerifier()
+
+// Verify checks the file stored at path, or all the files stored inside of it
+// when it is a directory, against the RPM database. Returns the NEVRA of the
+// package shipping it, in the form name-epoch:version-release.arch, or a
+// *VerificationError.
+func (v *RPMVerifier) Verify(path string) (string, error) {
+	return v.cache.verify(path, v.checkFile)
+}
+
+// checkFile compares the file stored at path with the record of its package
+func (v *RPMVerifier) checkFile(path string) (string, error) {
+	pkg, recorded, err := v.owner(path)
+	if err != nil {
+		return "", err
+	}
+	if err := verifyDigest(path, pkg.nevra, recorded.size, recorded.digest, pkg.algorithm); err != nil {
+		return "", err
+	}
+	return pkg.nevra, nil
+}
+
+// owner returns the package shipping the file stored at path, queried once
+// per package, and the record of the file. The owner is looked up every time
+// the file is checked, as the file changed since the last check: an upgrade
+// ships it in another package.
+func (v *RPMVerifier) owner(path string) (*rpmPackage, rpmFile, error) {
+	// the `rpm` command exits with an error when the file is not managed by RPM
+	out, err := exec.Command(
+		v.Command,
+		"-qf",
+		"--queryformat",
+		"%{NAME}-%{VERSION}-%{RELEASE}.%{ARCH} %{NAME}-%{EPOCHNUM}:%{VERSION}-%{RELEASE}.%{ARCH}\n",
+		path).Output()
+	if _, ok := err.(*exec.ExitError); ok {
+		return nil, rpmFile{}, &VerificationError{File: path, Reason: ReasonNotOwned}
+	} else if err != nil {
+		return nil, rpmFile{}, &VerificationError{File: path, Reason: ReasonQueryFailed, Err: err}
+	}
+	// a file shipped by several packages is verified against the first one
+	fields := strings.Fields(strings.SplitN(string(out), "\n", 2)[0])
+	if len(fields) != 2 {
+		return nil, rpmFile{}, &VerificationError{
+			File:   path,
+			Reason: ReasonQueryFailed,
+			Err:    fmt.Errorf("unexpected output of rpm -qf: %q", out),
+		}
+	}
+	rpm, nevra := fields[0], fields[1]
+
+	pkg, err := v.cachedPackage(rpm, nevra)
+	if err != nil {
+		return nil, rpmFile{}, &VerificationError{File: path, Reason: ReasonQueryFailed, Package: nevra, Err: err}
+	}
+	recorded, ok := pkg.files[path]
+	if !ok {
+		// rpm resolves the symbolic links leading to the file, its
+		// package records where the file really is
+		resolved, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			return nil, rpmFile{}, &VerificationError{File: path, Reason: ReasonUnreadable, Package: nevra, Err: err}
+		}
+		if recorded, ok = pkg.files[resolved]; !ok {
+			return nil, rpmFile{}, &VerificationError{File: path, Reason: ReasonNotOwned, Package: nevra}
+		}
+	}
+	return pkg, recorded, nil
+}
+
+// cachedPackage returns the package nevra, named rpm, querying it unless it
+// has been queried already
+func (v *RPMVerifier) cachedPackage(rpm, nevra string) (*rpmPackage, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if pkg, ok := v.packages[nevra]; ok {
+		return pkg, nil
+	}
+	pkg, err := v.queryPackage(rpm, nevra)
+	if err != nil {
+		return nil, err
+	}
+	// the upgraded package replaces the previous one
+	for cached := range v.packages {
+		if packageName(cached) == packageName(nevra) {
+			delete(v.packages, cached)
+		}
+	}
+	v.packages[nevra] = pkg
+	return pkg, nil
+}
+
+// packageName returns the name of the package nevra, in the form
+// name-epoch:version-release.arch
+func packageName(nevra string) string {
+	if i := strings.LastIndex(nevra, ":"); i >= 0 {
+		nevra = nevra[:i]
+	}
+	if i := strings.LastIndex(nevra, "-"); i >= 0 {
+		return nevra[:i]
+	}
+	return nevra
+}
+
+// queryPackage reads the digests and sizes of the files shipped by the
+// package rpm from the RPM database
+func (v *RPMVerifier) queryPackage(rpm, nevra string) (*rpmPackage, error) {
+	log.Debugf("Querying the files of %s", nevra)
+	out, err := exec.Command(
+		v.Command,
+		"-q",
+		"--queryformat",
+		"%{FILEDIGESTALGO}\n[%{FILENAMES}\t%{FILESIZES}\t%{FILEDIGESTS}\n]",
+		rpm).Output()
+	if err != nil {
+		return nil, err
+	}
+
+	pkg := &rpmPackage{nevra: nevra, files: make(map[string]rpmFile)}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("unexpected output of rpm -q %s: %q", rpm, out)
+	}
+	algorithm := strings.TrimSpace(scanner.Text())
+	// packages lacking the algorithm predate sha256 digests
+	if algorithm == "(none)" {
+		algorithm = "1"
+	}
+	pkg.algorithm = rpmDigestAlgorithms[algorithm]
+
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("unexpected output of rpm -q %s: %q", rpm, scanner.Text())
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected output of rpm -q %s: %q", rpm, scanner.Text())
+		}
+		pkg.files[fields[0]] = rpmFile{size: size, digest: fields[2]}
+	}
+	return pkg, scanner.Err()
+}
@@ -0,0 +1,287 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package walker
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeRPM is a stand-in for the rpm program: it records its arguments and
+// answers like an RPM database holding a single package, shipping the files
+// listed in the "files" file next to it. The package is images-1.0-1, unless
+// the "package" file next to it names another version. Like rpm, it resolves
+// the symbolic links leading to the files it looks up.
+const fakeRPM = `#!/bin/sh
+dir="$(dirname "$0")"
+echo "$@" >> "$dir/calls"
+case "$1" in
+-qf)
+	if grep -q "^$(readlink -f "$4")	" "$dir/files"; then
+		cat "$dir/package" 2>/dev/null || echo "images-1.0-1.noarch images-0:1.0-1.noarch"
+	else
+		echo "file $4 is not owned by any package"
+		exit 1
+	fi
+	;;
+-q)
+	echo 8
+	cat "$dir/files"
+	;;
+esac
+`
+
+// newFakeRPMVerifier returns an RPMVerifier running fakeRPM, installed in
+// dir, which ships the files of packaged with their content
+func newFakeRPMVerifier(t *testing.T, dir string, packaged map[string]string) *RPMVerifier {
+	files := ""
+	for file, content := range packaged {
+		files += fmt.Sprintf("%s\t%d\t%x\n", file, len(content), sha256.Sum256([]byte(content)))
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "files"), []byte(files), 0644); err != nil {
+		t.Fatalf("error writing files: %v", err)
+	}
+	rpm := filepath.Join(dir, "rpm")
+	if err := ioutil.WriteFile(rpm, []byte(fakeRPM), 0755); err != nil {
+		t.Fatalf("error writing fake rpm: %v", err)
+	}
+	v := NewRPMVerifier()
+	v.Command = rpm
+	return v
+}
+
+// calls returns the calls to fakeRPM installed in dir starting with prefix
+func calls(dir, prefix string) int {
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "calls"))
+	n := 0
+	for _, call := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(call, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestRPMVerifier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-rpm")
+	if err != nil {
+		t.Fatalf("error while creating test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	images := filepath.Join(dir, "images")
+	if err := os.MkdirAll(filepath.Join(images, "salt-api", "blobs"), 0755); err != nil {
+		t.Fatalf("error creating dir: %v", err)
+	}
+	onDisk := map[string]string{
+		"salt-api.metadata":    "metadata",
+		"salt-api.tar.xz":      "image",
+		"salt-api/index.json":  "index",
+		"salt-api/blobs/layer": "layer",
+		"tampered.tar.xz":      "tampered",
+		"truncated.tar.xz":     "trunc",
+		"not-owned.metadata":   "metadata",
+	}
+	packaged := map[string]string{
+		"salt-api.metadata":    "metadata",
+		"salt-api.tar.xz":      "image",
+		"salt-api/index.json":  "index",
+		"salt-api/blobs/layer": "layer",
+		"tampered.tar.xz":      "original",
+		"truncated.tar.xz":     "truncated",
+	}
+	for file, content := range onDisk {
+		if err := ioutil.WriteFile(filepath.Join(images, file), []byte(content), 0644); err != nil {
+			t.Fatalf("error writing file: %v", err)
+		}
+	}
+	absolute := make(map[string]string)
+	for file, content := range packaged {
+		absolute[filepath.Join(images, file)] = content
+	}
+	v := newFakeRPMVerifier(t, dir, absolute)
+
+	for file, reason := range map[string]string{
+		"salt-api.metadata":  "",
+		"salt-api.tar.xz":    "",
+		"salt-api":           "",
+		"tampered.tar.xz":    ReasonDigestMismatch,
+		"truncated.tar.xz":   ReasonSizeMismatch,
+		"not-owned.metadata": ReasonNotOwned,
+		"missing.metadata":   ReasonUnreadable,
+	} {
+		nevra, err := v.Verify(filepath.Join(images, file))
+		if reason == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", file, err)
+			} else if nevra != "images-0:1.0-1.noarch" {
+				t.Errorf("%s: unexpected package %s", file, nevra)
+			}
+			continue
+		}
+		verr, ok := err.(*VerificationError)
+		if !ok {
+			t.Errorf("%s: expected verification error, got %v", file, err)
+		} else if verr.Reason != reason {
+			t.Errorf("%s: expected %s, got %s", file, reason, verr.Reason)
+		}
+	}
+
+	// the files of the package are only queried once, the files of a known
+	// package are not looked up again
+	if n := calls(dir, "-q --queryformat"); n != 1 {
+		t.Errorf("expected the package to be queried once, got %d queries", n)
+	}
+	lookups := calls(dir, "-qf")
+	if _, err := v.Verify(filepath.Join(images, "salt-api.tar.xz")); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if n := calls(dir, "-qf"); n != lookups {
+		t.Errorf("expected the verified file not to be looked up again, got %d lookups", n-lookups)
+	}
+
+	// changed files are verified again
+	if err := ioutil.WriteFile(filepath.Join(images, "salt-api.tar.xz"), []byte("new image"), 0644); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	if _, err := v.Verify(filepath.Join(images, "salt-api.tar.xz")); err == nil {
+		t.Error("expected the changed file to fail the verification")
+	}
+}
+
+func TestRPMVerifierSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-rpm")
+	if err != nil {
+		t.Fatalf("error while creating test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the images are found through a symbolic link to the directory the
+	// package ships them in
+	images := filepath.Join(dir, "images")
+	link := filepath.Join(dir, "link")
+	if err := os.Mkdir(images, 0755); err != nil {
+		t.Fatalf("error creating dir: %v", err)
+	}
+	if err := os.Symlink(images, link); err != nil {
+		t.Fatalf("error creating link: %v", err)
+	}
+	image := filepath.Join(images, "salt-api.tar.xz")
+	if err := ioutil.WriteFile(image, []byte("image"), 0644); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	v := newFakeRPMVerifier(t, dir, map[string]string{image: "image"})
+
+	if nevra, err := v.Verify(filepath.Join(link, "salt-api.tar.xz")); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if nevra != "images-0:1.0-1.noarch" {
+		t.Errorf("unexpected package %s", nevra)
+	}
+}
+
+func TestRPMVerifierUpgrade(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-rpm")
+	if err != nil {
+		t.Fatalf("error while creating test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := filepath.Join(dir, "salt-api.tar.xz")
+	if err := ioutil.WriteFile(image, []byte("image 1.0"), 0644); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	v := newFakeRPMVerifier(t, dir, map[string]string{image: "image 1.0"})
+	if nevra, err := v.Verify(image); err != nil || nevra != "images-0:1.0-1.noarch" {
+		t.Fatalf("unexpected verification: %s, %v", nevra, err)
+	}
+
+	// the upgrade ships new content in a new package
+	if err := ioutil.WriteFile(image, []byte("image 1.1.0"), 0644); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	newFakeRPMVerifier(t, dir, map[string]string{image: "image 1.1.0"})
+	if err := ioutil.WriteFile(filepath.Join(dir, "package"), []byte("images-1.1-1.noarch images-0:1.1-1.noarch\n"), 0644); err != nil {
+		t.Fatalf("error writing package: %v", err)
+	}
+	if nevra, err := v.Verify(image); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if nevra != "images-0:1.1-1.noarch" {
+		t.Errorf("unexpected package %s", nevra)
+	}
+	if len(v.packages) != 1 || v.packages["images-0:1.1-1.noarch"] == nil {
+		t.Errorf("expected the new package to replace the previous one, got %v", v.packages)
+	}
+}
+
+func TestRPMVerifierWithoutRPM(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-rpm")
+	if err != nil {
+		t.Fatalf("error while creating test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "salt-api.metadata")
+	if err := ioutil.WriteFile(file, []byte("metadata"), 0644); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	v := NewRPMVerifier()
+	v.Command = filepath.Join(dir, "rpm")
+	_, err = v.Verify(file)
+	if verr, ok := err.(*VerificationError); !ok || verr.Reason != ReasonQueryFailed {
+		t.Errorf("expected the query to fail, got %v", err)
+	}
+}
+
+func TestWalkerFailures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-rpm")
+	if err != nil {
+		t.Fatalf("error while creating test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	images := filepath.Join(dir, "images")
+	if err := os.Mkdir(images, 0755); err != nil {
+		t.Fatalf("error creating dir: %v", err)
+	}
+	for _, name := range []string{"packaged.metadata", "local.metadata"} {
+		if err := ioutil.WriteFile(filepath.Join(images, name), []byte("metadata"), 0644); err != nil {
+			t.Fatalf("error writing file: %v", err)
+		}
+	}
+
+	walker := NewWalker(images, ".metadata")
+	walker.Verifier = newFakeRPMVerifier(t, dir, map[string]string{filepath.Join(images, "packaged.metadata"): "metadata"})
+	if err := filepath.Walk(images, walker.Scan); err != nil {
+		t.Errorf("walker error: %v", err)
+	}
+
+	if len(walker.Files) != 1 || walker.Files[0] != "packaged.metadata" {
+		t.Errorf("Unexpected files found by walker: %v", walker.Files)
+	}
+	if walker.Packages["packaged.metadata"] != "images-0:1.0-1.noarch" {
+		t.Errorf("Unexpected packages found by walker: %v", walker.Packages)
+	}
+	if verr, ok := walker.Failures["local.metadata"].(*VerificationError); !ok || verr.Reason != ReasonNotOwned {
+		t.Errorf("Unexpected failures found by walker: %v", walker.Failures)
+	}
+}
@@ -0,0 +1,231 @@
+/*
+ * container-feeder: import Linux container images delivered as RPMs
+ * Copyright 2018 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package walker
+
+import (
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The names of the verifiers
+const (
+	// the files are verified against the RPM database (default)
+	VerifierRPM = "rpm"
+	// the files are verified against the dpkg database
+	VerifierDpkg = "dpkg"
+	// the image files are verified against the checksum of their .metadata
+	// file, which is trusted as it is
+	VerifierChecksum = "checksum"
+	// the files are trusted as they are
+	VerifierNone = "none"
+)
+
+// The reasons a file fails the verification
+const (
+	// the file is not shipped by any package
+	ReasonNotOwned = "not-owned"
+	// the package database could not be queried
+	ReasonQueryFailed = "query-failed"
+	// the file could not be read
+	ReasonUnreadable = "unreadable"
+	// the size of the file is not the one recorded by its package
+	ReasonSizeMismatch = "size-mismatch"
+	// the digest of the file is not the one recorded by its package
+	ReasonDigestMismatch = "digest-mismatch"
+	// the package records the digest with an unsupported algorithm
+	ReasonUnsupportedDigest = "unsupported-digest"
+	// no checksum of the file is known
+	ReasonNoChecksum = "no-checksum"
+)
+
+// Verifier checks that the files found by a walker have not been tampered
+type Verifier interface {
+	// Verify checks the file stored at path, or all the files stored inside
+	// of it when it is a directory. Returns the package shipping it, empty
+	// when unknown, or a *VerificationError.
+	Verify(path string) (string, error)
+}
+
+// NewVerifier returns the named verifier. The rpm and dpkg verifiers are
+// shared, along with what they cached.
+func NewVerifier(name string) (Verifier, error) {
+	switch name {
+	case "", VerifierRPM:
+		return defaultRPMVerifier, nil
+	case VerifierDpkg:
+		return defaultDpkgVerifier, nil
+	case VerifierChecksum:
+		return NewChecksumVerifier(), nil
+	case VerifierNone:
+		return NoopVerifier{}, nil
+	}
+	return nil, fmt.Errorf("unknown verifier '%s'", name)
+}
+
+// VerificationError tells why a file failed the verification
+type VerificationError struct {
+	File string
+	// one of the Reason constants
+	Reason string
+	// the package shipping the file, empty when unknown
+	Package string
+	// the underlying error, if any
+	Err error
+}
+
+func (e *VerificationError) Error() string {
+	msg := fmt.Sprintf("%s: %s", e.File, e.Reason)
+	if e.Package != "" {
+		msg += fmt.Sprintf(" (%s)", e.Package)
+	}
+	if e.Err != nil {
+		msg += fmt.Sprintf(": %v", e.Err)
+	}
+	return msg
+}
+
+// NoopVerifier accepts every file
+type NoopVerifier struct{}
+
+func (NoopVerifier) Verify(path string) (string, error) {
+	if _, err := os.Stat(path); err != nil {
+		return "", &VerificationError{File: path, Reason: ReasonUnreadable, Err: err}
+	}
+	return "", nil
+}
+
+// verification is the cached outcome of the verification of a file, valid
+// as long as the file is unchanged
+type verification struct {
+	size    int64
+	modTime time.Time
+	pkg     string
+	err     error
+}
+
+// fileCache walks the directories to verify and caches the outcome of the
+// verification of every file until the file changes
+type fileCache struct {
+	mu      sync.Mutex
+	results map[string]verification
+}
+
+// verify checks the file stored at path, or all the regular files stored
+// inside of it when it is a directory, with check. Returns the package
+// shipping the first of them.
+func (c *fileCache) verify(path string, check func(path string) (string, error)) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", &VerificationError{File: path, Reason: ReasonUnreadable, Err: err}
+	}
+	if !info.IsDir() {
+		return c.verifyFile(path, info, check)
+	}
+
+	pkg := ""
+	err = filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return &VerificationError{File: file, Reason: ReasonUnreadable, Err: err}
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		filePkg, err := c.verifyFile(file, info, check)
+		if pkg == "" {
+			pkg = filePkg
+		}
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return pkg, nil
+}
+
+// verifyFile checks the regular file stored at path, described by info, with
+// check, or returns the cached outcome of its previous verification
+func (c *fileCache) verifyFile(path string, info os.FileInfo, check func(path string) (string, error)) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", &VerificationError{File: path, Reason: ReasonUnreadable, Err: err}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cached, ok := c.results[path]; ok && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached.pkg, cached.err
+	}
+	pkg, err := check(path)
+	if c.results == nil {
+		c.results = make(map[string]verification)
+	}
+	c.results[path] = verification{size: info.Size(), modTime: info.ModTime(), pkg: pkg, err: err}
+	return pkg, err
+}
+
+// forget drops the cached outcome of the verification of the file stored at
+// path
+func (c *fileCache) forget(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.results, path)
+}
+
+// verifyDigest compares the size and the digest, computed with algorithm, of
+// the file stored at path with the ones recorded by pkg
+func verifyDigest(path, pkg string, size int64, digest string, algorithm func() hash.Hash) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return &VerificationError{File: path, Reason: ReasonUnreadable, Package: pkg, Err: err}
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return &VerificationError{File: path, Reason: ReasonUnreadable, Package: pkg, Err: err}
+	}
+	if size >= 0 && info.Size() != size {
+		return &VerificationError{
+			File:    path,
+			Reason:  ReasonSizeMismatch,
+			Package: pkg,
+			Err:     fmt.Errorf("expected %d bytes, got %d", size, info.Size()),
+		}
+	}
+	if algorithm == nil {
+		return &VerificationError{File: path, Reason: ReasonUnsupportedDigest, Package: pkg}
+	}
+	h := algorithm()
+	if _, err := io.Copy(h, file); err != nil {
+		return &VerificationError{File: path, Reason: ReasonUnreadable, Package: pkg, Err: err}
+	}
+	if actual := fmt.Sprintf("%x", h.Sum(nil)); actual != digest {
+		return &VerificationError{
+			File:    path,
+			Reason:  ReasonDigestMismatch,
+			Package: pkg,
+			Err:     fmt.Errorf("expected %s, got %s", digest, actual),
+		}
+	}
+	return nil
+}
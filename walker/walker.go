@@ -18,23 +18,59 @@
 package walker
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// The ways the symbolic links are handled
+const (
+	// the links to files are followed, the links to directories are
+	// ignored (default)
+	SymlinksFiles = "files"
+	// the links to files and to directories are followed
+	SymlinksFollow = "follow"
+	// the links are ignored
+	SymlinksSkip = "skip"
+)
+
 // List the files inside of a directory.
-// Note well: doesn't walk recursively
+// Note well: doesn't walk recursively, unless Recursive is set
 // It's possible to list only the files matching a given extension,
 // remember to add the "." (eg: ".mp3")
 type Walker struct {
-	Root        string
-	Extension   string // only list files with this extension
+	Root      string
+	Extension string // only list files with this extension
+	// the paths of the files, relative to Root
 	Files       []string
 	VerifyFiles bool
+	// when set, the files it returns true for are known to be verified
+	// already and are not verified again
+	Verified func(path string) bool
+	// the NEVRA of the package shipping each of the files verified by the
+	// walker
+	Packages map[string]string
+	// why the files that failed the verification have been ignored, as
+	// *VerificationError
+	Failures map[string]error
+	// verifies the files when VerifyFiles is set, the RPM verifier shared by
+	// all the walkers by default
+	Verifier Verifier
+	// walk the subdirectories of Root as well
+	Recursive bool
+	// when set, only list the files matching one of these patterns
+	Include []string
+	// do not list the files, nor walk the directories, matching one of these
+	// patterns
+	Exclude []string
+	// one of the Symlinks constants, SymlinksFiles when empty
+	Symlinks string
+	// the subdirectories walked when Recursive is set
+	Dirs []string
 }
 
 func NewWalker(path, extension string) *Walker {
@@ -43,64 +79,160 @@ func NewWalker(path, extension string) *Walker {
 		Extension:   extension,
 		Root:        path,
 		VerifyFiles: true,
+		Packages:    make(map[string]string),
+		Failures:    make(map[string]error),
+		Verifier:    defaultRPMVerifier,
 	}
 }
 
+// Scan is a filepath.WalkFunc listing the files found while walking Root.
+// The links to directories are never followed: use Walk to follow them.
 func (w *Walker) Scan(path string, f os.FileInfo, err error) error {
 	if err != nil {
 		return err
 	}
+	if path == w.Root {
+		return nil
+	}
 
-	if f.IsDir() && path != w.Root {
-		return filepath.SkipDir
+	rel, err := filepath.Rel(w.Root, path)
+	if err != nil {
+		return err
+	}
+	if f.IsDir() {
+		if !w.Recursive || Match(w.Exclude, rel) {
+			return filepath.SkipDir
+		}
+		w.Dirs = append(w.Dirs, path)
+		return nil
+	}
+	if f.Mode()&os.ModeSymlink != 0 && w.Symlinks == SymlinksSkip {
+		return nil
+	}
+	w.add(path, rel)
+	return nil
+}
+
+// Walk lists the files stored inside of Root, following the links to
+// directories when Symlinks is SymlinksFollow. Every directory is walked
+// once, whatever the number of links to it.
+func (w *Walker) Walk() error {
+	info, err := os.Stat(w.Root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", w.Root)
 	}
+	root, err := filepath.EvalSymlinks(w.Root)
+	if err != nil {
+		return err
+	}
+	return w.walkDir(w.Root, map[string]bool{root: true})
+}
 
-	if path != w.Root {
-		add := true
+// walkDir lists the files stored inside of dir, skipping the directories
+// already visited
+func (w *Walker) walkDir(dir string, visited map[string]bool) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		rel, err := filepath.Rel(w.Root, path)
+		if err != nil {
+			return err
+		}
 
-		if w.Extension != "" && strings.ToLower(w.Extension) != strings.ToLower(filepath.Ext(path)) {
-			add = false
-		} else if w.VerifyFiles {
-			var verifyErr error
-			add, verifyErr = Verify(path)
-			if verifyErr != nil {
-				log.Warnf("Ignoring file %s because verification failed %v", path, verifyErr)
+		info := entry
+		if entry.Mode()&os.ModeSymlink != 0 {
+			if w.Symlinks == SymlinksSkip {
+				continue
+			}
+			if info, err = os.Stat(path); err != nil {
+				log.Debugf("Ignoring broken link %s: %v", path, err)
+				continue
+			}
+			if info.IsDir() && w.Symlinks != SymlinksFollow {
+				continue
 			}
 		}
-		if add {
-			w.Files = append(w.Files, filepath.Base(path))
+
+		if !info.IsDir() {
+			w.add(path, rel)
+			continue
+		}
+		if !w.Recursive || Match(w.Exclude, rel) {
+			continue
+		}
+		real, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			return err
+		}
+		if visited[real] {
+			log.Debugf("Ignoring directory %s: already walked", path)
+			continue
+		}
+		visited[real] = true
+		w.Dirs = append(w.Dirs, path)
+		if err := w.walkDir(path, visited); err != nil {
+			return err
 		}
 	}
-
 	return nil
 }
 
+// add lists the file stored at path, rel being its path relative to Root,
+// if it matches and passes the verification
+func (w *Walker) add(path, rel string) {
+	if w.Extension != "" && strings.ToLower(w.Extension) != strings.ToLower(filepath.Ext(path)) {
+		return
+	}
+	if (len(w.Include) > 0 && !Match(w.Include, rel)) || Match(w.Exclude, rel) {
+		return
+	}
+	if w.VerifyFiles && (w.Verified == nil || !w.Verified(path)) {
+		nevra, verifyErr := w.Verifier.Verify(path)
+		if verifyErr != nil {
+			log.Debugf("Ignoring file %s because verification failed %v", path, verifyErr)
+			w.Failures[rel] = verifyErr
+			return
+		}
+		w.Packages[rel] = nevra
+	}
+	w.Files = append(w.Files, rel)
+}
+
+// Match returns true if the path rel, relative to the walked directory,
+// matches one of the patterns. The patterns holding a "/" are matched against
+// the whole path, the others against the name of the file only.
+func Match(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		name := rel
+		if !strings.Contains(pattern, "/") {
+			name = filepath.Base(rel)
+		}
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
 // Verifies the file has not been tampered
-// The check is done using the information inside of the
+// The check is done using the digest recorded inside of the
 // RPM database.
 // Returns false if the file is not part of a RPM package.
 func Verify(file string) (bool, error) {
-	// figure out the name of the package shipping the file
-	// the `rpm` command exits with an error when the file is not managed by RPM
-	out, err := exec.Command(
-		"rpm",
-		"-qf",
-		file).Output()
-	if err != nil {
-		return false, err
-	}
-	rpm := strings.Trim(string(out[:]), "\n")
-
-	// verifies the whole rpm
-	// the `rpm` command exits with an error when the verification fails
-	_, err = exec.Command(
-		"rpm",
-		"--verify",
-		rpm).Output()
-
-	if err != nil {
+	if _, err := VerifyPackage(file); err != nil {
 		return false, err
 	}
-
 	return true, nil
 }
+
+// VerifyPackage works like Verify and returns the NEVRA of the package
+// shipping the file, in the form name-epoch:version-release.arch
+func VerifyPackage(file string) (string, error) {
+	return defaultRPMVerifier.Verify(file)
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 	"testing"
 )
 
@@ -140,3 +141,102 @@ func TestWalkerNonExistingDirectory(t *testing.T) {
 		t.Errorf("error was expected")
 	}
 }
+
+func TestWalkerWithVerifiedFiles(t *testing.T) {
+	topDir, err := ioutil.TempDir("", "test-walker")
+	if err != nil {
+		t.Errorf("error while creating test dir: %v", err)
+	}
+	defer os.RemoveAll(topDir)
+
+	for _, name := range []string{"verified.mp3", "unknown.mp3"} {
+		if err := ioutil.WriteFile(filepath.Join(topDir, name), nil, 0644); err != nil {
+			t.Errorf("error creating file: %v", err)
+		}
+	}
+
+	// files that are not shipped by a package fail the verification
+	walker := NewWalker(topDir, ".mp3")
+	walker.Verified = func(path string) bool {
+		return filepath.Base(path) == "verified.mp3"
+	}
+	if err := filepath.Walk(topDir, walker.Scan); err != nil {
+		t.Errorf("walker error: %v", err)
+	}
+
+	if len(walker.Files) != 1 || walker.Files[0] != "verified.mp3" {
+		t.Errorf("Unexpected files found by walker: %v", walker.Files)
+	}
+}
+
+func TestWalkerRecursive(t *testing.T) {
+	topDir, err := ioutil.TempDir("", "test-walker")
+	if err != nil {
+		t.Fatalf("error while creating test dir: %v", err)
+	}
+	defer os.RemoveAll(topDir)
+
+	images := filepath.Join(topDir, "images")
+	others := filepath.Join(topDir, "others")
+	for _, dir := range []string{
+		filepath.Join(images, "caasp", "4.0"),
+		filepath.Join(images, "testing"),
+		others,
+	} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("error creating dir: %v", err)
+		}
+	}
+	for _, file := range []string{
+		filepath.Join(images, "top.mp3"),
+		filepath.Join(images, "caasp", "4.0", "velum.mp3"),
+		filepath.Join(images, "caasp", "4.0", "velum-debug.mp3"),
+		filepath.Join(images, "testing", "test.mp3"),
+		filepath.Join(others, "other.mp3"),
+	} {
+		if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+	}
+	for link, target := range map[string]string{
+		filepath.Join(images, "linked.mp3"): filepath.Join(others, "other.mp3"),
+		filepath.Join(images, "others"):     others,
+		// loops are walked once
+		filepath.Join(images, "caasp", "loop"): images,
+	} {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatalf("error creating link: %v", err)
+		}
+	}
+
+	for _, test := range []struct {
+		recursive bool
+		include   []string
+		exclude   []string
+		symlinks  string
+		expected  []string
+	}{
+		{false, nil, nil, "", []string{"linked.mp3", "top.mp3"}},
+		{false, nil, nil, SymlinksSkip, []string{"top.mp3"}},
+		{true, nil, nil, "", []string{"caasp/4.0/velum-debug.mp3", "caasp/4.0/velum.mp3", "linked.mp3", "testing/test.mp3", "top.mp3"}},
+		{true, nil, nil, SymlinksFollow, []string{"caasp/4.0/velum-debug.mp3", "caasp/4.0/velum.mp3", "linked.mp3", "others/other.mp3", "testing/test.mp3", "top.mp3"}},
+		{true, []string{"caasp/*/*"}, []string{"*-debug.mp3"}, "", []string{"caasp/4.0/velum.mp3"}},
+		{true, nil, []string{"testing", "linked.*"}, SymlinksSkip, []string{"caasp/4.0/velum-debug.mp3", "caasp/4.0/velum.mp3", "top.mp3"}},
+	} {
+		walker := NewWalker(images, ".mp3")
+		walker.VerifyFiles = false
+		walker.Recursive = test.recursive
+		walker.Include = test.include
+		walker.Exclude = test.exclude
+		walker.Symlinks = test.symlinks
+		if err := walker.Walk(); err != nil {
+			t.Errorf("walker error: %v", err)
+			continue
+		}
+		actual := walker.Files
+		sort.Strings(actual)
+		if strings.Join(actual, " ") != strings.Join(test.expected, " ") {
+			t.Errorf("%+v: expected %v - found %v", test, test.expected, actual)
+		}
+	}
+}